@@ -11,6 +11,7 @@ import (
 	"github.com/lenarlenar/go-my-metrics-service/internal/collector"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
 	"github.com/lenarlenar/go-my-metrics-service/internal/sender"
+	"github.com/lenarlenar/go-my-metrics-service/internal/statsd"
 	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
 	"github.com/lenarlenar/go-my-metrics-service/internal/workerpool"
 )
@@ -33,38 +34,43 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	flags := flags.GetFlags()
-	storage := storage.NewMemStorage()
+	// Агенту нужны только последние значения метрик, история не хранится.
+	storage := storage.NewMemStorageWithoutHistory()
 
-	tickerPoll := time.NewTicker(flags.PollInterval)
-	defer tickerPoll.Stop()
-	go func() {
-		for {
-			select {
-			case <-tickerPoll.C:
-				collector.UpdateMetrics(storage)
-			case <-ctx.Done():
-				return
-			}
+	collectors, err := collector.New(flags)
+	if err != nil {
+		log.I().Fatal(err)
+	}
+	log.I().Infof("Источники метрик: %v\n", collectors.Names())
+	go collectors.Run(ctx, storage)
+
+	// Метрики локальных приложений попадают в то же хранилище и уходят на сервер
+	// вместе с собственными метриками агента.
+	for _, l := range []struct{ network, address string }{
+		{"udp", flags.StatsDAddress},
+		{"unixgram", flags.StatsDSocket},
+	} {
+		if l.address == "" {
+			continue
 		}
-	}()
+		listener, err := statsd.Listen(l.network, l.address, storage)
+		if err != nil {
+			log.I().Fatal(err)
+		}
+		log.I().Infof("Приём метрик StatsD на %s %s\n", l.network, listener.Addr())
+		go listener.Serve(ctx)
+	}
 
 	if flags.RateLimit == 0 {
-		sender.NewSender(flags.ServerAddress, storage).Run(flags)
+		sender.NewSender(flags, storage).Run(flags)
 	} else {
-		go func() {
-			for {
-				select {
-				case <-tickerPoll.C:
-					collector.UpdateExtraMetrics(storage)
-				case <-ctx.Done():
-					return
-				}
-			}
-		}()
-
 		tickerReport := time.NewTicker(flags.ReportInterval)
 		defer tickerReport.Stop()
 
+		if _, err := sender.OpenSpool(flags); err != nil {
+			log.I().Fatalf("ошибка открытия дисковой очереди: %v", err)
+		}
+
 		pool := workerpool.New(flags, flags.RateLimit)
 		defer pool.Shutdown()
 
@@ -74,11 +80,15 @@ func main() {
 			for {
 				select {
 				case <-tickerReport.C:
-					metrics := storage.GetMetrics()
+					metrics, err := storage.GetMetrics(ctx)
+					if err != nil {
+						log.I().Warnf("ошибка при чтении метрик: %v", err)
+						continue
+					}
 					if ok := pool.Submit(metrics); ok {
 						log.I().Info("Метрики успешно отправлены в пул")
 					} else {
-						log.I().Warn("Пул переполнен, метрики не отправлены")
+						log.I().Warn("Пул переполнен, приращения будут отправлены со следующей пачкой")
 					}
 				case <-ctx.Done():
 					return
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -13,11 +15,20 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/lenarlenar/go-my-metrics-service/internal/alerting"
+	"github.com/lenarlenar/go-my-metrics-service/internal/graphite"
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/middleware"
 	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
 	"github.com/lenarlenar/go-my-metrics-service/internal/server/router"
 	"github.com/lenarlenar/go-my-metrics-service/internal/service"
+	"github.com/lenarlenar/go-my-metrics-service/internal/statsd"
 	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var (
@@ -27,6 +38,9 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
 
 	log.I().Infof("Build version: %s\n", buildVersion)
 	log.I().Infof("Build date: %s\n", buildDate)
@@ -44,8 +58,40 @@ func main() {
 	}()
 
 	config := flags.Parse()
-	storage := storage.NewStorage(config)
-	metricsService := service.NewService(storage)
+	if (config.StatsDAddress != "" || config.GraphiteAddress != "") && config.StrictAuth && !config.AllowUnauthenticatedIngest {
+		log.I().Fatal("StatsD и Graphite не поддерживают аутентификацию; в строгом режиме их приём " +
+			"нужно явно разрешить флагом -allow-unauthenticated-ingest")
+	}
+	storage, err := storage.NewStorage(storage.Config{
+		DatabaseDSN:     config.DatabaseDSN,
+		FileStoragePath: config.FileStoragePath,
+		Restore:         config.Restore,
+		StoreInterval:   config.StoreInterval,
+	})
+	if err != nil {
+		log.I().Fatalf("ошибка инициализации хранилища: %v", err)
+	}
+	tenants, err := tenant.NewRegistry(config.Tenants)
+	if err != nil {
+		log.I().Fatalf("ошибка загрузки арендаторов: %v", err)
+	}
+	roles, err := middleware.NewRoleTokens(config.Tokens, tenants)
+	if err != nil {
+		log.I().Fatalf("ошибка загрузки токенов API: %v", err)
+	}
+	// Запросы HTTP и gRPC работают только с метриками своего арендатора.
+	metricsService := service.NewService(tenant.NewStorage(storage))
+
+	var tlsConfig *tls.Config
+	var grpcOptions []grpc.ServerOption
+	if config.TLSCert != "" {
+		tlsConfig, err = tlsconfig.Server(config.TLSCert, config.TLSKey, config.TLSClientCA)
+		if err != nil {
+			log.I().Fatalf("ошибка настройки TLS: %v", err)
+		}
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := router.NewGRPC(config, metricsService, tenants, roles, grpcOptions...)
 
 	var rsaKey *rsa.PrivateKey
 	if config.CryptoPath != "" {
@@ -56,29 +102,98 @@ func main() {
 		}
 	}
 
-	router := router.New(config, metricsService, rsaKey)
+	alertEngine, err := alerting.NewEngine(storage, config.AlertRules)
+	if err != nil {
+		log.I().Fatalf("ошибка загрузки правил алертинга: %v", err)
+	}
+	alertCtx, alertCancel := context.WithCancel(context.Background())
+	defer alertCancel()
+	go alertEngine.Run(alertCtx, config.AlertInterval)
+
+	notificationStore, ok := storage.(interfaces.NotificationStore)
+	if !ok {
+		log.I().Fatal("хранилище не поддерживает сохранение состояния уведомлений")
+	}
+	notifier, err := alerting.NewNotifier(alertEngine, notificationStore, config.Notifications)
+	if err != nil {
+		log.I().Fatalf("ошибка загрузки настроек уведомлений: %v", err)
+	}
+	go notifier.Run(alertCtx, config.AlertInterval)
+
+	router := router.New(config, metricsService, rsaKey, alertEngine, tenants, roles)
 
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+		Addr:      ":8080",
+		Handler:   router,
+		TLSConfig: tlsConfig,
 	}
 
 	go func() {
 		log.I().Infoln(
 			"Starting server",
 			"addr", config.ServerAddress,
+			"tls", tlsConfig != nil,
+			"mtls", config.TLSClientCA != "",
 		)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			// Сертификат уже загружен в TLSConfig.
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.I().Fatalw(err.Error(), "event", "start server")
 		}
 	}()
 
+	if config.GRPCAddress != "" {
+		listener, err := net.Listen("tcp", config.GRPCAddress)
+		if err != nil {
+			log.I().Fatalw(err.Error(), "event", "listen grpc")
+		}
+
+		go func() {
+			log.I().Infoln(
+				"Starting gRPC server",
+				"addr", config.GRPCAddress,
+			)
+			if err := grpcServer.Serve(listener); err != nil {
+				log.I().Fatalw(err.Error(), "event", "start grpc server")
+			}
+		}()
+	}
+
+	ingestCtx, ingestCancel := context.WithCancel(context.Background())
+	defer ingestCancel()
+	// Метрики StatsD и Graphite попадают к метрикам по умолчанию; служебные метки из них отбрасываются,
+	// поэтому записать метрику в область арендатора нельзя.
+	ingestStorage := tenant.NewStorage(storage)
+	if config.StatsDAddress != "" {
+		listener, err := statsd.Listen("udp", config.StatsDAddress, ingestStorage)
+		if err != nil {
+			log.I().Fatalw(err.Error(), "event", "listen statsd")
+		}
+		log.I().Infoln("Starting StatsD listener", "addr", listener.Addr())
+		go listener.Serve(ingestCtx)
+	}
+	if config.GraphiteAddress != "" {
+		listener, err := graphite.Listen(config.GraphiteAddress, ingestStorage)
+		if err != nil {
+			log.I().Fatalw(err.Error(), "event", "listen graphite")
+		}
+		log.I().Infoln("Starting Graphite listener", "addr", listener.Addr())
+		go listener.Serve(ingestCtx)
+	}
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-stop
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	ingestCancel()
+	grpcServer.GracefulStop()
 	if err := server.Shutdown(ctx); err != nil {
 		log.I().Fatalw(err.Error(), "event", "shutdown server")
 	}
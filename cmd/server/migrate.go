@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage/migrations"
+	_ "github.com/lib/pq"
+)
+
+const migrateUsage = `Использование: server migrate [-d DSN] up | down [N] | status
+
+  up       применить все не применённые миграции
+  down N   откатить N последних миграций (по умолчанию 1)
+  status   показать текущую версию схемы
+`
+
+// runMigrate выполняет подкоманду migrate и возвращает код завершения процесса.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), migrateUsage) }
+	databaseDSN := fs.String("d", os.Getenv("DATABASE_DSN"), "Строка подключения к базе данных")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *databaseDSN == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	db, err := sql.Open("postgres", *databaseDSN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ошибка при подключении к базе данных: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	migrator, err := migrations.New(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ошибка загрузки миграций: %v\n", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	switch fs.Arg(0) {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ошибка применения миграций: %v\n", err)
+			return 1
+		}
+		fmt.Printf("применено миграций: %d\n", applied)
+	case "down":
+		steps := 1
+		if fs.NArg() > 1 {
+			steps, err = strconv.Atoi(fs.Arg(1))
+			if err != nil || steps <= 0 {
+				fs.Usage()
+				return 2
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ошибка отката миграций: %v\n", err)
+			return 1
+		}
+		fmt.Printf("откачено миграций: %d\n", reverted)
+	case "status":
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ошибка чтения версии схемы: %v\n", err)
+			return 1
+		}
+		fmt.Printf("версия схемы: %d\n", version)
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
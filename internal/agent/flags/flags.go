@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"flag"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
 )
 
 const (
@@ -18,15 +20,74 @@ const (
 	defaultKey            = ""
 	defaultRateLimit      = 3
 	defaultCryptoPath     = ""
+	defaultGRPCAddress    = ""
+	defaultLabels         = ""
+	defaultSpoolDir       = ""
+	defaultSpoolMaxSize   = 64
+	defaultStatsDAddress  = ""
+	defaultStatsDSocket   = ""
+	defaultTLSCA          = ""
+	defaultTLSCert        = ""
+	defaultTLSKey         = ""
+	defaultTenantID       = ""
+	defaultToken          = ""
 )
 
 type JSONConfig struct {
-	ServerAddress  string `json:"address"`
-	ReportInterval int    `json:"report_interval"`
-	PollInterval   int    `json:"poll_interval"`
-	Key            string `json:"key"`
-	RateLimit      int    `json:"rate_limit"`
-	CryptoPath     string `json:"crypto_key"`
+	ServerAddress  string               `json:"address"`
+	ReportInterval int                  `json:"report_interval"`
+	PollInterval   int                  `json:"poll_interval"`
+	Key            string               `json:"key"`
+	RateLimit      int                  `json:"rate_limit"`
+	CryptoPath     string               `json:"crypto_key"`
+	GRPCAddress    string               `json:"grpc_address"`
+	Labels         map[string]string    `json:"labels"`
+	SpoolDir       string               `json:"spool_dir"`
+	SpoolMaxSize   int                  `json:"spool_max_size"`
+	Collectors     map[string]Collector `json:"collectors"`
+	Processes      []Process            `json:"processes"`
+	StatsDAddress  string               `json:"statsd_address"`
+	StatsDSocket   string               `json:"statsd_socket"`
+	TLSCA          string               `json:"tls_ca"`
+	TLSCert        string               `json:"tls_cert"`
+	TLSKey         string               `json:"tls_key"`
+	TenantID       string               `json:"tenant_id"`
+	Token          string               `json:"token"`
+}
+
+// Collector - настройки источника метрик агента в JSON-конфиге.
+// Источник без настроек включён и опрашивается с интервалом poll_interval.
+//
+// Пример:
+//
+//	{"collectors": {"cpu": {"interval": "5s"}, "memory": {"enabled": false}}}
+type Collector struct {
+	Enabled  *bool  `json:"enabled"`
+	Interval string `json:"interval"`
+}
+
+// Process - процессы, метрики которых собирает источник process. Процессы ищутся
+// ровно одним способом: по PID-файлу, по регулярному выражению для имени процесса
+// или по cgroup. Name попадает в метку process.
+//
+// По умолчанию метрики каждого процесса помечаются и меткой pid. Каждый перезапуск
+// процесса создаёт на сервере новые ряды, поэтому для процессов, которые часто
+// перезапускаются или порождают короткоживущих потомков, метку лучше отключить
+// через "pid_label": false - тогда метрики процессов записи суммируются.
+//
+// Пример:
+//
+//	{"processes": [
+//		{"name": "app", "pid_file": "/run/app.pid", "pid_label": false},
+//		{"name": "nginx", "pattern": "^nginx$"},
+//		{"name": "db", "cgroup": "/system.slice/postgresql.service"}
+//	]}
+type Process struct {
+	Name     string `json:"name"`
+	PIDFile  string `json:"pid_file"`
+	Pattern  string `json:"pattern"`
+	Cgroup   string `json:"cgroup"`
+	PIDLabel *bool  `json:"pid_label"`
 }
 
 type EnvConfig struct {
@@ -37,6 +98,17 @@ type EnvConfig struct {
 	Key            string `env:"KEY"`
 	RateLimit      int    `env:"RATE_LIMIT"`
 	CryptoPath     string `env:"CRYPTO_KEY"`
+	GRPCAddress    string `env:"GRPC_ADDRESS"`
+	Labels         string `env:"LABELS"`
+	SpoolDir       string `env:"SPOOL_DIR"`
+	SpoolMaxSize   int    `env:"SPOOL_MAX_SIZE"`
+	StatsDAddress  string `env:"STATSD_ADDRESS"`
+	StatsDSocket   string `env:"STATSD_SOCKET"`
+	TLSCA          string `env:"TLS_CA"`
+	TLSCert        string `env:"TLS_CERT"`
+	TLSKey         string `env:"TLS_KEY"`
+	TenantID       string `env:"TENANT_ID"`
+	Token          string `env:"TOKEN"`
 }
 
 type Flags struct {
@@ -46,6 +118,25 @@ type Flags struct {
 	Key            string
 	RateLimit      int
 	CryptoPath     string
+	GRPCAddress    string
+	Labels         model.Labels         // метки всех метрик агента, host по умолчанию - имя машины
+	SpoolDir       string               // каталог дисковой очереди неотправленных метрик, пусто - очередь отключена
+	SpoolMaxSize   int64                // максимальный размер дисковой очереди в байтах
+	Collectors     map[string]Collector // настройки источников метрик, задаются только в JSON-конфиге
+	Processes      []Process            // процессы для источника process, задаются только в JSON-конфиге
+	StatsDAddress  string               // UDP-адрес приёма метрик StatsD, пусто - приём отключен
+	StatsDSocket   string               // путь к Unix-сокету для приёма метрик StatsD, пусто - отключен
+	TLSCA          string               // путь к сертификатам CA сервера, включает HTTPS и TLS для gRPC
+	TLSCert        string               // путь к сертификату агента для mTLS, включает HTTPS и TLS для gRPC
+	TLSKey         string               // путь к ключу сертификата агента
+	TenantID       string               // арендатор на сервере, запросы подписываются ключом Key арендатора
+	Token          string               // токен доступа арендатора, передаётся в заголовке Authorization
+}
+
+// TLS сообщает, нужно ли подключаться к серверу по TLS: заданы сертификаты
+// или адрес сервера указан со схемой https.
+func (f Flags) TLS() bool {
+	return f.TLSCA != "" || f.TLSCert != "" || strings.HasPrefix(f.ServerAddress, "https://")
 }
 
 func GetFlags() Flags {
@@ -60,6 +151,18 @@ func GetFlags() Flags {
 	key := flag.String("k", defaultKey, "Ключ для шифрования")
 	rateLimit := flag.Int("l", defaultRateLimit, "Количество одновременно исходящих запросов на сервер")
 	cryptoPath := flag.String("crypto-key", defaultCryptoPath, "Путь до файла с приватным ключом")
+	grpcAddress := flag.String("g", defaultGRPCAddress, "Адрес gRPC-сервера, включает отправку по gRPC")
+	labels := flag.String("labels", defaultLabels, "Метки, добавляемые ко всем метрикам агента, в формате k1=v1,k2=v2; метка host по умолчанию - имя машины")
+	spoolDir := flag.String("spool-dir", defaultSpoolDir, "Каталог дисковой очереди для метрик, которые не удалось отправить")
+	// Значение по умолчанию подставляется последним, иначе флаг всегда перекрывал бы JSON-конфиг.
+	spoolMaxSize := flag.Int("spool-max-size", 0, "Максимальный размер дисковой очереди в мегабайтах (по умолчанию 64)")
+	statsdAddress := flag.String("statsd", defaultStatsDAddress, "UDP-адрес для приёма метрик StatsD от локальных приложений")
+	statsdSocket := flag.String("statsd-socket", defaultStatsDSocket, "Путь к Unix-сокету для приёма метрик StatsD")
+	tlsCA := flag.String("tls-ca", defaultTLSCA, "Путь к сертификатам CA для проверки сервера, включает HTTPS")
+	tlsCert := flag.String("tls-cert", defaultTLSCert, "Путь к сертификату агента для mTLS")
+	tlsKey := flag.String("tls-key", defaultTLSKey, "Путь к ключу сертификата агента")
+	tenantID := flag.String("tenant", defaultTenantID, "Идентификатор арендатора на сервере")
+	token := flag.String("token", defaultToken, "Токен доступа арендатора")
 	configPath := flag.String("c", defaultConfigPath, "Путь к конфиг-файлу JSON")
 	flag.Parse()
 
@@ -74,7 +177,12 @@ func GetFlags() Flags {
 		}
 	}
 
-	return Flags{
+	agentLabels, err := model.ParseLabels(coalesceString(envConfig.Labels, *labels, defaultLabels))
+	if err != nil {
+		log.I().Fatal(err)
+	}
+
+	f := Flags{
 		ServerAddress: coalesceString(
 			envConfig.ServerAddress,
 			*serverAddress,
@@ -111,7 +219,71 @@ func GetFlags() Flags {
 			jsonConfig.CryptoPath,
 			defaultCryptoPath,
 		),
+		GRPCAddress: coalesceString(
+			envConfig.GRPCAddress,
+			*grpcAddress,
+			jsonConfig.GRPCAddress,
+			defaultGRPCAddress,
+		),
+		Labels: agentLabels.Merge(jsonConfig.Labels).Merge(hostLabels()),
+		SpoolDir: coalesceString(
+			envConfig.SpoolDir,
+			*spoolDir,
+			jsonConfig.SpoolDir,
+			defaultSpoolDir,
+		),
+		SpoolMaxSize: int64(coalesceInt(
+			envConfig.SpoolMaxSize,
+			*spoolMaxSize,
+			jsonConfig.SpoolMaxSize,
+			defaultSpoolMaxSize,
+		)) << 20,
+		Collectors: jsonConfig.Collectors,
+		Processes:  jsonConfig.Processes,
+		StatsDAddress: coalesceString(
+			envConfig.StatsDAddress,
+			*statsdAddress,
+			jsonConfig.StatsDAddress,
+			defaultStatsDAddress,
+		),
+		StatsDSocket: coalesceString(
+			envConfig.StatsDSocket,
+			*statsdSocket,
+			jsonConfig.StatsDSocket,
+			defaultStatsDSocket,
+		),
+		TLSCA: coalesceString(
+			envConfig.TLSCA,
+			*tlsCA,
+			jsonConfig.TLSCA,
+			defaultTLSCA,
+		),
+		TLSCert: coalesceString(
+			envConfig.TLSCert,
+			*tlsCert,
+			jsonConfig.TLSCert,
+			defaultTLSCert,
+		),
+		TLSKey: coalesceString(
+			envConfig.TLSKey,
+			*tlsKey,
+			jsonConfig.TLSKey,
+			defaultTLSKey,
+		),
+		TenantID: coalesceString(
+			envConfig.TenantID,
+			*tenantID,
+			jsonConfig.TenantID,
+			defaultTenantID,
+		),
+		Token: coalesceString(
+			envConfig.Token,
+			*token,
+			jsonConfig.Token,
+			defaultToken,
+		),
 	}
+	return f
 }
 
 func loadJSONConfig(path string) (*JSONConfig, error) {
@@ -128,6 +300,17 @@ func loadJSONConfig(path string) (*JSONConfig, error) {
 	return &cfg, nil
 }
 
+// hostLabels возвращает метку host с именем машины. Без неё метрики агентов на разных
+// машинах попадали бы в одни и те же ряды, если метки не заданы явно.
+func hostLabels() model.Labels {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.I().Warnf("не удалось определить имя машины для метки host: %v", err)
+		return nil
+	}
+	return model.Labels{"host": hostname}
+}
+
 func coalesceString(values ...string) string {
 	for _, v := range values {
 		if v != "" {
@@ -0,0 +1,237 @@
+// Package alerting реализует правила алертинга, вычисляемые по метрикам из хранилища.
+package alerting
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+)
+
+// State - состояние алерта.
+type State string
+
+const (
+	StatePending  State = "pending"  // условие выполняется, но меньше чем for
+	StateFiring   State = "firing"   // условие выполняется дольше чем for
+	StateResolved State = "resolved" // условие перестало выполняться после firing
+)
+
+// resolvedRetention - сколько времени разрешенный алерт хранится после перехода в resolved.
+const resolvedRetention = 15 * time.Minute
+
+// Alert - алерт по одному временному ряду.
+type Alert struct {
+	Rule       string       `json:"rule"`
+	Metric     string       `json:"metric"`
+	Labels     model.Labels `json:"labels,omitempty"`
+	Summary    string       `json:"summary,omitempty"`
+	State      State        `json:"state"`
+	Value      float64      `json:"value"`
+	ActiveAt   time.Time    `json:"active_at"`
+	FiredAt    *time.Time   `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time   `json:"resolved_at,omitempty"`
+
+	series model.Metrics // имя и метки временного ряда, по которому сработал алерт
+}
+
+// Engine периодически вычисляет правила и хранит состояние алертов.
+type Engine struct {
+	storage interfaces.Storage
+	rules   []*Rule
+
+	mutex  sync.Mutex
+	alerts map[string]*Alert // ключ: имя правила + ключ временного ряда
+}
+
+// NewEngine создает движок алертинга с правилами из конфига.
+func NewEngine(storage interfaces.Storage, configs []RuleConfig) (*Engine, error) {
+	rules := make([]*Rule, 0, len(configs))
+	for _, cfg := range configs {
+		rule, err := NewRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return &Engine{
+		storage: storage,
+		rules:   rules,
+		alerts:  make(map[string]*Alert),
+	}, nil
+}
+
+// Run вычисляет правила с заданным интервалом до отмены контекста.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	if len(e.rules) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Evaluate(ctx, time.Now()); err != nil {
+				log.I().Warnf("ошибка при вычислении правил алертинга: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Evaluate вычисляет все правила на момент now и обновляет состояние алертов.
+// Если хранилище недоступно, состояние алертов не меняется, чтобы не разрешить их ошибочно.
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) error {
+	metrics, err := e.storage.GetMetrics(ctx)
+	if err != nil {
+		return err
+	}
+
+	type activeAlert struct {
+		rule   *Rule
+		metric model.Metrics
+		value  float64
+	}
+	active := make(map[string]activeAlert)
+	for _, rule := range e.rules {
+		for _, m := range metrics {
+			if !rule.matches(m) {
+				continue
+			}
+
+			value, ok, err := e.value(ctx, rule, m, now)
+			if err != nil {
+				return err
+			}
+			if !ok || !rule.compare(value) {
+				continue
+			}
+			active[rule.Name+"/"+m.Key()] = activeAlert{rule: rule, metric: m, value: value}
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for key, a := range active {
+		e.activate(key, a.rule, a.metric, a.value, now)
+	}
+
+	for key, alert := range e.alerts {
+		if _, ok := active[key]; ok {
+			continue
+		}
+		switch alert.State {
+		case StatePending:
+			delete(e.alerts, key)
+		case StateFiring:
+			resolvedAt := now
+			alert.State = StateResolved
+			alert.ResolvedAt = &resolvedAt
+			log.I().Infof("алерт %s по %s разрешен", alert.Rule, alert.Metric)
+		case StateResolved:
+			if now.Sub(*alert.ResolvedAt) > resolvedRetention {
+				delete(e.alerts, key)
+			}
+		}
+	}
+	return nil
+}
+
+// activate обновляет алерт, условие которого выполняется.
+func (e *Engine) activate(key string, rule *Rule, m model.Metrics, value float64, now time.Time) {
+	alert, ok := e.alerts[key]
+	if !ok || alert.State == StateResolved {
+		alert = &Alert{
+			Rule:     rule.Name,
+			Metric:   model.SeriesKey(m.ID, m.Labels),
+			Labels:   m.Labels.Merge(rule.Labels),
+			Summary:  rule.Summary,
+			State:    StatePending,
+			ActiveAt: now,
+			series:   model.Metrics{ID: m.ID, Labels: m.Labels},
+		}
+		e.alerts[key] = alert
+	}
+	alert.Value = value
+
+	if alert.State == StatePending && now.Sub(alert.ActiveAt) >= rule.For {
+		firedAt := now
+		alert.State = StateFiring
+		alert.FiredAt = &firedAt
+		log.I().Warnf("алерт %s по %s сработал: значение %g", alert.Rule, alert.Metric, value)
+	}
+}
+
+// value возвращает значение временного ряда для правила.
+func (e *Engine) value(ctx context.Context, rule *Rule, m model.Metrics, now time.Time) (float64, bool, error) {
+	if rule.rate {
+		samples, err := e.storage.GetHistory(ctx, m.MType, m.ID, m.Labels, now.Add(-rule.window), now)
+		if err != nil {
+			return 0, false, err
+		}
+		var sum float64
+		for _, s := range samples {
+			sum += s.Value
+		}
+		return sum / rule.window.Seconds(), true, nil
+	}
+
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		return *m.Value, true, nil
+	case m.MType == "counter" && m.Delta != nil:
+		return float64(*m.Delta), true, nil
+	}
+	return 0, false, nil
+}
+
+// Alerts возвращает копию всех отслеживаемых алертов, включая недавно разрешенные.
+func (e *Engine) Alerts() []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, alert := range e.alerts {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].Metric < alerts[j].Metric
+	})
+	return alerts
+}
+
+// AlertsHandler возвращает активные алерты (pending и firing) в формате JSON.
+// Движок вычисляет правила по метрикам всех арендаторов, а клиент видит только алерты
+// своего арендатора, без служебных меток.
+func (e *Engine) AlertsHandler(c *gin.Context) {
+	id, err := tenant.Scope(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	active := make([]Alert, 0)
+	for _, alert := range e.Alerts() {
+		if alert.State == StateResolved || alert.series.Labels[tenant.Label] != id {
+			continue
+		}
+		alert.Metric = model.SeriesKey(alert.series.ID, tenant.PublicLabels(alert.series.Labels))
+		alert.Labels = tenant.PublicLabels(alert.Labels)
+		active = append(active, alert)
+	}
+	c.JSON(http.StatusOK, active)
+}
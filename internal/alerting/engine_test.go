@@ -0,0 +1,136 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRule(t *testing.T) {
+	rule, err := NewRule(RuleConfig{Name: "HighHeap", Expr: "HeapAlloc > 500MB", For: "2m"})
+	require.NoError(t, err)
+	assert.Equal(t, "HeapAlloc", rule.metric)
+	assert.Equal(t, float64(500<<20), rule.threshold)
+	assert.Equal(t, 2*time.Minute, rule.For)
+	assert.False(t, rule.rate)
+
+	rule, err = NewRule(RuleConfig{Name: "PollStorm", Expr: `rate(PollCount{host="a"}[1m]) >= 0.5`})
+	require.NoError(t, err)
+	assert.True(t, rule.rate)
+	assert.Equal(t, time.Minute, rule.window)
+	assert.Equal(t, model.Labels{"host": "a"}, rule.matchers)
+	assert.Equal(t, ">=", rule.operator)
+
+	for _, expr := range []string{"", "HeapAlloc", "HeapAlloc >> 1", "HeapAlloc > 1XB", "rate(PollCount[x]) > 1"} {
+		_, err = NewRule(RuleConfig{Name: "bad", Expr: expr})
+		assert.ErrorIs(t, err, ErrInvalidExpr, expr)
+	}
+}
+
+func TestEngineStates(t *testing.T) {
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 1KB", For: "2m"}})
+	require.NoError(t, err)
+
+	start := time.Now()
+	s.SetGauge(context.Background(), "HeapAlloc", 2048, nil)
+
+	require.NoError(t, engine.Evaluate(context.Background(), start))
+	alerts := engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StatePending, alerts[0].State)
+
+	require.NoError(t, engine.Evaluate(context.Background(), start.Add(time.Minute)))
+	assert.Equal(t, StatePending, engine.Alerts()[0].State)
+
+	require.NoError(t, engine.Evaluate(context.Background(), start.Add(2*time.Minute)))
+	alerts = engine.Alerts()
+	assert.Equal(t, StateFiring, alerts[0].State)
+	assert.Equal(t, 2048.0, alerts[0].Value)
+
+	s.SetGauge(context.Background(), "HeapAlloc", 10, nil)
+	require.NoError(t, engine.Evaluate(context.Background(), start.Add(3*time.Minute)))
+	alerts = engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+
+	require.NoError(t, engine.Evaluate(context.Background(), start.Add(3*time.Minute+resolvedRetention+time.Second)))
+	assert.Empty(t, engine.Alerts())
+}
+
+func TestEnginePendingDropped(t *testing.T) {
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 100", For: "1m"}})
+	require.NoError(t, err)
+
+	s.SetGauge(context.Background(), "HeapAlloc", 200, model.Labels{"host": "a"})
+	s.SetGauge(context.Background(), "HeapAlloc", 50, model.Labels{"host": "b"})
+
+	now := time.Now()
+	require.NoError(t, engine.Evaluate(context.Background(), now))
+	alerts := engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "a", alerts[0].Labels["host"])
+
+	s.SetGauge(context.Background(), "HeapAlloc", 50, model.Labels{"host": "a"})
+	require.NoError(t, engine.Evaluate(context.Background(), now.Add(time.Second)))
+	assert.Empty(t, engine.Alerts())
+}
+
+func TestEngineRate(t *testing.T) {
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "PollStorm", Expr: "rate(PollCount[1m]) > 1"}})
+	require.NoError(t, err)
+
+	for i := 0; i < 30; i++ {
+		s.AddCounter(context.Background(), "PollCount", 3, nil)
+	}
+
+	require.NoError(t, engine.Evaluate(context.Background(), time.Now()))
+	alerts := engine.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	assert.InDelta(t, 1.5, alerts[0].Value, 0.001)
+}
+
+func TestAlertsHandlerTenants(t *testing.T) {
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 1KB"}})
+	require.NoError(t, err)
+	s.SetGauge(context.Background(), "HeapAlloc", 2048, model.Labels{"host": "a"})
+	s.SetGauge(context.Background(), "HeapAlloc", 4096, model.Labels{"host": "b", tenant.Label: "payments"})
+	require.NoError(t, engine.Evaluate(context.Background(), time.Now()))
+	require.Len(t, engine.Alerts(), 2)
+
+	gin.SetMode(gin.TestMode)
+	alerts := func(ctx context.Context) []Alert {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/alerts", nil).WithContext(ctx)
+		engine.AlertsHandler(c)
+		require.Equal(t, http.StatusOK, w.Code)
+		var result []Alert
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		return result
+	}
+
+	// Каждый видит только алерты своих метрик, служебная метка арендатора скрыта.
+	result := alerts(context.Background())
+	require.Len(t, result, 1)
+	assert.Equal(t, 2048.0, result[0].Value)
+
+	result = alerts(tenant.WithTenant(context.Background(), tenant.Tenant{ID: "payments"}, true))
+	require.Len(t, result, 1)
+	assert.Equal(t, `HeapAlloc{host="b"}`, result[0].Metric)
+	assert.Equal(t, model.Labels{"host": "b"}, result[0].Labels)
+}
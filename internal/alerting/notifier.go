@@ -0,0 +1,273 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/retry"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+)
+
+const (
+	defaultRepeatInterval = 4 * time.Hour
+	defaultRetries        = 5
+	webhookTimeout        = 10 * time.Second
+
+	// groupByRule - значение group_by, означающее группировку по имени правила.
+	groupByRule = "rule"
+)
+
+// Notification - тело запроса к вебхуку. Алерты разных арендаторов не попадают
+// в одно уведомление, а их метки передаются без служебных.
+type Notification struct {
+	Status      State        `json:"status"`           // firing, если в группе есть сработавшие алерты, иначе resolved
+	Tenant      string       `json:"tenant,omitempty"` // арендатор алертов, пусто - метрики без арендатора
+	GroupKey    string       `json:"group_key"`
+	GroupLabels model.Labels `json:"group_labels"`
+	Alerts      []Alert      `json:"alerts"`
+	SentAt      time.Time    `json:"sent_at"`
+}
+
+// group - алерты, которые отправляются одним уведомлением.
+type group struct {
+	tenant      string
+	key         string
+	labels      model.Labels
+	alerts      []Alert
+	status      State
+	fingerprint string
+}
+
+// NotificationsConfig - настройки доставки уведомлений об алертах на HTTP-вебхуки
+// в JSON-конфиге сервера.
+//
+// Пример:
+//
+//	{"webhooks": ["http://localhost:9000/hook"], "group_by": ["rule", "host"], "repeat_interval": "4h", "retries": 5}
+//
+// В group_by значение "rule" означает имя правила, остальные значения - метки алерта.
+type NotificationsConfig struct {
+	Webhooks       []string `json:"webhooks"`
+	GroupBy        []string `json:"group_by"`
+	RepeatInterval string   `json:"repeat_interval"`
+	Retries        int      `json:"retries"`
+}
+
+// Notifier отправляет уведомления об алертах на вебхуки.
+// Уведомление по группе повторяется, только если изменился набор алертов
+// или прошло repeatInterval с прошлой отправки. Состояние отправок хранится в store,
+// поэтому после перезапуска сервера уведомления не дублируются.
+type Notifier struct {
+	engine *Engine
+	store  interfaces.NotificationStore
+
+	webhooks       []string
+	groupBy        []string
+	repeatInterval time.Duration
+	retries        int
+	backoff        retry.Backoff
+	client         *http.Client
+}
+
+// NewNotifier создает отправщик уведомлений с настройками из конфига.
+func NewNotifier(engine *Engine, store interfaces.NotificationStore, cfg NotificationsConfig) (*Notifier, error) {
+	n := &Notifier{
+		engine:         engine,
+		store:          store,
+		webhooks:       cfg.Webhooks,
+		groupBy:        cfg.GroupBy,
+		repeatInterval: defaultRepeatInterval,
+		retries:        cfg.Retries,
+		backoff:        retry.Exponential(time.Second, 30*time.Second),
+		client:         &http.Client{Timeout: webhookTimeout},
+	}
+
+	if len(n.groupBy) == 0 {
+		n.groupBy = []string{groupByRule}
+	}
+	if n.retries <= 0 {
+		n.retries = defaultRetries
+	}
+	if cfg.RepeatInterval != "" {
+		d, err := time.ParseDuration(cfg.RepeatInterval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid repeat_interval %q", cfg.RepeatInterval)
+		}
+		n.repeatInterval = d
+	}
+	return n, nil
+}
+
+// Run отправляет уведомления с заданным интервалом до отмены контекста.
+func (n *Notifier) Run(ctx context.Context, interval time.Duration) {
+	if len(n.webhooks) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Повторы отправки на недоступный вебхук не должны задерживать следующий цикл.
+			cycleCtx, cancel := context.WithTimeout(ctx, interval)
+			n.Notify(cycleCtx, time.Now())
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Notify группирует текущие алерты и отправляет уведомления по группам, которые изменились
+// или по которым пора повторить уведомление. Вебхуки обслуживаются параллельно, поэтому
+// недоступный вебхук не задерживает доставку на остальные.
+func (n *Notifier) Notify(ctx context.Context, now time.Time) {
+	groups := n.group(n.engine.Alerts())
+
+	var wg sync.WaitGroup
+	for _, url := range n.webhooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, g := range groups {
+				n.deliver(ctx, url, g, now)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// deliver отправляет уведомление по группе на один вебхук, если это требуется.
+func (n *Notifier) deliver(ctx context.Context, url string, g group, now time.Time) {
+	stateKey := url + "|" + g.key
+	prev, ok, err := n.store.GetNotificationState(ctx, stateKey)
+	if err != nil {
+		// Без состояния нельзя понять, отправлялось ли уведомление; повторим на следующем цикле.
+		log.I().Warnf("ошибка при чтении состояния уведомления %s: %v", stateKey, err)
+		return
+	}
+	switch {
+	case !ok && g.status == StateResolved:
+		// О срабатывании не уведомляли, значит и о разрешении сообщать не нужно.
+		return
+	case ok && prev.Fingerprint == g.fingerprint:
+		if g.status == StateResolved || now.Sub(prev.SentAt) < n.repeatInterval {
+			return
+		}
+	}
+
+	notification := Notification{
+		Status:      g.status,
+		Tenant:      g.tenant,
+		GroupKey:    g.key,
+		GroupLabels: g.labels,
+		Alerts:      g.alerts,
+		SentAt:      now,
+	}
+	if err := n.send(ctx, url, notification); err != nil {
+		log.I().Warnf("ошибка при отправке уведомления %s на %s: %v", g.key, url, err)
+		return
+	}
+
+	state := model.NotificationState{Key: stateKey, Fingerprint: g.fingerprint, SentAt: now}
+	if err := n.store.SetNotificationState(ctx, state); err != nil {
+		log.I().Warnf("ошибка при сохранении состояния уведомления %s: %v", stateKey, err)
+	}
+}
+
+// send выполняет POST-запрос к вебхуку с повторными попытками.
+func (n *Notifier) send(ctx context.Context, url string, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	return retry.Do(ctx, n.retries, n.backoff, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("status code %d", resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+// group разбивает сработавшие и разрешенные алерты на группы по арендатору и groupBy.
+// Алерты в состоянии pending не отправляются. Как и в AlertsHandler, служебные метки
+// из алертов убираются.
+func (n *Notifier) group(alerts []Alert) []group {
+	groups := make(map[string]*group)
+	for _, alert := range alerts {
+		if alert.State == StatePending {
+			continue
+		}
+		id := alert.series.Labels[tenant.Label]
+		alert.Metric = model.SeriesKey(alert.series.ID, tenant.PublicLabels(alert.series.Labels))
+		alert.Labels = tenant.PublicLabels(alert.Labels)
+
+		labels := make(model.Labels, len(n.groupBy))
+		for _, name := range n.groupBy {
+			if name == groupByRule {
+				labels[name] = alert.Rule
+			} else {
+				labels[name] = alert.Labels[name]
+			}
+		}
+		key := "{" + labels.String() + "}"
+		if id != "" {
+			key = id + "/" + key
+		}
+
+		g, ok := groups[key]
+		if !ok {
+			g = &group{tenant: id, key: key, labels: labels, status: StateResolved}
+			groups[key] = g
+		}
+		g.alerts = append(g.alerts, alert)
+		if alert.State == StateFiring {
+			g.status = StateFiring
+		}
+	}
+
+	result := make([]group, 0, len(groups))
+	for _, g := range groups {
+		g.fingerprint = fingerprint(g.alerts)
+		result = append(result, *g)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].key < result[j].key })
+	return result
+}
+
+// fingerprint вычисляет отпечаток набора алертов по правилу, ряду и состоянию.
+// Изменение значения метрики не меняет отпечаток и не приводит к повторному уведомлению.
+func fingerprint(alerts []Alert) string {
+	lines := make([]string, 0, len(alerts))
+	for _, alert := range alerts {
+		lines = append(lines, alert.Rule+"|"+alert.Metric+"|"+string(alert.State))
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
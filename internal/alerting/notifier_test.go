@@ -0,0 +1,255 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/retry"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver - тестовый вебхук, запоминающий полученные уведомления.
+type receiver struct {
+	mutex         sync.Mutex
+	failures      int // сколько первых запросов завершить ошибкой 500
+	requests      int
+	notifications []Notification
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.requests++
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var notification Notification
+	if err := json.NewDecoder(req.Body).Decode(&notification); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.notifications = append(r.notifications, notification)
+}
+
+func (r *receiver) received() []Notification {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Notification(nil), r.notifications...)
+}
+
+func newTestNotifier(t *testing.T, engine *Engine, store *storage.MemStorage, url string) *Notifier {
+	notifier, err := NewNotifier(engine, store, NotificationsConfig{
+		Webhooks:       []string{url},
+		GroupBy:        []string{"rule", "host"},
+		RepeatInterval: "1h",
+		Retries:        3,
+	})
+	require.NoError(t, err)
+	notifier.backoff = retry.Linear(time.Millisecond, 0)
+	return notifier
+}
+
+func TestNotifierDedupAndRepeat(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 100"}})
+	require.NoError(t, err)
+	notifier := newTestNotifier(t, engine, s, server.URL)
+
+	now := time.Now()
+	s.SetGauge(context.Background(), "HeapAlloc", 200, model.Labels{"host": "a"})
+	require.NoError(t, engine.Evaluate(context.Background(), now))
+	notifier.Notify(context.Background(), now)
+
+	received := rcv.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, StateFiring, received[0].Status)
+	assert.Equal(t, `{host="a",rule="HighHeap"}`, received[0].GroupKey)
+	require.Len(t, received[0].Alerts, 1)
+	assert.Equal(t, 200.0, received[0].Alerts[0].Value)
+
+	// Набор алертов не изменился - уведомление не повторяется до repeat_interval.
+	s.SetGauge(context.Background(), "HeapAlloc", 300, model.Labels{"host": "a"})
+	require.NoError(t, engine.Evaluate(context.Background(), now.Add(time.Minute)))
+	notifier.Notify(context.Background(), now.Add(time.Minute))
+	assert.Len(t, rcv.received(), 1)
+
+	require.NoError(t, engine.Evaluate(context.Background(), now.Add(time.Hour+time.Minute)))
+	notifier.Notify(context.Background(), now.Add(time.Hour+time.Minute))
+	assert.Len(t, rcv.received(), 2)
+
+	// Разрешение отправляется один раз.
+	s.SetGauge(context.Background(), "HeapAlloc", 10, model.Labels{"host": "a"})
+	for i := 2; i < 4; i++ {
+		require.NoError(t, engine.Evaluate(context.Background(), now.Add(time.Duration(i)*time.Hour)))
+		notifier.Notify(context.Background(), now.Add(time.Duration(i)*time.Hour))
+	}
+	received = rcv.received()
+	require.Len(t, received, 3)
+	assert.Equal(t, StateResolved, received[2].Status)
+}
+
+func TestNotifierGroupsAndSkipsPending(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{
+		{Name: "HighHeap", Expr: "HeapAlloc > 100"},
+		{Name: "SlowHeap", Expr: "HeapAlloc > 100", For: "1h"},
+	})
+	require.NoError(t, err)
+	notifier := newTestNotifier(t, engine, s, server.URL)
+
+	now := time.Now()
+	s.SetGauge(context.Background(), "HeapAlloc", 200, model.Labels{"host": "a"})
+	s.SetGauge(context.Background(), "HeapAlloc", 200, model.Labels{"host": "b"})
+	require.NoError(t, engine.Evaluate(context.Background(), now))
+	notifier.Notify(context.Background(), now)
+
+	received := rcv.received()
+	require.Len(t, received, 2)
+	assert.Equal(t, model.Labels{"rule": "HighHeap", "host": "a"}, received[0].GroupLabels)
+	assert.Equal(t, model.Labels{"rule": "HighHeap", "host": "b"}, received[1].GroupLabels)
+}
+
+func TestNotifierDedupAcrossRestart(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 100"}})
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.SetGauge(context.Background(), "HeapAlloc", 200, nil)
+	require.NoError(t, engine.Evaluate(context.Background(), now))
+	newTestNotifier(t, engine, s, server.URL).Notify(context.Background(), now)
+	require.Len(t, rcv.received(), 1)
+
+	// Новый движок и отправщик с тем же хранилищем, как после перезапуска сервера.
+	engine, err = NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 100"}})
+	require.NoError(t, err)
+	require.NoError(t, engine.Evaluate(context.Background(), now.Add(time.Minute)))
+	newTestNotifier(t, engine, s, server.URL).Notify(context.Background(), now.Add(time.Minute))
+	assert.Len(t, rcv.received(), 1)
+}
+
+func TestNotifierRetry(t *testing.T) {
+	rcv := &receiver{failures: 2}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 100"}})
+	require.NoError(t, err)
+	notifier := newTestNotifier(t, engine, s, server.URL)
+
+	now := time.Now()
+	s.SetGauge(context.Background(), "HeapAlloc", 200, nil)
+	require.NoError(t, engine.Evaluate(context.Background(), now))
+	notifier.Notify(context.Background(), now)
+	assert.Len(t, rcv.received(), 1)
+	assert.Equal(t, 3, rcv.requests)
+
+	// Все попытки неудачны - состояние не сохраняется, уведомление отправится на следующем цикле.
+	rcv.failures = 3
+	s.SetGauge(context.Background(), "HeapAlloc", 200, model.Labels{"host": "a"})
+	require.NoError(t, engine.Evaluate(context.Background(), now.Add(time.Minute)))
+	notifier.Notify(context.Background(), now.Add(time.Minute))
+	assert.Len(t, rcv.received(), 1)
+
+	notifier.Notify(context.Background(), now.Add(2*time.Minute))
+	assert.Len(t, rcv.received(), 2)
+}
+
+func TestNotifierTenants(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 100"}})
+	require.NoError(t, err)
+	notifier, err := NewNotifier(engine, s, NotificationsConfig{Webhooks: []string{server.URL}})
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.SetGauge(context.Background(), "HeapAlloc", 200, model.Labels{"host": "a"})
+	s.SetGauge(context.Background(), "HeapAlloc", 200, model.Labels{"host": "a", tenant.Label: "payments"})
+	require.NoError(t, engine.Evaluate(context.Background(), now))
+	notifier.Notify(context.Background(), now)
+
+	// Алерты арендаторов приходят отдельными уведомлениями и без служебной метки.
+	received := rcv.received()
+	require.Len(t, received, 2)
+	assert.Equal(t, "payments", received[0].Tenant)
+	assert.Equal(t, `payments/{rule="HighHeap"}`, received[0].GroupKey)
+	assert.Equal(t, "", received[1].Tenant)
+	assert.Equal(t, `{rule="HighHeap"}`, received[1].GroupKey)
+	for _, notification := range received {
+		require.Len(t, notification.Alerts, 1)
+		assert.Equal(t, `HeapAlloc{host="a"}`, notification.Alerts[0].Metric)
+		assert.NotContains(t, notification.Alerts[0].Labels, tenant.Label)
+	}
+}
+
+func TestNotifierSlowWebhook(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+	blocked := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-blocked:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+	defer close(blocked)
+
+	s := storage.NewMemStorage()
+	engine, err := NewEngine(s, []RuleConfig{{Name: "HighHeap", Expr: "HeapAlloc > 100"}})
+	require.NoError(t, err)
+	notifier, err := NewNotifier(engine, s, NotificationsConfig{Webhooks: []string{slow.URL, server.URL}})
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.SetGauge(context.Background(), "HeapAlloc", 200, nil)
+	require.NoError(t, engine.Evaluate(context.Background(), now))
+
+	// Недоступный вебхук не задерживает доставку на остальные, а отмена контекста
+	// прерывает его повторы.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		notifier.Notify(ctx, now)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return len(rcv.received()) == 1 }, time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Notify не завершился после отмены контекста")
+	}
+}
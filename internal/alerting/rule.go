@@ -0,0 +1,178 @@
+package alerting
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+// RuleConfig - описание правила алертинга в JSON-конфиге сервера.
+//
+// Пример:
+//
+//	{"name": "HighHeap", "expr": "HeapAlloc > 500MB", "for": "2m", "labels": {"severity": "warning"}}
+//	{"name": "PollStorm", "expr": "rate(PollCount[1m]) > 10"}
+type RuleConfig struct {
+	Name    string            `json:"name"`
+	Expr    string            `json:"expr"`
+	For     string            `json:"for"`
+	Labels  map[string]string `json:"labels"`
+	Summary string            `json:"summary"`
+}
+
+// Rule - разобранное правило алертинга.
+type Rule struct {
+	Name    string
+	Expr    string
+	For     time.Duration
+	Labels  model.Labels
+	Summary string
+
+	metric    string        // имя метрики
+	matchers  model.Labels  // метки, которые должны быть у временного ряда
+	rate      bool          // вычислять скорость роста counter за окно
+	window    time.Duration // окно для rate
+	operator  string
+	threshold float64
+}
+
+var (
+	exprRegexp = regexp.MustCompile(
+		`^\s*(?:rate\(\s*(?P<rsel>[^\s\[\]()]+)\s*\[\s*(?P<window>[^\]]+?)\s*\]\s*\)|(?P<sel>[^\s()<>=!]+))` +
+			`\s*(?P<op>>=|<=|==|!=|>|<)\s*(?P<num>[-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)\s*(?P<unit>[a-zA-Z]*)\s*$`)
+	selectorRegexp = regexp.MustCompile(`^([^{}]+)(?:\{(.*)\})?$`)
+	matcherRegexp  = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*"([^"]*)"\s*$`)
+)
+
+// units - множители для суффиксов порога. Единицы объема двоичные: 1KB = 1024 байт.
+var units = map[string]float64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// ErrInvalidExpr возвращается, если выражение правила не удалось разобрать.
+var ErrInvalidExpr = errors.New("invalid alerting expression")
+
+// NewRule разбирает описание правила из конфига.
+func NewRule(cfg RuleConfig) (*Rule, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("rule name must not be empty")
+	}
+
+	rule := &Rule{
+		Name:    cfg.Name,
+		Expr:    cfg.Expr,
+		Labels:  model.Labels(cfg.Labels),
+		Summary: cfg.Summary,
+	}
+
+	if cfg.For != "" {
+		d, err := time.ParseDuration(cfg.For)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: invalid for: %w", cfg.Name, err)
+		}
+		rule.For = d
+	}
+
+	match := exprRegexp.FindStringSubmatch(cfg.Expr)
+	if match == nil {
+		return nil, fmt.Errorf("rule %s: %w: %q", cfg.Name, ErrInvalidExpr, cfg.Expr)
+	}
+	group := func(name string) string { return match[exprRegexp.SubexpIndex(name)] }
+
+	selector := group("sel")
+	if selector == "" {
+		selector = group("rsel")
+		window, err := time.ParseDuration(group("window"))
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("rule %s: %w: invalid rate window %q", cfg.Name, ErrInvalidExpr, group("window"))
+		}
+		rule.rate = true
+		rule.window = window
+	}
+
+	metric, matchers, err := parseSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", cfg.Name, err)
+	}
+	rule.metric = metric
+	rule.matchers = matchers
+
+	threshold, err := strconv.ParseFloat(group("num"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w: %v", cfg.Name, ErrInvalidExpr, err)
+	}
+	multiplier, ok := units[strings.ToUpper(group("unit"))]
+	if !ok {
+		return nil, fmt.Errorf("rule %s: %w: unknown unit %q", cfg.Name, ErrInvalidExpr, group("unit"))
+	}
+	rule.threshold = threshold * multiplier
+	rule.operator = group("op")
+
+	return rule, nil
+}
+
+// parseSelector разбирает селектор вида Name или Name{k1="v1",k2="v2"}.
+func parseSelector(selector string) (string, model.Labels, error) {
+	match := selectorRegexp.FindStringSubmatch(selector)
+	if match == nil {
+		return "", nil, fmt.Errorf("%w: invalid selector %q", ErrInvalidExpr, selector)
+	}
+
+	var matchers model.Labels
+	if strings.TrimSpace(match[2]) != "" {
+		matchers = make(model.Labels)
+		for _, pair := range strings.Split(match[2], ",") {
+			m := matcherRegexp.FindStringSubmatch(pair)
+			if m == nil {
+				return "", nil, fmt.Errorf("%w: invalid label matcher %q", ErrInvalidExpr, pair)
+			}
+			matchers[m[1]] = m[2]
+		}
+	}
+	return match[1], matchers, nil
+}
+
+// matches проверяет, что временной ряд относится к правилу.
+func (r *Rule) matches(m model.Metrics) bool {
+	if m.ID != r.metric {
+		return false
+	}
+	if r.rate && m.MType != "counter" {
+		return false
+	}
+	for k, v := range r.matchers {
+		if m.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// compare применяет оператор правила к значению.
+func (r *Rule) compare(value float64) bool {
+	switch r.operator {
+	case ">":
+		return value > r.threshold
+	case ">=":
+		return value >= r.threshold
+	case "<":
+		return value < r.threshold
+	case "<=":
+		return value <= r.threshold
+	case "==":
+		return value == r.threshold
+	case "!=":
+		return value != r.threshold
+	}
+	return false
+}
@@ -1,58 +1,226 @@
+// Package collector собирает метрики агента из подключаемых источников.
 package collector
 
 import (
-	"math/rand/v2"
-	"runtime"
-	"strconv"
+	"context"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
 	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
-	"github.com/shirou/gopsutil/cpu"
-	"github.com/shirou/gopsutil/mem"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
 )
 
-func UpdateMetrics(memStorage interfaces.Storage) {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-	memStorage.SetGauge("Alloc", float64(m.Alloc))
-	memStorage.SetGauge("BuckHashSys", float64(m.BuckHashSys))
-	memStorage.SetGauge("Frees", float64(m.Frees))
-	memStorage.SetGauge("GCCPUFraction", float64(m.GCCPUFraction))
-	memStorage.SetGauge("GCSys", float64(m.GCSys))
-	memStorage.SetGauge("HeapAlloc", float64(m.HeapAlloc))
-	memStorage.SetGauge("HeapIdle", float64(m.HeapIdle))
-	memStorage.SetGauge("HeapInuse", float64(m.HeapInuse))
-	memStorage.SetGauge("HeapObjects", float64(m.HeapObjects))
-	memStorage.SetGauge("HeapReleased", float64(m.HeapReleased))
-	memStorage.SetGauge("HeapSys", float64(m.HeapSys))
-	memStorage.SetGauge("LastGC", float64(m.LastGC))
-	memStorage.SetGauge("Lookups", float64(m.Lookups))
-	memStorage.SetGauge("MCacheInuse", float64(m.MCacheInuse))
-	memStorage.SetGauge("MCacheSys", float64(m.MCacheSys))
-	memStorage.SetGauge("MSpanInuse", float64(m.MSpanInuse))
-	memStorage.SetGauge("MSpanSys", float64(m.MSpanSys))
-	memStorage.SetGauge("Mallocs", float64(m.Mallocs))
-	memStorage.SetGauge("NextGC", float64(m.NextGC))
-	memStorage.SetGauge("NumForcedGC", float64(m.NumForcedGC))
-	memStorage.SetGauge("NumGC", float64(m.NumGC))
-	memStorage.SetGauge("OtherSys", float64(m.OtherSys))
-	memStorage.SetGauge("PauseTotalNs", float64(m.PauseTotalNs))
-	memStorage.SetGauge("StackInuse", float64(m.StackInuse))
-	memStorage.SetGauge("StackSys", float64(m.StackSys))
-	memStorage.SetGauge("Sys", float64(m.Sys))
-	memStorage.SetGauge("TotalAlloc", float64(m.TotalAlloc))
-
-	memStorage.AddCounter("PollCount", 1)
-	memStorage.SetGauge("RandomValue", rand.Float64())
-}
-
-func UpdateExtraMetrics(memStorage interfaces.Storage) {
-
-	v, _ := mem.VirtualMemory()
-	memStorage.SetGauge("TotalMemory", float64(v.Total))
-	memStorage.SetGauge("FreeMemory", float64(v.Free))
-
-	cpuUtilization, _ := cpu.Percent(0, true)
-	for i, cpuPercent := range cpuUtilization {
-		memStorage.SetGauge("CPUutilization"+strconv.Itoa(i+1), cpuPercent)
+// Factory создает источник метрик по конфигу агента.
+type Factory func(cfg flags.Flags) (interfaces.Collector, error)
+
+// builtin - источники метрик агента в порядке регистрации.
+// defaultEnabled сообщает, включён ли источник, если в конфиге он не упомянут.
+var builtin = []struct {
+	name           string
+	defaultEnabled func(cfg flags.Flags) bool
+	factory        Factory
+}{
+	{"runtime", always, newRuntimeCollector},
+	{"memory", always, newMemoryCollector},
+	{"cpu", always, newCPUCollector},
+	{"swap", always, newSwapCollector},
+	{"disk", always, newDiskCollector},
+	{"network", always, newNetworkCollector},
+	{"load", always, newLoadCollector},
+	{"fd", always, newFDCollector},
+	{"process", hasProcesses, newProcessCollector},
+}
+
+func always(flags.Flags) bool { return true }
+
+func hasProcesses(cfg flags.Flags) bool { return len(cfg.Processes) > 0 }
+
+// entry - зарегистрированный источник и интервал его опроса.
+type entry struct {
+	collector interfaces.Collector
+	interval  time.Duration
+}
+
+// Registry опрашивает зарегистрированные источники метрик и сохраняет метрики в хранилище агента.
+type Registry struct {
+	entries []entry
+}
+
+// NewRegistry создает пустой реестр источников.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// New создает реестр со встроенными источниками, включёнными в конфиге агента.
+func New(cfg flags.Flags) (*Registry, error) {
+	for name := range cfg.Collectors {
+		if !isBuiltin(name) {
+			return nil, fmt.Errorf("неизвестный источник метрик %q", name)
+		}
+	}
+
+	r := NewRegistry()
+	for _, b := range builtin {
+		c, configured := cfg.Collectors[b.name]
+		enabled := b.defaultEnabled(cfg)
+		if configured && c.Enabled != nil {
+			enabled = *c.Enabled
+		}
+		if !enabled {
+			continue
+		}
+
+		interval := cfg.PollInterval
+		if c.Interval != "" {
+			d, err := time.ParseDuration(c.Interval)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("неверный интервал %q для источника метрик %q", c.Interval, b.name)
+			}
+			interval = d
+		}
+
+		collector, err := b.factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при создании источника метрик %q: %w", b.name, err)
+		}
+		r.Register(collector, interval)
+	}
+	return r, nil
+}
+
+// Register добавляет источник, который будет опрашиваться с интервалом interval.
+func (r *Registry) Register(c interfaces.Collector, interval time.Duration) {
+	r.entries = append(r.entries, entry{collector: c, interval: interval})
+}
+
+// Names возвращает имена зарегистрированных источников.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.entries))
+	for _, e := range r.entries {
+		names = append(names, e.collector.Name())
+	}
+	return names
+}
+
+// Run опрашивает каждый источник со своим интервалом до отмены контекста.
+func (r *Registry) Run(ctx context.Context, storage interfaces.Storage) {
+	var wg sync.WaitGroup
+	for _, e := range r.entries {
+		wg.Add(1)
+		go func(e entry) {
+			defer wg.Done()
+
+			ticker := time.NewTicker(e.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					Poll(ctx, e.collector, storage)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+// Poll опрашивает источник один раз и сохраняет метрики в хранилище одной пачкой.
+// Ряды, исчезнувшие из результата источника interfaces.ExpiringCollector, удаляются.
+func Poll(ctx context.Context, c interfaces.Collector, storage interfaces.Storage) {
+	metrics, err := c.Collect(ctx)
+	if err != nil {
+		log.I().Warnf("ошибка при сборе метрик %s: %v", c.Name(), err)
+	}
+	if e, ok := c.(interfaces.ExpiringCollector); ok {
+		expire(ctx, e, storage)
+	}
+	if len(metrics) == 0 {
+		return
+	}
+	if err := storage.UpdateBatch(ctx, metrics); err != nil {
+		log.I().Warnf("ошибка при сохранении метрик %s: %v", c.Name(), err)
+	}
+}
+
+// expire удаляет из хранилища ряды, исчезнувшие из результата источника.
+func expire(ctx context.Context, c interfaces.ExpiringCollector, storage interfaces.Storage) {
+	for _, m := range c.Expired() {
+		if _, err := storage.Delete(ctx, m.MType, m.ID, m.Labels); err != nil {
+			log.I().Warnf("ошибка при удалении метрики %s: %v", m.ID, err)
+		}
+	}
+}
+
+func isBuiltin(name string) bool {
+	for _, b := range builtin {
+		if b.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func gauge(name string, value float64) model.Metrics {
+	return model.Metrics{ID: name, MType: "gauge", Value: &value}
+}
+
+func counter(name string, delta int64) model.Metrics {
+	return model.Metrics{ID: name, MType: "counter", Delta: &delta}
+}
+
+// withLabels добавляет метки к метрике.
+func withLabels(m model.Metrics, labels model.Labels) model.Metrics {
+	m.Labels = labels
+	return m
+}
+
+// cumulative переводит накопительные счётчики системы (байты, пакеты, операции)
+// в приращения с прошлого опроса, как того требует Collector.
+type cumulative struct {
+	mutex sync.Mutex
+	prev  map[string]uint64
+}
+
+func newCumulative() *cumulative {
+	return &cumulative{prev: make(map[string]uint64)}
+}
+
+// delta возвращает метрику counter с приращением значения value с прошлого вызова.
+// При первом вызове значение только запоминается, и ok равно false.
+// Если значение уменьшилось (счётчик сброшен), приращением считается само значение.
+func (c *cumulative) delta(name string, labels model.Labels, value uint64) (m model.Metrics, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := model.MetricKey("counter", name, labels)
+	prev, seen := c.prev[key]
+	c.prev[key] = value
+	if !seen {
+		return model.Metrics{}, false
+	}
+
+	d := value - prev
+	if value < prev {
+		d = value
+	}
+	return withLabels(counter(name, int64(d)), labels), true
+}
+
+// forget удаляет запомненное значение счётчика, например, когда процесс завершился.
+func (c *cumulative) forget(name string, labels model.Labels) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.prev, model.MetricKey("counter", name, labels))
+}
+
+// appendDelta добавляет к metrics приращение счётчика, если оно известно.
+func (c *cumulative) appendDelta(metrics []model.Metrics, name string, labels model.Labels, value uint64) []model.Metrics {
+	if m, ok := c.delta(name, labels, value); ok {
+		metrics = append(metrics, m)
 	}
+	return metrics
 }
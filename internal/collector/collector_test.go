@@ -0,0 +1,139 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubCollector - тестовый источник с заданными метриками.
+type stubCollector struct {
+	metrics []model.Metrics
+	err     error
+}
+
+func (s stubCollector) Name() string { return "stub" }
+
+func (s stubCollector) Collect(context.Context) ([]model.Metrics, error) {
+	return s.metrics, s.err
+}
+
+func TestNewRegistry(t *testing.T) {
+	disabled, enabled := false, true
+	r, err := New(flags.Flags{
+		PollInterval: 2 * time.Second,
+		Collectors: map[string]flags.Collector{
+			"memory": {Enabled: &disabled},
+			"cpu":    {Interval: "5s"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"runtime", "cpu", "swap", "disk", "network", "load", "fd"}, r.Names())
+	assert.Equal(t, 2*time.Second, r.entries[0].interval)
+	assert.Equal(t, 5*time.Second, r.entries[1].interval)
+
+	_, err = New(flags.Flags{Collectors: map[string]flags.Collector{"gpu": {}}})
+	assert.Error(t, err)
+
+	_, err = New(flags.Flags{Collectors: map[string]flags.Collector{"cpu": {Interval: "soon"}}})
+	assert.Error(t, err)
+
+	// Источник process включается, только если заданы процессы.
+	r, err = New(flags.Flags{Processes: []flags.Process{{Name: "app", Pattern: "^app$"}}})
+	require.NoError(t, err)
+	assert.Contains(t, r.Names(), "process")
+
+	_, err = New(flags.Flags{Collectors: map[string]flags.Collector{"process": {Enabled: &enabled}}})
+	assert.Error(t, err)
+}
+
+func TestPoll(t *testing.T) {
+	s := storage.NewMemStorage()
+	Poll(context.Background(), runtimeCollector{}, s)
+	Poll(context.Background(), runtimeCollector{}, s)
+
+	metrics, err := s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *metrics[model.MetricKey("counter", "PollCount", nil)].Delta)
+	assert.Contains(t, metrics, model.MetricKey("gauge", "HeapAlloc", nil))
+
+	// Ошибка источника не мешает сохранить то, что удалось собрать.
+	Poll(context.Background(), stubCollector{
+		metrics: []model.Metrics{gauge("Partial", 1)},
+		err:     errors.New("permission denied"),
+	}, s)
+	metrics, err = s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, metrics, model.MetricKey("gauge", "Partial", nil))
+}
+
+func TestRegistryRun(t *testing.T) {
+	s := storage.NewMemStorage()
+	r := NewRegistry()
+	r.Register(stubCollector{metrics: []model.Metrics{counter("Ticks", 1)}}, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r.Run(ctx, s)
+
+	metrics, err := s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, *metrics[model.MetricKey("counter", "Ticks", nil)].Delta, int64(2))
+}
+
+func TestCumulative(t *testing.T) {
+	c := newCumulative()
+	labels := model.Labels{"interface": "eth0"}
+
+	_, ok := c.delta("NetBytesSent", labels, 100)
+	assert.False(t, ok, "первое значение только запоминается")
+
+	m, ok := c.delta("NetBytesSent", labels, 150)
+	require.True(t, ok)
+	assert.Equal(t, int64(50), *m.Delta)
+	assert.Equal(t, labels, m.Labels)
+
+	// Другой интерфейс учитывается отдельно.
+	_, ok = c.delta("NetBytesSent", model.Labels{"interface": "lo"}, 10)
+	assert.False(t, ok)
+
+	// Счётчик сброшен, например после перезагрузки интерфейса.
+	m, ok = c.delta("NetBytesSent", labels, 20)
+	require.True(t, ok)
+	assert.Equal(t, int64(20), *m.Delta)
+}
+
+func TestFDCollector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file-nr")
+	require.NoError(t, os.WriteFile(path, []byte("1632\t0\t9223372036854775807\n"), 0o600))
+
+	metrics, err := fdCollector{path: path}.Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "OpenFileDescriptors", metrics[0].ID)
+	assert.Equal(t, 1632.0, *metrics[0].Value)
+
+	metrics, err = fdCollector{path: filepath.Join(t.TempDir(), "missing")}.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestCPUCollector(t *testing.T) {
+	metrics, err := cpuCollector{}.Collect(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	for i, m := range metrics {
+		assert.Equal(t, "CPUutilization", m.ID)
+		assert.Equal(t, model.Labels{"cpu": strconv.Itoa(i + 1)}, m.Labels)
+	}
+}
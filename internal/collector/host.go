@@ -0,0 +1,162 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/net"
+)
+
+// diskCollector собирает заполненность каждой точки монтирования (gauge с меткой mount)
+// и счётчики ввода-вывода каждого диска (counter с меткой device).
+type diskCollector struct {
+	io *cumulative
+}
+
+func newDiskCollector(flags.Flags) (interfaces.Collector, error) {
+	return &diskCollector{io: newCumulative()}, nil
+}
+
+func (*diskCollector) Name() string { return "disk" }
+
+func (d *diskCollector) Collect(ctx context.Context) ([]model.Metrics, error) {
+	var errs []error
+	metrics := make([]model.Metrics, 0)
+
+	partitions, err := disk.PartitionsWithContext(ctx, false)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, p := range partitions {
+		usage, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Mountpoint, err))
+			continue
+		}
+		labels := model.Labels{"mount": p.Mountpoint}
+		metrics = append(metrics,
+			withLabels(gauge("DiskTotal", float64(usage.Total)), labels),
+			withLabels(gauge("DiskUsed", float64(usage.Used)), labels),
+			withLabels(gauge("DiskFree", float64(usage.Free)), labels),
+			withLabels(gauge("DiskUsedPercent", usage.UsedPercent), labels),
+		)
+	}
+
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for device, c := range counters {
+		labels := model.Labels{"device": device}
+		metrics = d.io.appendDelta(metrics, "DiskReadBytes", labels, c.ReadBytes)
+		metrics = d.io.appendDelta(metrics, "DiskWriteBytes", labels, c.WriteBytes)
+		metrics = d.io.appendDelta(metrics, "DiskReadCount", labels, c.ReadCount)
+		metrics = d.io.appendDelta(metrics, "DiskWriteCount", labels, c.WriteCount)
+	}
+	return metrics, errors.Join(errs...)
+}
+
+// networkCollector собирает счётчики байт, пакетов и ошибок каждого сетевого интерфейса
+// (counter с меткой interface).
+type networkCollector struct {
+	io *cumulative
+}
+
+func newNetworkCollector(flags.Flags) (interfaces.Collector, error) {
+	return &networkCollector{io: newCumulative()}, nil
+}
+
+func (*networkCollector) Name() string { return "network" }
+
+func (n *networkCollector) Collect(ctx context.Context) ([]model.Metrics, error) {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]model.Metrics, 0, len(counters)*8)
+	for _, c := range counters {
+		labels := model.Labels{"interface": c.Name}
+		metrics = n.io.appendDelta(metrics, "NetBytesSent", labels, c.BytesSent)
+		metrics = n.io.appendDelta(metrics, "NetBytesRecv", labels, c.BytesRecv)
+		metrics = n.io.appendDelta(metrics, "NetPacketsSent", labels, c.PacketsSent)
+		metrics = n.io.appendDelta(metrics, "NetPacketsRecv", labels, c.PacketsRecv)
+		metrics = n.io.appendDelta(metrics, "NetErrIn", labels, c.Errin)
+		metrics = n.io.appendDelta(metrics, "NetErrOut", labels, c.Errout)
+		metrics = n.io.appendDelta(metrics, "NetDropIn", labels, c.Dropin)
+		metrics = n.io.appendDelta(metrics, "NetDropOut", labels, c.Dropout)
+	}
+	return metrics, nil
+}
+
+// loadCollector собирает среднюю загрузку системы за 1, 5 и 15 минут.
+type loadCollector struct{}
+
+func newLoadCollector(flags.Flags) (interfaces.Collector, error) {
+	return loadCollector{}, nil
+}
+
+func (loadCollector) Name() string { return "load" }
+
+func (loadCollector) Collect(ctx context.Context) ([]model.Metrics, error) {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []model.Metrics{
+		gauge("Load1", avg.Load1),
+		gauge("Load5", avg.Load5),
+		gauge("Load15", avg.Load15),
+	}, nil
+}
+
+// fileNrPath - статистика открытых файловых дескрипторов ядра Linux.
+const fileNrPath = "/proc/sys/fs/file-nr"
+
+// fdCollector собирает число открытых в системе файловых дескрипторов и их предел.
+// Доступен только в Linux, на других системах метрик не возвращает.
+type fdCollector struct {
+	path string
+}
+
+func newFDCollector(flags.Flags) (interfaces.Collector, error) {
+	return fdCollector{path: fileNrPath}, nil
+}
+
+func (fdCollector) Name() string { return "fd" }
+
+func (f fdCollector) Collect(context.Context) ([]model.Metrics, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Формат файла: "выделено свободно максимум".
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("неверный формат %s: %q", f.path, data)
+	}
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		values[i], err = strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("неверный формат %s: %w", f.path, err)
+		}
+	}
+	return []model.Metrics{
+		gauge("OpenFileDescriptors", values[0]-values[1]),
+		gauge("MaxFileDescriptors", values[2]),
+	}, nil
+}
@@ -0,0 +1,286 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/shirou/gopsutil/process"
+)
+
+// cgroupRoot - точка монтирования cgroup, относительно которой задаются пути в конфиге.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// processTarget - способ найти процессы одной записи конфига.
+type processTarget struct {
+	name     string
+	pidFile  string
+	pattern  *regexp.Regexp
+	cgroup   string
+	pidLabel bool
+}
+
+// processCollector собирает метрики процессов из конфига агента: загрузку CPU,
+// резидентную память, число потоков, открытых дескрипторов и байты ввода-вывода.
+// Метрики помечаются метками process (имя записи конфига) и pid; без метки pid
+// метрики процессов записи суммируются. Ряды завершившихся процессов возвращает Expired.
+type processCollector struct {
+	targets []processTarget
+	io      *cumulative
+
+	mutex     sync.Mutex
+	processes map[int32]trackedProcess // процессы с прошлого опроса
+	series    map[string]model.Metrics // ряды последнего опроса
+	expired   []model.Metrics          // ряды, пропавшие при последнем опросе
+}
+
+// trackedProcess - отслеживаемый процесс. process.Process хранит время CPU
+// с прошлого опроса, по нему считается загрузка CPU.
+type trackedProcess struct {
+	proc *process.Process
+	name string
+}
+
+func newProcessCollector(cfg flags.Flags) (interfaces.Collector, error) {
+	c := &processCollector{
+		io:        newCumulative(),
+		processes: make(map[int32]trackedProcess),
+		series:    make(map[string]model.Metrics),
+	}
+	for _, p := range cfg.Processes {
+		target, err := newProcessTarget(p)
+		if err != nil {
+			return nil, err
+		}
+		c.targets = append(c.targets, target)
+	}
+	if len(c.targets) == 0 {
+		return nil, errors.New("не заданы процессы в processes")
+	}
+	return c, nil
+}
+
+func newProcessTarget(p flags.Process) (processTarget, error) {
+	if p.Name == "" {
+		return processTarget{}, errors.New("не задано имя процесса")
+	}
+
+	methods := 0
+	for _, v := range []string{p.PIDFile, p.Pattern, p.Cgroup} {
+		if v != "" {
+			methods++
+		}
+	}
+	if methods != 1 {
+		return processTarget{}, fmt.Errorf("для процесса %q нужно задать ровно одно из pid_file, pattern, cgroup", p.Name)
+	}
+
+	target := processTarget{name: p.Name, pidFile: p.PIDFile, pidLabel: p.PIDLabel == nil || *p.PIDLabel}
+	if p.Pattern != "" {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return processTarget{}, fmt.Errorf("неверный pattern процесса %q: %w", p.Name, err)
+		}
+		target.pattern = re
+	}
+	if p.Cgroup != "" {
+		target.cgroup = p.Cgroup
+		if !strings.HasPrefix(p.Cgroup, cgroupRoot+"/") {
+			target.cgroup = filepath.Join(cgroupRoot, p.Cgroup)
+		}
+	}
+	return target, nil
+}
+
+func (*processCollector) Name() string { return "process" }
+
+func (c *processCollector) Collect(ctx context.Context) ([]model.Metrics, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var errs []error
+	metrics := make([]model.Metrics, 0)
+	seen := make(map[int32]bool)
+	for _, target := range c.targets {
+		pids, err := target.pids(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("процесс %q: %w", target.name, err))
+			continue
+		}
+		collected := make([]model.Metrics, 0)
+		for _, pid := range pids {
+			if seen[pid] {
+				continue
+			}
+			seen[pid] = true
+			collected = c.collect(ctx, target.name, pid, collected)
+		}
+		if !target.pidLabel {
+			collected = sumProcesses(collected)
+		}
+		metrics = append(metrics, collected...)
+	}
+
+	// Завершившиеся процессы больше не отслеживаются.
+	for pid, tracked := range c.processes {
+		if !seen[pid] {
+			delete(c.processes, pid)
+			labels := processLabels(pid, tracked.name)
+			c.io.forget("ProcessReadBytes", labels)
+			c.io.forget("ProcessWriteBytes", labels)
+		}
+	}
+	c.expire(metrics)
+	return metrics, errors.Join(errs...)
+}
+
+// Expired возвращает ряды, пропавшие при последнем опросе: метрики завершившихся
+// процессов и записей, процессы которых не найдены.
+func (c *processCollector) Expired() []model.Metrics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expired := c.expired
+	c.expired = nil
+	return expired
+}
+
+// expire запоминает ряды опроса и находит пропавшие с прошлого. Вызывается под блокировкой.
+func (c *processCollector) expire(metrics []model.Metrics) {
+	series := make(map[string]model.Metrics, len(metrics))
+	for _, m := range metrics {
+		series[m.Key()] = model.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels}
+	}
+	for key, m := range c.series {
+		if _, ok := series[key]; !ok {
+			c.expired = append(c.expired, m)
+		}
+	}
+	c.series = series
+}
+
+// sumProcesses убирает из метрик метку pid и складывает значения процессов одной записи.
+func sumProcesses(metrics []model.Metrics) []model.Metrics {
+	index := make(map[string]int)
+	result := make([]model.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		labels := make(model.Labels, len(m.Labels))
+		for k, v := range m.Labels {
+			if k != "pid" {
+				labels[k] = v
+			}
+		}
+		m.Labels = labels
+
+		i, ok := index[m.Key()]
+		if !ok {
+			index[m.Key()] = len(result)
+			result = append(result, m)
+			continue
+		}
+		if m.MType == "counter" {
+			delta := *result[i].Delta + *m.Delta
+			result[i].Delta = &delta
+		} else {
+			value := *result[i].Value + *m.Value
+			result[i].Value = &value
+		}
+	}
+	return result
+}
+
+// collect добавляет к metrics метрики одного процесса. Недоступные значения
+// (например, байты ввода-вывода чужого процесса без прав) пропускаются.
+func (c *processCollector) collect(ctx context.Context, name string, pid int32, metrics []model.Metrics) []model.Metrics {
+	tracked, known := c.processes[pid]
+	if !known || tracked.name != name {
+		p, err := process.NewProcessWithContext(ctx, pid)
+		if err != nil {
+			return metrics
+		}
+		tracked = trackedProcess{proc: p, name: name}
+		c.processes[pid] = tracked
+		known = false
+	}
+	p := tracked.proc
+	labels := processLabels(pid, name)
+
+	// Загрузка CPU считается между опросами, поэтому при первом опросе процесса её ещё нет.
+	if percent, err := p.PercentWithContext(ctx, 0); err == nil && known {
+		metrics = append(metrics, withLabels(gauge("ProcessCPUPercent", percent), labels))
+	}
+	if mem, err := p.MemoryInfoWithContext(ctx); err == nil {
+		metrics = append(metrics, withLabels(gauge("ProcessRSS", float64(mem.RSS)), labels))
+	}
+	if threads, err := p.NumThreadsWithContext(ctx); err == nil {
+		metrics = append(metrics, withLabels(gauge("ProcessThreads", float64(threads)), labels))
+	}
+	if fds, err := p.NumFDsWithContext(ctx); err == nil {
+		metrics = append(metrics, withLabels(gauge("ProcessOpenFDs", float64(fds)), labels))
+	}
+	if io, err := p.IOCountersWithContext(ctx); err == nil {
+		metrics = c.io.appendDelta(metrics, "ProcessReadBytes", labels, io.ReadBytes)
+		metrics = c.io.appendDelta(metrics, "ProcessWriteBytes", labels, io.WriteBytes)
+	}
+	return metrics
+}
+
+func processLabels(pid int32, name string) model.Labels {
+	return model.Labels{"process": name, "pid": strconv.Itoa(int(pid))}
+}
+
+// pids возвращает идентификаторы процессов цели.
+func (t processTarget) pids(ctx context.Context) ([]int32, error) {
+	switch {
+	case t.pidFile != "":
+		data, err := os.ReadFile(t.pidFile)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("неверный PID-файл %s: %w", t.pidFile, err)
+		}
+		return []int32{int32(pid)}, nil
+	case t.cgroup != "":
+		return readCgroupProcs(filepath.Join(t.cgroup, "cgroup.procs"))
+	default:
+		processes, err := process.ProcessesWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pids := make([]int32, 0)
+		for _, p := range processes {
+			name, err := p.NameWithContext(ctx)
+			if err == nil && t.pattern.MatchString(name) {
+				pids = append(pids, p.Pid)
+			}
+		}
+		return pids, nil
+	}
+}
+
+// readCgroupProcs читает список процессов cgroup, по одному PID в строке.
+func readCgroupProcs(path string) ([]int32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int32, 0)
+	for _, line := range strings.Fields(string(data)) {
+		pid, err := strconv.ParseInt(line, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("неверный формат %s: %w", path, err)
+		}
+		pids = append(pids, int32(pid))
+	}
+	return pids, nil
+}
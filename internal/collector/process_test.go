@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		process flags.Process
+		wantErr bool
+	}{
+		{name: "pid file", process: flags.Process{Name: "app", PIDFile: "/run/app.pid"}},
+		{name: "pattern", process: flags.Process{Name: "nginx", Pattern: "^nginx$"}},
+		{name: "cgroup", process: flags.Process{Name: "db", Cgroup: "/system.slice/postgresql.service"}},
+		{name: "without name", process: flags.Process{PIDFile: "/run/app.pid"}, wantErr: true},
+		{name: "two methods", process: flags.Process{Name: "app", PIDFile: "/run/app.pid", Pattern: "app"}, wantErr: true},
+		{name: "no method", process: flags.Process{Name: "app"}, wantErr: true},
+		{name: "bad pattern", process: flags.Process{Name: "app", Pattern: "("}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newProcessTarget(test.process)
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	target, err := newProcessTarget(flags.Process{Name: "db", Cgroup: "/system.slice/postgresql.service"})
+	require.NoError(t, err)
+	assert.Equal(t, "/sys/fs/cgroup/system.slice/postgresql.service", target.cgroup)
+}
+
+func TestProcessCollector(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "app.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o600))
+
+	c, err := newProcessCollector(flags.Flags{Processes: []flags.Process{{Name: "app", PIDFile: pidFile}}})
+	require.NoError(t, err)
+
+	byName := func(metrics []model.Metrics) map[string]model.Metrics {
+		result := make(map[string]model.Metrics)
+		for _, m := range metrics {
+			result[m.ID] = m
+		}
+		return result
+	}
+
+	metrics, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	first := byName(metrics)
+	assert.NotContains(t, first, "ProcessCPUPercent", "загрузка CPU известна только со второго опроса")
+	require.Contains(t, first, "ProcessRSS")
+	assert.Greater(t, *first["ProcessRSS"].Value, 0.0)
+	assert.Equal(t, model.Labels{"process": "app", "pid": strconv.Itoa(os.Getpid())}, first["ProcessRSS"].Labels)
+	assert.Contains(t, first, "ProcessThreads")
+
+	metrics, err = c.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, byName(metrics), "ProcessCPUPercent")
+
+	// PID-файл удалён - процесс больше не отслеживается.
+	require.NoError(t, os.Remove(pidFile))
+	_, err = c.Collect(context.Background())
+	assert.Error(t, err)
+	assert.Empty(t, c.(*processCollector).processes)
+}
+
+func TestReadCgroupProcs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cgroup.procs")
+	require.NoError(t, os.WriteFile(path, []byte("1\n42\n"), 0o600))
+
+	pids, err := readCgroupProcs(path)
+	require.NoError(t, err)
+	assert.Equal(t, []int32{1, 42}, pids)
+}
+
+func TestProcessCollectorExpired(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "app.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0o600))
+	c, err := newProcessCollector(flags.Flags{Processes: []flags.Process{{Name: "app", PIDFile: pidFile}}})
+	require.NoError(t, err)
+
+	s := storage.NewMemStorageWithoutHistory()
+	Poll(context.Background(), c, s)
+	rss := model.MetricKey("gauge", "ProcessRSS", model.Labels{"process": "app", "pid": strconv.Itoa(os.Getpid())})
+	metrics, err := s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	require.Contains(t, metrics, rss)
+
+	// Процесс завершился - его ряды удаляются из хранилища агента и больше не отправляются.
+	require.NoError(t, os.Remove(pidFile))
+	Poll(context.Background(), c, s)
+	metrics, err = s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestSumProcesses(t *testing.T) {
+	metrics := sumProcesses([]model.Metrics{
+		withLabels(gauge("ProcessRSS", 100), processLabels(1, "nginx")),
+		withLabels(counter("ProcessReadBytes", 5), processLabels(1, "nginx")),
+		withLabels(gauge("ProcessRSS", 50), processLabels(2, "nginx")),
+		withLabels(counter("ProcessReadBytes", 7), processLabels(2, "nginx")),
+	})
+
+	require.Len(t, metrics, 2)
+	assert.Equal(t, model.Labels{"process": "nginx"}, metrics[0].Labels)
+	assert.Equal(t, 150.0, *metrics[0].Value)
+	assert.Equal(t, int64(12), *metrics[1].Delta)
+
+	disabled := false
+	target, err := newProcessTarget(flags.Process{Name: "app", PIDFile: "/run/app.pid", PIDLabel: &disabled})
+	require.NoError(t, err)
+	assert.False(t, target.pidLabel)
+}
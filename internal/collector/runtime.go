@@ -0,0 +1,58 @@
+package collector
+
+import (
+	"context"
+	"math/rand/v2"
+	"runtime"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+// runtimeCollector собирает статистику памяти Go-рантайма, счётчик опросов PollCount
+// и случайное значение RandomValue.
+type runtimeCollector struct{}
+
+func newRuntimeCollector(flags.Flags) (interfaces.Collector, error) {
+	return runtimeCollector{}, nil
+}
+
+func (runtimeCollector) Name() string { return "runtime" }
+
+func (runtimeCollector) Collect(context.Context) ([]model.Metrics, error) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	metrics := make([]model.Metrics, 0, 30)
+	metrics = append(metrics, gauge("Alloc", float64(m.Alloc)))
+	metrics = append(metrics, gauge("BuckHashSys", float64(m.BuckHashSys)))
+	metrics = append(metrics, gauge("Frees", float64(m.Frees)))
+	metrics = append(metrics, gauge("GCCPUFraction", float64(m.GCCPUFraction)))
+	metrics = append(metrics, gauge("GCSys", float64(m.GCSys)))
+	metrics = append(metrics, gauge("HeapAlloc", float64(m.HeapAlloc)))
+	metrics = append(metrics, gauge("HeapIdle", float64(m.HeapIdle)))
+	metrics = append(metrics, gauge("HeapInuse", float64(m.HeapInuse)))
+	metrics = append(metrics, gauge("HeapObjects", float64(m.HeapObjects)))
+	metrics = append(metrics, gauge("HeapReleased", float64(m.HeapReleased)))
+	metrics = append(metrics, gauge("HeapSys", float64(m.HeapSys)))
+	metrics = append(metrics, gauge("LastGC", float64(m.LastGC)))
+	metrics = append(metrics, gauge("Lookups", float64(m.Lookups)))
+	metrics = append(metrics, gauge("MCacheInuse", float64(m.MCacheInuse)))
+	metrics = append(metrics, gauge("MCacheSys", float64(m.MCacheSys)))
+	metrics = append(metrics, gauge("MSpanInuse", float64(m.MSpanInuse)))
+	metrics = append(metrics, gauge("MSpanSys", float64(m.MSpanSys)))
+	metrics = append(metrics, gauge("Mallocs", float64(m.Mallocs)))
+	metrics = append(metrics, gauge("NextGC", float64(m.NextGC)))
+	metrics = append(metrics, gauge("NumForcedGC", float64(m.NumForcedGC)))
+	metrics = append(metrics, gauge("NumGC", float64(m.NumGC)))
+	metrics = append(metrics, gauge("OtherSys", float64(m.OtherSys)))
+	metrics = append(metrics, gauge("PauseTotalNs", float64(m.PauseTotalNs)))
+	metrics = append(metrics, gauge("StackInuse", float64(m.StackInuse)))
+	metrics = append(metrics, gauge("StackSys", float64(m.StackSys)))
+	metrics = append(metrics, gauge("Sys", float64(m.Sys)))
+	metrics = append(metrics, gauge("TotalAlloc", float64(m.TotalAlloc)))
+
+	metrics = append(metrics, counter("PollCount", 1))
+	metrics = append(metrics, gauge("RandomValue", rand.Float64()))
+	return metrics, nil
+}
@@ -0,0 +1,76 @@
+package collector
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// memoryCollector собирает объём оперативной памяти системы.
+type memoryCollector struct{}
+
+func newMemoryCollector(flags.Flags) (interfaces.Collector, error) {
+	return memoryCollector{}, nil
+}
+
+func (memoryCollector) Name() string { return "memory" }
+
+func (memoryCollector) Collect(ctx context.Context) ([]model.Metrics, error) {
+	v, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []model.Metrics{
+		gauge("TotalMemory", float64(v.Total)),
+		gauge("FreeMemory", float64(v.Free)),
+	}, nil
+}
+
+// cpuCollector собирает загрузку каждого процессора с прошлого опроса: ряд CPUutilization
+// с номером процессора в метке cpu.
+type cpuCollector struct{}
+
+func newCPUCollector(flags.Flags) (interfaces.Collector, error) {
+	return cpuCollector{}, nil
+}
+
+func (cpuCollector) Name() string { return "cpu" }
+
+func (cpuCollector) Collect(ctx context.Context) ([]model.Metrics, error) {
+	cpuUtilization, err := cpu.PercentWithContext(ctx, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]model.Metrics, 0, len(cpuUtilization))
+	for i, cpuPercent := range cpuUtilization {
+		metrics = append(metrics, withLabels(gauge("CPUutilization", cpuPercent), model.Labels{"cpu": strconv.Itoa(i + 1)}))
+	}
+	return metrics, nil
+}
+
+// swapCollector собирает использование файла подкачки.
+type swapCollector struct{}
+
+func newSwapCollector(flags.Flags) (interfaces.Collector, error) {
+	return swapCollector{}, nil
+}
+
+func (swapCollector) Name() string { return "swap" }
+
+func (swapCollector) Collect(ctx context.Context) ([]model.Metrics, error) {
+	s, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []model.Metrics{
+		gauge("SwapTotal", float64(s.Total)),
+		gauge("SwapUsed", float64(s.Used)),
+		gauge("SwapFree", float64(s.Free)),
+		gauge("SwapUsedPercent", s.UsedPercent),
+	}, nil
+}
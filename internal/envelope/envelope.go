@@ -0,0 +1,152 @@
+// Package envelope шифрует тела запросов агента открытым ключом сервера.
+//
+// Версия 1 - исходная схема: весь JSON шифруется RSA PKCS#1 v1.5. Она ограничена
+// размером ключа (для 2048-битного ключа - 245 байт) и оставлена для совместимости.
+//
+// Версия 2 - гибридная схема: для каждого запроса генерируется ключ AES-256,
+// которым данные шифруются в режиме GCM, а сам ключ шифруется RSA-OAEP (SHA-256).
+// Формат тела:
+//
+//	версия (1 байт) | длина ключа (2 байта, big endian) | зашифрованный ключ | nonce (12 байт) | шифротекст
+//
+// Первые три байта участвуют в аутентификации GCM, поэтому подмена версии обнаруживается.
+// Версия передаётся также в заголовке Header; запрос без заголовка считается версией 1.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// VersionPKCS1 - шифрование всего тела RSA PKCS#1 v1.5.
+	VersionPKCS1 = 1
+	// VersionHybrid - ключ AES-GCM, зашифрованный RSA-OAEP.
+	VersionHybrid = 2
+
+	// Header - заголовок запроса с версией схемы шифрования тела.
+	Header = "Encryption-Version"
+	// SupportedHeader - заголовок ответа сервера со списком поддерживаемых версий.
+	SupportedHeader = "Encryption-Versions"
+
+	aesKeySize  = 32
+	headerSize  = 3
+	nonceLength = 12
+)
+
+// Supported - версии, которые понимает Decrypt, в виде значения SupportedHeader.
+const Supported = "1,2"
+
+var (
+	// ErrUnsupportedVersion - версия схемы шифрования неизвестна.
+	ErrUnsupportedVersion = errors.New("unsupported encryption version")
+	// ErrMalformed - тело не соответствует формату версии.
+	ErrMalformed = errors.New("malformed encrypted body")
+)
+
+// ParseVersion разбирает значение заголовка Header. Пустое значение означает версию 1.
+func ParseVersion(header string) (int, error) {
+	if header == "" {
+		return VersionPKCS1, nil
+	}
+	version, err := strconv.Atoi(header)
+	if err != nil || (version != VersionPKCS1 && version != VersionHybrid) {
+		return 0, fmt.Errorf("%w: %q", ErrUnsupportedVersion, header)
+	}
+	return version, nil
+}
+
+// Encrypt шифрует данные открытым ключом по схеме заданной версии.
+func Encrypt(pub *rsa.PublicKey, version int, plaintext []byte) ([]byte, error) {
+	switch version {
+	case VersionPKCS1:
+		return rsa.EncryptPKCS1v15(rand.Reader, pub, plaintext)
+	case VersionHybrid:
+		return encryptHybrid(pub, plaintext)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+}
+
+// Decrypt расшифровывает данные закрытым ключом по схеме заданной версии.
+func Decrypt(priv *rsa.PrivateKey, version int, data []byte) ([]byte, error) {
+	switch version {
+	case VersionPKCS1:
+		return rsa.DecryptPKCS1v15(rand.Reader, priv, data)
+	case VersionHybrid:
+		return decryptHybrid(priv, data)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+}
+
+func encryptHybrid(pub *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, headerSize, headerSize+len(encryptedKey)+nonceLength+len(plaintext)+gcm.Overhead())
+	out[0] = VersionHybrid
+	binary.BigEndian.PutUint16(out[1:headerSize], uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, out[:headerSize]), nil
+}
+
+func decryptHybrid(priv *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < headerSize {
+		return nil, ErrMalformed
+	}
+	if data[0] != VersionHybrid {
+		return nil, fmt.Errorf("%w: версия в теле %d", ErrMalformed, data[0])
+	}
+	keyLength := int(binary.BigEndian.Uint16(data[1:headerSize]))
+	if len(data) < headerSize+keyLength+nonceLength {
+		return nil, ErrMalformed
+	}
+
+	encryptedKey := data[headerSize : headerSize+keyLength]
+	nonce := data[headerSize+keyLength : headerSize+keyLength+nonceLength]
+	ciphertext := data[headerSize+keyLength+nonceLength:]
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, encryptedKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != aesKeySize {
+		return nil, ErrMalformed
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, data[:headerSize])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,72 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	small := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	large := bytes.Repeat([]byte(`{"id":"cpu","type":"gauge","value":12.5},`), 1000)
+
+	for _, version := range []int{VersionPKCS1, VersionHybrid} {
+		encrypted, err := Encrypt(&key.PublicKey, version, small)
+		require.NoError(t, err)
+		decrypted, err := Decrypt(key, version, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, small, decrypted)
+	}
+
+	// PKCS#1 v1.5 ограничен размером ключа, гибридная схема - нет.
+	_, err = Encrypt(&key.PublicKey, VersionPKCS1, large)
+	assert.Error(t, err)
+	encrypted, err := Encrypt(&key.PublicKey, VersionHybrid, large)
+	require.NoError(t, err)
+	decrypted, err := Decrypt(key, VersionHybrid, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, large, decrypted)
+
+	_, err = Encrypt(&key.PublicKey, 3, small)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encrypted, err := Encrypt(&key.PublicKey, VersionHybrid, []byte("payload"))
+	require.NoError(t, err)
+
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 1
+	_, err = Decrypt(key, VersionHybrid, tampered)
+	assert.Error(t, err)
+
+	wrongVersion := bytes.Clone(encrypted)
+	wrongVersion[0] = VersionPKCS1
+	_, err = Decrypt(key, VersionHybrid, wrongVersion)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	_, err = Decrypt(key, VersionHybrid, encrypted[:10])
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("")
+	require.NoError(t, err)
+	assert.Equal(t, VersionPKCS1, v)
+
+	v, err = ParseVersion("2")
+	require.NoError(t, err)
+	assert.Equal(t, VersionHybrid, v)
+
+	_, err = ParseVersion("7")
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
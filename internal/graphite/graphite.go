@@ -0,0 +1,176 @@
+// Package graphite принимает метрики по текстовому протоколу Graphite (plaintext) через TCP
+// и записывает их в хранилище метрик.
+//
+// Каждая строка имеет вид "path value timestamp". Поддерживаются метки в формате
+// тегов Graphite: "path;tag1=v1;tag2=v2 value timestamp". В Graphite нет типов метрик,
+// поэтому все значения сохраняются как gauge. Метка времени проверяется, но не сохраняется:
+// хранилище записывает время приёма.
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+const (
+	// maxBatchSize - максимальное число строк, сохраняемых одной пачкой.
+	maxBatchSize = 1000
+	// idleTimeout - время, после которого молчащее соединение закрывается.
+	idleTimeout = 5 * time.Minute
+	// maxLineLength - максимальная длина строки. Соединение со строкой длиннее закрывается,
+	// чтобы клиент не мог заставить сервер буферизовать данные без ограничений.
+	maxLineLength = 16 * 1024
+)
+
+// ErrInvalidLine - строка не соответствует протоколу Graphite.
+var ErrInvalidLine = errors.New("invalid graphite line")
+
+// ParseLine разбирает одну строку протокола Graphite в метрику gauge.
+func ParseLine(line string) (model.Metrics, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return model.Metrics{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+
+	parts := strings.Split(fields[0], ";")
+	name := parts[0]
+	if name == "" {
+		return model.Metrics{}, fmt.Errorf("%w: пустое имя метрики в %q", ErrInvalidLine, line)
+	}
+	var labels model.Labels
+	for _, tag := range parts[1:] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" {
+			return model.Metrics{}, fmt.Errorf("%w: неверный тег %q", ErrInvalidLine, tag)
+		}
+		if labels == nil {
+			labels = make(model.Labels)
+		}
+		labels[k] = v
+	}
+
+	if err := model.ValidateNames(name, labels); err != nil {
+		return model.Metrics{}, fmt.Errorf("%w: %w", ErrInvalidLine, err)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return model.Metrics{}, fmt.Errorf("%w: неверное значение в %q", ErrInvalidLine, line)
+	}
+	if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+		return model.Metrics{}, fmt.Errorf("%w: неверная метка времени в %q", ErrInvalidLine, line)
+	}
+
+	return model.Metrics{ID: name, MType: "gauge", Value: &value, Labels: labels}, nil
+}
+
+// Listener принимает соединения Graphite и записывает метрики в хранилище.
+// Строки, пришедшие одним блоком, сохраняются одной пачкой.
+type Listener struct {
+	listener net.Listener
+	storage  interfaces.Storage
+
+	wg sync.WaitGroup
+}
+
+// Listen открывает TCP-порт для приёма метрик Graphite.
+func Listen(address string, storage interfaces.Storage) (*Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при открытии порта Graphite: %w", err)
+	}
+	return &Listener{listener: listener, storage: storage}, nil
+}
+
+// Addr возвращает адрес, на котором слушает Listener.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Serve принимает соединения до отмены контекста, затем закрывает порт
+// и дожидается завершения открытых соединений.
+func (l *Listener) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		l.listener.Close()
+	}()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.I().Warnf("ошибка при приёме соединения Graphite: %v", err)
+			continue
+		}
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.handle(ctx, conn)
+		}()
+	}
+	l.wg.Wait()
+}
+
+// handle читает строки соединения до его закрытия или отмены контекста.
+func (l *Listener) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReaderSize(conn, maxLineLength)
+	batch := make([]model.Metrics, 0, maxBatchSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		data, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			log.I().Warnf("строка Graphite от %s длиннее %d байт, соединение закрыто", conn.RemoteAddr(), maxLineLength)
+			l.save(ctx, batch)
+			return
+		}
+		if line := strings.TrimSpace(string(data)); line != "" {
+			if m, perr := ParseLine(line); perr != nil {
+				log.I().Warnf("ошибка разбора строки Graphite от %s: %v", conn.RemoteAddr(), perr)
+			} else {
+				batch = append(batch, m)
+			}
+		}
+
+		// Пачка сохраняется, когда прочитано всё, что пришло, или она заполнилась.
+		if err != nil || reader.Buffered() == 0 || len(batch) == maxBatchSize {
+			l.save(ctx, batch)
+			batch = batch[:0]
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.I().Warnf("ошибка при чтении соединения Graphite %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// save сохраняет пачку метрик.
+func (l *Listener) save(ctx context.Context, batch []model.Metrics) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := l.storage.UpdateBatch(ctx, batch); err != nil {
+		log.I().Warnf("ошибка при сохранении метрик Graphite: %v", err)
+	}
+}
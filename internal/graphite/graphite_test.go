@@ -0,0 +1,111 @@
+package graphite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		line    string
+		want    model.Metrics
+		wantErr bool
+	}{
+		{line: "servers.web1.cpu 12.5 1700000000", want: model.Metrics{ID: "servers.web1.cpu", MType: "gauge", Value: value(12.5)}},
+		{line: "cpu;host=web1;dc=eu 3 1700000000", want: model.Metrics{ID: "cpu", MType: "gauge", Value: value(3),
+			Labels: model.Labels{"host": "web1", "dc": "eu"}}},
+		{line: "cpu 3", wantErr: true},
+		{line: "cpu x 1700000000", wantErr: true},
+		{line: "cpu nan 1700000000", wantErr: true},
+		{line: "cpu 3 yesterday", wantErr: true},
+		{line: "cpu;host 3 1700000000", wantErr: true},
+		{line: ";host=web1 3 1700000000", wantErr: true},
+		{line: `orders{__tenant__="payments"} 3 1700000000`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			m, err := ParseLine(test.line)
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, m)
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	s := storage.NewMemStorage()
+	l, err := Listen("127.0.0.1:0", s)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Serve(ctx)
+		close(done)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("web.cpu 1 1700000000\nbroken line\nweb.mem;host=a 2 1700000000\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		metrics, err := s.GetMetrics(context.Background())
+		return err == nil && len(metrics) == 2
+	}, time.Second, 10*time.Millisecond)
+	metrics, err := s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *metrics[model.MetricKey("gauge", "web.mem", model.Labels{"host": "a"})].Value)
+
+	// Остановка закрывает и порт, и открытые соединения.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Serve не завершился после отмены контекста")
+	}
+	conn.Close()
+}
+
+func TestListenerLineLimit(t *testing.T) {
+	s := storage.NewMemStorage()
+	l, err := Listen("127.0.0.1:0", s)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Serve(ctx)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("web.cpu 1 1700000000\n"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("web." + strings.Repeat("x", maxLineLength)))
+	require.NoError(t, err)
+
+	// Сервер закрывает соединение со слишком длинной строкой, сохранив прочитанное до неё.
+	// Непрочитанный остаток строки может превратить закрытие в сброс соединения.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "соединение должно быть закрыто сервером")
+	metrics, err := s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+}
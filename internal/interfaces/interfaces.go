@@ -1,21 +1,62 @@
 package interfaces
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/lenarlenar/go-my-metrics-service/internal/model"
 )
 
+// Collector - источник метрик агента. Агент опрашивает каждый источник со своим интервалом
+// и сохраняет собранные метрики в хранилище одной пачкой.
 type Collector interface {
-	StartCollectAndUpdate(pollInterval int) *time.Ticker
+	// Name возвращает имя источника, под которым он настраивается в конфиге агента.
+	Name() string
+	// Collect возвращает текущие значения метрик источника. Значение counter - приращение
+	// с прошлого вызова.
+	Collect(ctx context.Context) ([]model.Metrics, error)
 }
 
+// ExpiringCollector - источник метрик, ряды которого могут исчезать, например, метрики
+// завершившихся процессов. После каждого опроса агент удаляет исчезнувшие ряды из своего
+// хранилища, чтобы не отправлять их последние значения бесконечно.
+type ExpiringCollector interface {
+	Collector
+	// Expired возвращает ряды, которые были в прошлом результате Collect, но пропали
+	// из последнего. Значения метрик не заполнены.
+	Expired() []model.Metrics
+}
+
+// ErrStorageUnavailable оборачивает ошибки хранилища, вызванные недоступностью бэкенда
+// (например, потерей соединения с базой данных). Такие ошибки временные: запрос можно повторить.
+var ErrStorageUnavailable = errors.New("storage unavailable")
+
+// Storage - хранилище метрик. Все методы учитывают отмену контекста и возвращают ошибки
+// вместо паники; при недоступности бэкенда ошибка оборачивает ErrStorageUnavailable.
 type Storage interface {
-	SetGauge(n string, v float64)
-	AddCounter(n string, v int64)
-	GetMetrics() map[string]model.Metrics
-	Ping() error
+	SetGauge(ctx context.Context, n string, v float64, labels model.Labels) error
+	AddCounter(ctx context.Context, n string, v int64, labels model.Labels) error
+	// UpdateBatch атомарно применяет пачку метрик: либо все, либо ни одной.
+	UpdateBatch(ctx context.Context, metrics []model.Metrics) error
+	GetMetrics(ctx context.Context) (map[string]model.Metrics, error)
+	GetHistory(ctx context.Context, mType, n string, labels model.Labels, from, to time.Time) ([]model.Sample, error)
+	// Delete удаляет метрику вместе с историей. Возвращает false, если метрики не было.
+	Delete(ctx context.Context, mType, n string, labels model.Labels) (bool, error)
+	// DeleteByPrefix удаляет все метрики, имя которых начинается с prefix, с любыми метками,
+	// и возвращает число удалённых метрик.
+	DeleteByPrefix(ctx context.Context, prefix string) (int, error)
+	// ResetCounter обнуляет counter, сохраняя его историю. Возвращает false, если counter не было.
+	ResetCounter(ctx context.Context, n string, labels model.Labels) (bool, error)
+	Ping(ctx context.Context) error
+}
+
+// NotificationStore хранит состояние отправленных уведомлений,
+// чтобы не дублировать их после перезапуска сервера.
+type NotificationStore interface {
+	GetNotificationState(ctx context.Context, key string) (model.NotificationState, bool, error)
+	SetNotificationState(ctx context.Context, state model.NotificationState) error
 }
 
 type Service interface {
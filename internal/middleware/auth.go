@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/signature"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+)
+
+// AuthPolicy - правила аутентификации изменяющих запросов.
+type AuthPolicy struct {
+	// Key - общий ключ HMAC для запросов без арендатора.
+	Key string
+	// Replay - защита от повторных подписанных запросов, nil - метка времени проверяется только подписью.
+	Replay *signature.ReplayGuard
+	// Strict требует аутентификации каждого запроса, даже если ключ не задан,
+	// и не принимает подпись без метки времени и nonce.
+	Strict bool
+}
+
+// Authenticate - middleware аутентификации изменяющих запросов. Запрос подтверждается
+// одним из способов:
+//   - подписью HMAC SHA256 в заголовке HashSHA256 ключом арендатора или общим ключом;
+//   - токеном арендатора или токеном роли writer в заголовке Authorization: Bearer
+//     (см. Tenants и Roles);
+//   - сертификатом клиента, проверенным при установке TLS-соединения (mTLS).
+//
+// Если ключ не задан, а режим Strict выключен, запросы без подтверждения пропускаются,
+// как и раньше. Неверная подпись всегда отклоняется.
+//
+// Подпись с заголовками signature.TimestampHeader и signature.NonceHeader проверяется
+// вместе с ними, методом и путём запроса, а Replay отклоняет устаревшие и повторные
+// запросы. Nonce закрепляется, только если запрос обработан успешно; nonce запроса,
+// завершившегося любой ошибкой, освобождается, чтобы агент мог его повторить. Повтор запроса,
+// который ещё обрабатывается, получает 409. Подпись одного тела от старых агентов принимается вне режима Strict.
+func Authenticate(policy AuthPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		key := policy.Key
+		scope := ""
+		t, hasTenant := tenant.FromContext(ctx)
+		if hasTenant {
+			key = t.Key
+			scope = t.ID
+		}
+
+		hash := c.GetHeader("HashSHA256")
+		if hash == "" {
+			switch {
+			case hasTenant && tenantVerified(c):
+			case requestRole(c) >= RoleWriter:
+			case clientCertificateVerified(c):
+				grantRole(c, RoleWriter)
+			case key == "" && !policy.Strict:
+				log.I().Warn("secretKey не задан")
+			default:
+				log.I().Warnf("запрос %s без подписи, токена и сертификата клиента", c.Request.URL.Path)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+				return
+			}
+			c.Next()
+			return
+		}
+		if key == "" {
+			if policy.Strict {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "signing key is not configured"})
+				return
+			}
+			log.I().Warn("secretKey не задан, подпись запроса не проверяется")
+			c.Next()
+			return
+		}
+
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			log.I().Warnf("не удалось прочитать Body: %v/n", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		c.Request.Body = io.NopCloser(strings.NewReader(string(data)))
+
+		timestamp := c.GetHeader(signature.TimestampHeader)
+		nonce := c.GetHeader(signature.NonceHeader)
+		signed := timestamp != "" || nonce != ""
+		if !signed && policy.Strict {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "request timestamp and nonce are required"})
+			return
+		}
+
+		expectedHash := calculateHash(data, []byte(key))
+		if signed {
+			target := signature.Target(c.Request.Method, c.Request.URL.Path)
+			expectedHash = signature.Sign([]byte(key), timestamp, nonce, target, data)
+		}
+		if !hmac.Equal([]byte(hash), []byte(expectedHash)) {
+			log.I().Warn("HashSHA256: хеши не совпали")
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if signed && policy.Replay != nil {
+			nonceKey := scope + "/" + nonce
+			if err := reserveNonce(policy.Replay, nonceKey, timestamp, nonce); err != nil {
+				log.I().Warnf("отклонён повторный или устаревший запрос %s: %v", c.Request.URL.Path, err)
+				code := http.StatusUnauthorized
+				if errors.Is(err, signature.ErrInProgress) {
+					code = http.StatusConflict
+				}
+				c.AbortWithStatusJSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			defer func() {
+				if status := c.Writer.Status(); status >= 200 && status < 300 {
+					policy.Replay.Commit(nonceKey)
+				} else {
+					policy.Replay.Release(nonceKey)
+				}
+			}()
+		}
+		tenant.Verify(ctx)
+		grantRole(c, RoleWriter)
+
+		c.Next()
+
+		responseData := []byte(c.Writer.Header().Get("Content-Type") + c.Request.URL.Path + c.Request.URL.RawQuery)
+		responseHash := calculateHash(responseData, []byte(key))
+		c.Writer.Header().Set("HashSHA256", responseHash)
+	}
+}
+
+// reserveNonce проверяет метку времени и nonce подписанного запроса.
+func reserveNonce(guard *signature.ReplayGuard, key, timestamp, nonce string) error {
+	if nonce == "" {
+		return signature.ErrReplay
+	}
+	ts, err := signature.ParseTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
+	return guard.Reserve(key, ts, time.Now())
+}
+
+// tenantVerified сообщает, что арендатор запроса уже подтверждён токеном или сертификатом.
+func tenantVerified(c *gin.Context) bool {
+	_, err := tenant.Scope(c.Request.Context())
+	return err == nil
+}
+
+// clientCertificateVerified сообщает, что клиент предъявил сертификат, проверенный при установке TLS.
+func clientCertificateVerified(c *gin.Context) bool {
+	return c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0
+}
+
+// clientCommonName возвращает CN проверенного сертификата клиента или пустую строку.
+func clientCommonName(c *gin.Context) string {
+	if !clientCertificateVerified(c) {
+		return ""
+	}
+	return c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,351 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/signature"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// GRPCAuth проверяет вызовы gRPC по тем же правилам, что Roles, Tenants и Authenticate
+// проверяют запросы HTTP. Токен, арендатор и подпись передаются в метаданных под именами
+// заголовков HTTP: authorization, x-tenant-id, hashsha256, x-timestamp и x-nonce.
+//
+// Подпись вызова всегда включает метку времени и nonce и считается по сообщениям запроса
+// в детерминированной сериализации protobuf (см. signature.GRPCMethod). Подпись потока
+// проверяется, когда клиент закрыл поток, - до того как сервис применит метрики.
+// Повтор принятого вызова получает codes.AlreadyExists, повтор вызова, который ещё
+// обрабатывается, - codes.Aborted.
+//
+// Если в конфиге есть токены ролей, вызов пропускается, только когда роль клиента не ниже
+// роли метода, как в RequireRole: вызов без роли получает codes.Unauthenticated,
+// с недостаточной ролью - codes.PermissionDenied.
+type GRPCAuth struct {
+	policy  AuthPolicy
+	tokens  *RoleTokens
+	tenants *tenant.Registry
+	methods map[string]Role
+}
+
+// NewGRPCAuth создает проверку вызовов gRPC. methods - роль, нужная для вызова каждого
+// метода по полному имени; методы с ролью writer и выше аутентифицируются как изменяющие
+// запросы HTTP. Вызовы методов, которых нет в methods, отклоняются.
+func NewGRPCAuth(policy AuthPolicy, tokens *RoleTokens, tenants *tenant.Registry, methods map[string]Role) *GRPCAuth {
+	return &GRPCAuth{policy: policy, tokens: tokens, tenants: tenants, methods: methods}
+}
+
+// UnaryInterceptor возвращает перехватчик одиночных вызовов.
+func (a *GRPCAuth) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		call, err := a.start(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		if err := call.add(req); err != nil {
+			return nil, err
+		}
+		if err := call.verify(); err != nil {
+			return nil, err
+		}
+
+		resp, err := handler(call.ctx, req)
+		call.finish(err)
+		return resp, err
+	}
+}
+
+// StreamInterceptor возвращает перехватчик потоковых вызовов.
+func (a *GRPCAuth) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		call, err := a.start(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		err = handler(srv, &authStream{ServerStream: ss, call: call})
+		call.finish(err)
+		return err
+	}
+}
+
+// authStream передаёт сообщения потока в подпись и проверяет её в конце потока.
+type authStream struct {
+	grpc.ServerStream
+	call *grpcCall
+}
+
+// Context возвращает контекст с арендатором вызова.
+func (s *authStream) Context() context.Context {
+	return s.call.ctx
+}
+
+// RecvMsg читает сообщение потока. Вместо io.EOF возвращает ошибку, если подпись неверна.
+func (s *authStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if errors.Is(err, io.EOF) {
+		if verr := s.call.verify(); verr != nil {
+			return verr
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return s.call.add(m)
+}
+
+// grpcCall - аутентификация одного вызова gRPC.
+type grpcCall struct {
+	policy AuthPolicy
+	tokens *RoleTokens
+	method string
+	need   Role
+	ctx    context.Context
+	role   Role
+	// mac - HMAC сообщений вызова, nil - подпись не проверяется.
+	mac       hash.Hash
+	hash      string
+	timestamp string
+	nonce     string
+	nonceKey  string
+	verified  bool
+	reserved  bool
+}
+
+// start определяет роль и арендатора вызова, проверяет, чем подтверждён вызов
+// изменяющего метода, и хватает ли роли. Подпись и роль подписанного вызова
+// проверяет verify, когда получены все сообщения.
+func (a *GRPCAuth) start(ctx context.Context, method string) (*grpcCall, error) {
+	need, ok := a.methods[method]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "method %s is not allowed", method)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx, role, err := a.identify(ctx, md)
+	if err != nil {
+		return nil, err
+	}
+	call := &grpcCall{policy: a.policy, tokens: a.tokens, method: method, need: need, ctx: ctx, role: role}
+	if need < RoleWriter {
+		return call, call.authorize()
+	}
+
+	key := a.policy.Key
+	scope := ""
+	t, hasTenant := tenant.FromContext(ctx)
+	if hasTenant {
+		key = t.Key
+		scope = t.ID
+	}
+
+	call.hash = metadataValue(md, "HashSHA256")
+	if call.hash == "" {
+		switch {
+		case hasTenant && tenantScoped(ctx):
+		case call.role >= RoleWriter:
+		case peerCertificate(ctx) != nil:
+			call.role = RoleWriter
+		case key == "" && !a.policy.Strict:
+			log.I().Warn("secretKey не задан")
+		default:
+			log.I().Warnf("вызов %s без подписи, токена и сертификата клиента", method)
+			return nil, status.Error(codes.Unauthenticated, "authentication required")
+		}
+		return call, call.authorize()
+	}
+	if key == "" {
+		if a.policy.Strict {
+			return nil, status.Error(codes.Unauthenticated, "signing key is not configured")
+		}
+		log.I().Warn("secretKey не задан, подпись вызова не проверяется")
+		return call, call.authorize()
+	}
+
+	call.timestamp = metadataValue(md, signature.TimestampHeader)
+	call.nonce = metadataValue(md, signature.NonceHeader)
+	if call.timestamp == "" || call.nonce == "" {
+		return nil, status.Error(codes.Unauthenticated, "request timestamp and nonce are required")
+	}
+	call.nonceKey = scope + "/" + call.nonce
+	target := signature.Target(signature.GRPCMethod, method)
+	call.mac = signature.New([]byte(key), call.timestamp, call.nonce, target)
+	return call, nil
+}
+
+// identify определяет роль и арендатора вызова по токену, арендатору из метаданных
+// и сертификату клиента так же, как Roles и Tenants.
+func (a *GRPCAuth) identify(ctx context.Context, md metadata.MD) (context.Context, Role, error) {
+	token, hasToken := strings.CutPrefix(metadataValue(md, "Authorization"), "Bearer ")
+	id := metadataValue(md, tenant.Header)
+
+	if rt, ok := a.tokens.lookup(token); hasToken && ok {
+		scoped, ok := rt.scope(id)
+		if !ok {
+			log.I().Warnf("токен роли %s не даёт доступа к арендатору %q", rt.role, id)
+			return nil, RoleNone, status.Error(codes.PermissionDenied, "token is not allowed to access this tenant")
+		}
+		if scoped == "" {
+			return ctx, rt.role, nil
+		}
+		var t tenant.Tenant
+		ok = false
+		if a.tenants != nil {
+			t, ok = a.tenants.ByID(scoped)
+		}
+		if !ok {
+			return nil, RoleNone, status.Error(codes.Unauthenticated, tenant.ErrUnauthorized.Error())
+		}
+		return tenant.WithTenant(ctx, t, true), rt.role, nil
+	}
+
+	if a.tenants == nil || a.tenants.Len() == 0 {
+		return ctx, RoleNone, nil
+	}
+	var t tenant.Tenant
+	var ok, verified bool
+	switch {
+	case hasToken:
+		t, ok = a.tenants.ByToken(token)
+		ok = ok && (id == "" || id == t.ID)
+		verified = true
+	case id != "":
+		t, ok = a.tenants.ByID(id)
+		cert := peerCertificate(ctx)
+		verified = cert != nil && cert.Subject.CommonName == id
+		// Без ключа подписи арендатор подтверждается только токеном или сертификатом.
+		ok = ok && (t.Key != "" || verified)
+	default:
+		return ctx, RoleNone, nil
+	}
+	if !ok {
+		log.I().Warn("вызов gRPC с неизвестным арендатором или токеном")
+		return nil, RoleNone, status.Error(codes.Unauthenticated, tenant.ErrUnauthorized.Error())
+	}
+
+	role := RoleNone
+	if verified {
+		role = RoleWriter
+	}
+	return tenant.WithTenant(ctx, t, verified), role, nil
+}
+
+// add добавляет сообщение вызова в подпись.
+func (c *grpcCall) add(msg any) error {
+	if c.mac == nil {
+		return nil
+	}
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return status.Error(codes.Internal, "message is not a protobuf message")
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	c.mac.Write(data)
+	return nil
+}
+
+// verify сверяет подпись с полученными сообщениями и резервирует nonce вызова.
+func (c *grpcCall) verify() error {
+	if c.mac == nil || c.verified {
+		return nil
+	}
+	c.verified = true
+
+	expectedHash := hex.EncodeToString(c.mac.Sum(nil))
+	if !hmac.Equal([]byte(c.hash), []byte(expectedHash)) {
+		log.I().Warn("HashSHA256: хеши не совпали")
+		return status.Error(codes.Unauthenticated, "signature mismatch")
+	}
+	c.role = max(c.role, RoleWriter)
+	if err := c.authorize(); err != nil {
+		return err
+	}
+	if c.policy.Replay != nil {
+		if err := reserveNonce(c.policy.Replay, c.nonceKey, c.timestamp, c.nonce); err != nil {
+			log.I().Warnf("отклонён повторный или устаревший вызов gRPC: %v", err)
+			code := codes.Unauthenticated
+			switch {
+			case errors.Is(err, signature.ErrReplay):
+				code = codes.AlreadyExists
+			case errors.Is(err, signature.ErrInProgress):
+				code = codes.Aborted
+			}
+			return status.Error(code, err.Error())
+		}
+		c.reserved = true
+	}
+	tenant.Verify(c.ctx)
+	return nil
+}
+
+// authorize пропускает вызов с ролью не ниже роли метода. Без токенов ролей в конфиге
+// доступ не ограничивается.
+func (c *grpcCall) authorize() error {
+	if !c.tokens.Enabled() {
+		return nil
+	}
+	switch {
+	case c.role == RoleNone:
+		return status.Error(codes.Unauthenticated, "authentication required")
+	case c.role < c.need:
+		log.I().Warnf("роли %s недостаточно для %s", c.role, c.method)
+		return status.Error(codes.PermissionDenied, "insufficient role")
+	}
+	return nil
+}
+
+// finish закрепляет nonce успешного вызова и освобождает nonce вызова с ошибкой.
+func (c *grpcCall) finish(err error) {
+	if !c.reserved {
+		return
+	}
+	if err == nil {
+		c.policy.Replay.Commit(c.nonceKey)
+	} else {
+		c.policy.Replay.Release(c.nonceKey)
+	}
+}
+
+// metadataValue возвращает первое значение метаданных key, имя не зависит от регистра.
+func metadataValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// tenantScoped сообщает, что арендатор вызова уже подтверждён токеном или сертификатом.
+func tenantScoped(ctx context.Context) bool {
+	_, err := tenant.Scope(ctx)
+	return err == nil
+}
+
+// peerCertificate возвращает сертификат клиента, проверенный при установке TLS, или nil.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
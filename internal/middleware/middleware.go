@@ -13,6 +13,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
 )
 
 // Logger - логирует информацию о каждом запросе, включая URI, метод, статус, продолжительность и размер ответа.
@@ -78,9 +79,14 @@ func (g *GzipReader) Read(p []byte) (int, error) {
 }
 
 // GzipUnpack - middleware для распаковки gzip-сжатых данных в теле запроса.
+// Зашифрованное тело (application/octet-stream) сжимается до шифрования, поэтому
+// его распаковка откладывается до middleware, стоящего после RSADecrypt.
+// После распаковки заголовок Content-Encoding удаляется, так что повторный
+// GzipUnpack в цепочке ничего не делает.
 func GzipUnpack() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if strings.Contains(c.GetHeader("Content-Encoding"), "gzip") {
+		if strings.Contains(c.GetHeader("Content-Encoding"), "gzip") &&
+			c.GetHeader("Content-Type") != "application/octet-stream" {
 			gz, err := gzip.NewReader(c.Request.Body)
 			if err != nil {
 				c.AbortWithStatus(http.StatusBadRequest)
@@ -89,6 +95,7 @@ func GzipUnpack() gin.HandlerFunc {
 			defer gz.Close()
 
 			c.Request.Body = &GzipReader{c.Request.Body, gz}
+			c.Request.Header.Del("Content-Encoding")
 		}
 		c.Next()
 	}
@@ -101,43 +108,48 @@ func calculateHash(data, key []byte) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// CheckHash - middleware для проверки HMAC SHA256 хеша данных в теле запроса и ответа.
-func CheckHash(secretKey string) gin.HandlerFunc {
+// Tenants - middleware, определяющее арендатора запроса. Токен из заголовка
+// Authorization: Bearer сразу подтверждает арендатора. Арендатор из заголовка
+// tenant.Header подтверждается сертификатом клиента с таким же CN или подписью
+// запроса своим ключом (см. Authenticate), иначе хранилище отклонит запрос.
+// Запрос без токена и заголовка работает с метриками по умолчанию.
+// Подтверждённый арендатор получает роль writer. Арендатора, уже определённого
+// токеном роли (см. Roles), middleware не меняет.
+func Tenants(registry *tenant.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
-
-		if secretKey == "" {
-			log.I().Warn("secretKey не задан")
+		if registry == nil || registry.Len() == 0 || c.GetBool(roleTokenKey) {
 			c.Next()
 			return
 		}
 
-		hash := c.GetHeader("HashSHA256")
-		if hash == "" {
-			log.I().Warn("HashSHA256 не задан в headers")
-			c.AbortWithStatus(http.StatusBadRequest)
+		id := c.GetHeader(tenant.Header)
+		token, hasToken := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		var t tenant.Tenant
+		var ok, verified bool
+		switch {
+		case hasToken:
+			t, ok = registry.ByToken(token)
+			ok = ok && (id == "" || id == t.ID)
+			verified = true
+		case id != "":
+			t, ok = registry.ByID(id)
+			verified = clientCommonName(c) == id
+			// Без ключа подписи арендатор подтверждается только токеном или сертификатом.
+			ok = ok && (t.Key != "" || verified)
+		default:
+			c.Next()
 			return
 		}
-
-		data, err := io.ReadAll(c.Request.Body)
-		if err != nil {
-			log.I().Warnf("не удалось прочитать Body: %v/n", err)
-			c.AbortWithStatus(http.StatusBadRequest)
+		if !ok {
+			log.I().Warnf("запрос с неизвестным арендатором или токеном: %s", c.Request.URL.Path)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": tenant.ErrUnauthorized.Error()})
 			return
 		}
 
-		c.Request.Body = io.NopCloser(strings.NewReader(string(data)))
-
-		expectedHash := calculateHash(data, []byte(secretKey))
-		if hash != expectedHash {
-			log.I().Warn("HashSHA256: хеши не совпали")
-			c.AbortWithStatus(http.StatusBadRequest)
-			return
+		if verified {
+			grantRole(c, RoleWriter)
 		}
-
+		c.Request = c.Request.WithContext(tenant.WithTenant(c.Request.Context(), t, verified))
 		c.Next()
-
-		responseData := []byte(c.Writer.Header().Get("Content-Type") + c.Request.URL.Path + c.Request.URL.RawQuery)
-		responseHash := calculateHash(responseData, []byte(secretKey))
-		c.Writer.Header().Set("HashSHA256", responseHash)
 	}
 }
@@ -0,0 +1,244 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+)
+
+// Role - роль клиента API. Каждая следующая роль включает права предыдущих.
+type Role int
+
+const (
+	// RoleNone - клиент не предъявил ни токена, ни подписи, ни сертификата.
+	RoleNone Role = iota
+	// RoleReader - чтение метрик: дашборды и Prometheus.
+	RoleReader
+	// RoleWriter - запись метрик: агенты.
+	RoleWriter
+	// RoleAdmin - удаление и сброс метрик, доступ к метрикам любого арендатора.
+	RoleAdmin
+)
+
+var roleNames = map[string]Role{"reader": RoleReader, "writer": RoleWriter, "admin": RoleAdmin}
+
+// ParseRole разбирает имя роли из конфига.
+func ParseRole(name string) (Role, error) {
+	role, ok := roleNames[name]
+	if !ok {
+		return RoleNone, fmt.Errorf("неизвестная роль %q, ожидается reader, writer или admin", name)
+	}
+	return role, nil
+}
+
+// String возвращает имя роли.
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+const (
+	// roleKey - ключ роли запроса в контексте gin.
+	roleKey = "role"
+	// roleTokenKey - признак того, что Authorization содержит токен роли, а не токен арендатора.
+	roleTokenKey = "role_token"
+)
+
+type roleToken struct {
+	role   Role
+	tenant string
+}
+
+// TokenConfig - токен API с ролью reader, writer или admin в JSON-конфиге сервера.
+// Клиент передаёт его в заголовке Authorization: Bearer. Токен с tenant работает только
+// с метриками этого арендатора. Если токены заданы, чтение метрик требует роли reader, запись - writer, удаление - admin.
+//
+// Пример:
+//
+//	{"tokens": [{"token": "dashboard-token", "role": "reader"}, {"token": "ops-token", "role": "admin"}]}
+type TokenConfig struct {
+	Token  string `json:"token"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant"`
+}
+
+// RoleTokens - токены API с ролями из конфига сервера.
+type RoleTokens struct {
+	byToken map[[sha256.Size]byte]roleToken
+}
+
+// NewRoleTokens проверяет токены: они уникальны, роли известны, а арендаторы, к которым
+// привязаны токены, есть в tenants.
+func NewRoleTokens(configs []TokenConfig, tenants *tenant.Registry) (*RoleTokens, error) {
+	r := &RoleTokens{byToken: make(map[[sha256.Size]byte]roleToken, len(configs))}
+	for i, cfg := range configs {
+		if cfg.Token == "" {
+			return nil, fmt.Errorf("у токена %d не задано значение", i)
+		}
+		role, err := ParseRole(cfg.Role)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Tenant != "" {
+			if tenants == nil {
+				return nil, errors.New("токен привязан к арендатору, но арендаторы не заданы")
+			}
+			if _, ok := tenants.ByID(cfg.Tenant); !ok {
+				return nil, fmt.Errorf("токен привязан к неизвестному арендатору %q", cfg.Tenant)
+			}
+		}
+		hash := sha256.Sum256([]byte(cfg.Token))
+		if _, ok := r.byToken[hash]; ok {
+			return nil, fmt.Errorf("токен %d задан дважды", i)
+		}
+		if tenants != nil {
+			if _, ok := tenants.ByToken(cfg.Token); ok {
+				return nil, fmt.Errorf("токен %d совпадает с токеном арендатора", i)
+			}
+		}
+		r.byToken[hash] = roleToken{role: role, tenant: cfg.Tenant}
+	}
+	return r, nil
+}
+
+// Enabled сообщает, что токены заданы и доступ к API ограничивается ролями.
+func (r *RoleTokens) Enabled() bool {
+	return r != nil && len(r.byToken) > 0
+}
+
+// Has сообщает, что среди токенов есть токен с ролью не ниже role.
+func (r *RoleTokens) Has(role Role) bool {
+	if r == nil {
+		return false
+	}
+	for _, rt := range r.byToken {
+		if rt.role >= role {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup возвращает токен роли по значению из заголовка Authorization.
+func (r *RoleTokens) lookup(token string) (roleToken, bool) {
+	if !r.Enabled() {
+		return roleToken{}, false
+	}
+	rt, ok := r.byToken[sha256.Sum256([]byte(token))]
+	return rt, ok
+}
+
+// scope возвращает арендатора, с метриками которого работает запрос с токеном rt,
+// если клиент выбрал арендатора id. false - токен не даёт доступа к арендатору id.
+func (rt roleToken) scope(id string) (string, bool) {
+	switch {
+	case rt.tenant != "" && id != "" && id != rt.tenant,
+		rt.tenant == "" && id != "" && rt.role < RoleAdmin:
+		return "", false
+	case rt.tenant != "":
+		return rt.tenant, true
+	}
+	return id, true
+}
+
+// grantRole повышает роль запроса до role.
+func grantRole(c *gin.Context, role Role) {
+	if current, _ := c.Get(roleKey); current == nil || current.(Role) < role {
+		c.Set(roleKey, role)
+	}
+}
+
+// requestRole возвращает роль запроса.
+func requestRole(c *gin.Context) Role {
+	if role, ok := c.Get(roleKey); ok {
+		return role.(Role)
+	}
+	return RoleNone
+}
+
+// Roles - middleware, определяющее роль запроса по токену из заголовка Authorization: Bearer.
+// Токен, привязанный к арендатору, работает только с его метриками. Токен администратора
+// без арендатора может выбрать арендатора заголовком tenant.Header; остальные токены
+// без арендатора работают с метриками по умолчанию. Токены, которых нет среди токенов
+// ролей, проверяет Tenants. Агенты, подтверждённые подписью, токеном арендатора
+// или сертификатом клиента, получают роль writer (см. Authenticate и Tenants).
+func Roles(tokens *RoleTokens, tenants *tenant.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !tokens.Enabled() || !ok {
+			c.Next()
+			return
+		}
+		rt, ok := tokens.lookup(token)
+		if !ok {
+			c.Next()
+			return
+		}
+		c.Set(roleTokenKey, true)
+		grantRole(c, rt.role)
+
+		id, ok := rt.scope(c.GetHeader(tenant.Header))
+		if !ok {
+			log.I().Warnf("токен роли %s не даёт доступа к арендатору %q", rt.role, c.GetHeader(tenant.Header))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token is not allowed to access this tenant"})
+			return
+		}
+		if id != "" {
+			var t tenant.Tenant
+			ok := false
+			if tenants != nil {
+				t, ok = tenants.ByID(id)
+			}
+			if !ok {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": tenant.ErrUnauthorized.Error()})
+				return
+			}
+			c.Request = c.Request.WithContext(tenant.WithTenant(c.Request.Context(), t, true))
+		}
+		c.Next()
+	}
+}
+
+// RequireRole - middleware, пропускающее запросы с ролью не ниже role. Без токенов
+// ролей в конфиге доступ не ограничивается. Запрос без роли получает 401,
+// с недостаточной ролью - 403.
+func RequireRole(tokens *RoleTokens, role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tokens.Enabled() {
+			c.Next()
+			return
+		}
+		current := requestRole(c)
+		switch {
+		case current == RoleNone:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+		case current < role:
+			log.I().Warnf("роли %s недостаточно для %s %s", current, c.Request.Method, c.Request.URL.Path)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient role"})
+		default:
+			c.Next()
+		}
+	}
+}
+
+// RequireConfiguredRole - middleware для опасных маршрутов, которые, в отличие от RequireRole,
+// не открываются без токенов ролей: пока в конфиге нет токена с ролью не ниже role,
+// все запросы получают 403.
+func RequireConfiguredRole(tokens *RoleTokens, role Role) gin.HandlerFunc {
+	if tokens.Has(role) {
+		return RequireRole(tokens, role)
+	}
+	return func(c *gin.Context) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "no " + role.String() + " token is configured"})
+	}
+}
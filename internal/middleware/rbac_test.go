@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRoleTokens(t *testing.T) {
+	tenants, err := tenant.NewRegistry([]tenant.Config{{ID: "payments", Token: "tenant-token"}})
+	require.NoError(t, err)
+
+	tokens, err := NewRoleTokens([]TokenConfig{
+		{Token: "r", Role: "reader"},
+		{Token: "w", Role: "writer", Tenant: "payments"},
+	}, tenants)
+	require.NoError(t, err)
+	assert.True(t, tokens.Enabled())
+	assert.True(t, tokens.Has(RoleWriter))
+	assert.False(t, tokens.Has(RoleAdmin))
+
+	empty, err := NewRoleTokens(nil, tenants)
+	require.NoError(t, err)
+	assert.False(t, empty.Enabled())
+
+	for _, configs := range [][]TokenConfig{
+		{{Token: "", Role: "reader"}},
+		{{Token: "x", Role: "root"}},
+		{{Token: "x", Role: "reader", Tenant: "search"}},
+		{{Token: "x", Role: "reader"}, {Token: "x", Role: "admin"}},
+		{{Token: "tenant-token", Role: "reader"}},
+	} {
+		_, err := NewRoleTokens(configs, tenants)
+		assert.Error(t, err, "%+v", configs)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens, err := NewRoleTokens([]TokenConfig{
+		{Token: "reader-token", Role: "reader"},
+		{Token: "writer-token", Role: "writer"},
+		{Token: "admin-token", Role: "admin"},
+	}, nil)
+	require.NoError(t, err)
+
+	r := gin.New()
+	r.Use(Roles(tokens, nil))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/read", RequireRole(tokens, RoleReader), ok)
+	r.POST("/write", RequireRole(tokens, RoleWriter), ok)
+	r.DELETE("/admin", RequireRole(tokens, RoleAdmin), ok)
+
+	tests := []struct {
+		token  string
+		method string
+		path   string
+		code   int
+	}{
+		{"", http.MethodGet, "/read", http.StatusUnauthorized},
+		{"unknown", http.MethodGet, "/read", http.StatusUnauthorized},
+		{"reader-token", http.MethodGet, "/read", http.StatusOK},
+		{"reader-token", http.MethodPost, "/write", http.StatusForbidden},
+		{"writer-token", http.MethodGet, "/read", http.StatusOK},
+		{"writer-token", http.MethodPost, "/write", http.StatusOK},
+		{"writer-token", http.MethodDelete, "/admin", http.StatusForbidden},
+		{"admin-token", http.MethodDelete, "/admin", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, test.code, w.Code, "%s %s %s", test.token, test.method, test.path)
+	}
+
+	// Без токенов в конфиге доступ не ограничивается.
+	open := gin.New()
+	open.GET("/read", RequireRole(nil, RoleAdmin), ok)
+	w := httptest.NewRecorder()
+	open.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/read", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -2,34 +2,48 @@ package middleware
 
 import (
 	"bytes"
-	"crypto/rand"
 	"crypto/rsa"
 	"io"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/envelope"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
 )
 
+// RSADecrypt - middleware для расшифровки тела запроса закрытым ключом сервера.
+// Схема шифрования берётся из заголовка envelope.Header; без заголовка тело считается
+// зашифрованным по исходной схеме RSA PKCS#1 v1.5. В ответе сервер сообщает
+// поддерживаемые версии в заголовке envelope.SupportedHeader, по которому агент
+// отличает новый сервер от старого.
 func RSADecrypt(privKey *rsa.PrivateKey) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if privKey == nil {
 			c.Next()
 			return
 		}
+		c.Header(envelope.SupportedHeader, envelope.Supported)
 
 		if c.Request.Header.Get("Content-Type") != "application/octet-stream" {
 			c.Next()
 			return
 		}
 
+		version, err := envelope.ParseVersion(c.GetHeader(envelope.Header))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported encryption version"})
+			return
+		}
+
 		encryptedData, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read body"})
 			return
 		}
 
-		decrypted, err := rsa.DecryptPKCS1v15(rand.Reader, privKey, encryptedData)
+		decrypted, err := envelope.Decrypt(privKey, version, encryptedData)
 		if err != nil {
+			log.I().Warnf("ошибка расшифровки тела запроса (версия %d): %v", version, err)
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "RSA decryption failed"})
 			return
 		}
@@ -38,6 +52,7 @@ func RSADecrypt(privKey *rsa.PrivateKey) gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(bytes.NewReader(decrypted))
 		c.Request.ContentLength = int64(len(decrypted))
 		c.Request.Header.Set("Content-Type", "application/json")
+		c.Request.Header.Del(envelope.Header)
 
 		c.Next()
 	}
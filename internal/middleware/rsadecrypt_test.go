@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRSADecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	payload := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/updates/", RSADecrypt(key), func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		assert.Equal(t, "application/json", c.GetHeader("Content-Type"))
+		c.Data(http.StatusOK, "application/json", body)
+	})
+
+	tests := []struct {
+		name    string
+		version string
+		body    func() []byte
+		code    int
+	}{
+		{name: "без заголовка - PKCS#1 v1.5", body: func() []byte {
+			b, err := envelope.Encrypt(&key.PublicKey, envelope.VersionPKCS1, payload)
+			require.NoError(t, err)
+			return b
+		}, code: http.StatusOK},
+		{name: "гибридная схема", version: "2", body: func() []byte {
+			b, err := envelope.Encrypt(&key.PublicKey, envelope.VersionHybrid, payload)
+			require.NoError(t, err)
+			return b
+		}, code: http.StatusOK},
+		{name: "гибридное тело без заголовка", body: func() []byte {
+			b, err := envelope.Encrypt(&key.PublicKey, envelope.VersionHybrid, payload)
+			require.NoError(t, err)
+			return b
+		}, code: http.StatusBadRequest},
+		{name: "неизвестная версия", version: "9", body: func() []byte { return payload }, code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(test.body()))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			if test.version != "" {
+				req.Header.Set(envelope.Header, test.version)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, test.code, w.Code)
+			assert.Equal(t, envelope.Supported, w.Header().Get(envelope.SupportedHeader))
+			if test.code == http.StatusOK {
+				assert.Equal(t, payload, w.Body.Bytes())
+			}
+		})
+	}
+}
@@ -1,8 +1,125 @@
 package model
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type Metrics struct {
-	ID    string   `json:"id"`              // Название метрики
-	MType string   `json:"type"`            // Тип метрики: "gauge" или "counter"
-	Delta *int64   `json:"delta,omitempty"` // Значение для counter (может быть nil)
-	Value *float64 `json:"value,omitempty"` // Значение для gauge (может быть nil)
+	ID     string   `json:"id"`               // Название метрики
+	MType  string   `json:"type"`             // Тип метрики: "gauge" или "counter"
+	Delta  *int64   `json:"delta,omitempty"`  // Значение для counter (может быть nil)
+	Value  *float64 `json:"value,omitempty"`  // Значение для gauge (может быть nil)
+	Labels Labels   `json:"labels,omitempty"` // Метки метрики, например host или cpu (может быть nil)
+}
+
+// Key возвращает ключ метрики в хранилище с учётом типа и меток.
+func (m Metrics) Key() string {
+	return MetricKey(m.MType, m.ID, m.Labels)
+}
+
+// Labels - набор меток метрики. Метрики с одинаковым именем, но разными метками
+// считаются разными временными рядами.
+type Labels map[string]string
+
+// String возвращает каноническое представление меток k1="v1",k2="v2" с ключами в порядке сортировки.
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k + "=" + strconv.Quote(l[k]))
+	}
+	return sb.String()
+}
+
+// Merge возвращает новый набор меток, в котором метки other дополняют текущие.
+// При совпадении ключей приоритет у текущих меток.
+func (l Labels) Merge(other Labels) Labels {
+	if len(l) == 0 && len(other) == 0 {
+		return nil
+	}
+	result := make(Labels, len(l)+len(other))
+	for k, v := range other {
+		result[k] = v
+	}
+	for k, v := range l {
+		result[k] = v
+	}
+	return result
+}
+
+// ErrInvalidName возвращается, если имя метрики или метки содержит символы,
+// из которых строится ключ временного ряда. Иначе имя вида orders{host="a"} совпало бы
+// с ключом другого ряда и метрики смешались бы.
+var ErrInvalidName = errors.New(`metric and label names must not contain {, }, " or =`)
+
+// ValidateNames проверяет, что имя метрики и имена меток не подделывают ключ ряда.
+// Значения меток в ключе экранируются и не проверяются.
+func ValidateNames(id string, labels Labels) error {
+	if strings.ContainsAny(id, `{}"=`) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, id)
+	}
+	for k := range labels {
+		if strings.ContainsAny(k, `{}"=,`) {
+			return fmt.Errorf("%w: метка %q", ErrInvalidName, k)
+		}
+	}
+	return nil
+}
+
+// SeriesKey возвращает ключ временного ряда: имя метрики, если меток нет, иначе имя{метки}.
+func SeriesKey(id string, labels Labels) string {
+	if len(labels) == 0 {
+		return id
+	}
+	return id + "{" + labels.String() + "}"
+}
+
+// MetricKey возвращает ключ метрики в хранилище: тип:имя{метки}.
+// Благодаря типу в ключе gauge и counter с одинаковым именем не затирают друг друга.
+func MetricKey(mType, id string, labels Labels) string {
+	return mType + ":" + SeriesKey(id, labels)
+}
+
+// ParseLabels разбирает метки в формате k1=v1,k2=v2. Пустая строка означает отсутствие меток.
+func ParseLabels(s string) (Labels, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	labels := make(Labels)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("некорректная метка %q, ожидается формат key=value", pair)
+		}
+		labels[k] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
+
+// Sample - одно значение метрики в истории.
+type Sample struct {
+	Timestamp time.Time `json:"ts"`    // Время получения значения
+	Value     float64   `json:"value"` // Значение gauge или приращение counter
+}
+
+// NotificationState - состояние последнего отправленного уведомления по группе алертов.
+type NotificationState struct {
+	Key         string    `json:"key"`         // Получатель и ключ группы
+	Fingerprint string    `json:"fingerprint"` // Отпечаток набора алертов в уведомлении
+	SentAt      time.Time `json:"sent_at"`     // Время успешной отправки
 }
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesKey(t *testing.T) {
+	assert.Equal(t, "Alloc", SeriesKey("Alloc", nil))
+	assert.Equal(t, `Alloc{cpu="1",host="a"}`, SeriesKey("Alloc", Labels{"host": "a", "cpu": "1"}))
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("host=a, dc = msk")
+	require.NoError(t, err)
+	assert.Equal(t, Labels{"host": "a", "dc": "msk"}, labels)
+
+	labels, err = ParseLabels("")
+	require.NoError(t, err)
+	assert.Nil(t, labels)
+
+	_, err = ParseLabels("host")
+	assert.Error(t, err)
+}
+
+func TestLabelsMerge(t *testing.T) {
+	merged := Labels{"host": "a"}.Merge(Labels{"host": "b", "dc": "msk"})
+	assert.Equal(t, Labels{"host": "a", "dc": "msk"}, merged)
+	assert.Nil(t, Labels(nil).Merge(nil))
+}
+
+func TestValidateNames(t *testing.T) {
+	assert.NoError(t, ValidateNames("servers.web1.cpu", Labels{"host": `a",b="c`}))
+	assert.ErrorIs(t, ValidateNames(`orders{__tenant__="payments"}`, nil), ErrInvalidName)
+	assert.ErrorIs(t, ValidateNames("orders", Labels{`a="1",b`: "2"}), ErrInvalidName)
+}
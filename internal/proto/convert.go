@@ -0,0 +1,60 @@
+package proto
+
+import "github.com/lenarlenar/go-my-metrics-service/internal/model"
+
+// FromModel конвертирует model.Metrics в protobuf-сообщение.
+func FromModel(m model.Metrics) *Metric {
+	metric := &Metric{Id: m.ID, Labels: m.Labels}
+	switch m.MType {
+	case "gauge":
+		metric.Type = Metric_GAUGE
+		if m.Value != nil {
+			metric.Value = *m.Value
+		}
+	case "counter":
+		metric.Type = Metric_COUNTER
+		if m.Delta != nil {
+			metric.Delta = *m.Delta
+		}
+	}
+	return metric
+}
+
+// ToModel конвертирует protobuf-сообщение в model.Metrics.
+// Для метрики неизвестного типа MType остается пустым.
+func ToModel(m *Metric) model.Metrics {
+	metric := model.Metrics{ID: m.GetId()}
+	if len(m.GetLabels()) > 0 {
+		metric.Labels = m.GetLabels()
+	}
+	metric.MType = MTypeToModel(m.GetType())
+	switch m.GetType() {
+	case Metric_GAUGE:
+		value := m.GetValue()
+		metric.Value = &value
+	case Metric_COUNTER:
+		delta := m.GetDelta()
+		metric.Delta = &delta
+	}
+	return metric
+}
+
+// MTypeToModel возвращает строковый тип метрики. Для неизвестного типа возвращается пустая строка.
+func MTypeToModel(t Metric_MType) string {
+	switch t {
+	case Metric_GAUGE:
+		return "gauge"
+	case Metric_COUNTER:
+		return "counter"
+	}
+	return ""
+}
+
+// ToModelBatch конвертирует пачку protobuf-сообщений в model.Metrics.
+func ToModelBatch(in []*Metric) []model.Metrics {
+	metrics := make([]model.Metrics, 0, len(in))
+	for _, m := range in {
+		metrics = append(metrics, ToModel(m))
+	}
+	return metrics
+}
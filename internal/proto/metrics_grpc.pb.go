@@ -0,0 +1,241 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: metrics.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Metrics_Update_FullMethodName       = "/metrics.Metrics/Update"
+	Metrics_UpdateBatch_FullMethodName  = "/metrics.Metrics/UpdateBatch"
+	Metrics_UpdateStream_FullMethodName = "/metrics.Metrics/UpdateStream"
+	Metrics_Value_FullMethodName        = "/metrics.Metrics/Value"
+)
+
+// MetricsClient is the client API for Metrics service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Metrics - сервис приема метрик от агентов.
+type MetricsClient interface {
+	// Update обновляет одну метрику.
+	Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error)
+	// UpdateBatch обновляет пачку метрик.
+	UpdateBatch(ctx context.Context, in *UpdateBatchRequest, opts ...grpc.CallOption) (*UpdateBatchResponse, error)
+	// UpdateStream принимает поток пачек метрик и отвечает один раз по завершении потока.
+	UpdateStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UpdateBatchRequest, UpdateBatchResponse], error)
+	// Value возвращает текущее значение метрики.
+	Value(ctx context.Context, in *ValueRequest, opts ...grpc.CallOption) (*ValueResponse, error)
+}
+
+type metricsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMetricsClient(cc grpc.ClientConnInterface) MetricsClient {
+	return &metricsClient{cc}
+}
+
+func (c *metricsClient) Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UpdateResponse)
+	err := c.cc.Invoke(ctx, Metrics_Update_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsClient) UpdateBatch(ctx context.Context, in *UpdateBatchRequest, opts ...grpc.CallOption) (*UpdateBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UpdateBatchResponse)
+	err := c.cc.Invoke(ctx, Metrics_UpdateBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsClient) UpdateStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UpdateBatchRequest, UpdateBatchResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Metrics_ServiceDesc.Streams[0], Metrics_UpdateStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UpdateBatchRequest, UpdateBatchResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Metrics_UpdateStreamClient = grpc.ClientStreamingClient[UpdateBatchRequest, UpdateBatchResponse]
+
+func (c *metricsClient) Value(ctx context.Context, in *ValueRequest, opts ...grpc.CallOption) (*ValueResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ValueResponse)
+	err := c.cc.Invoke(ctx, Metrics_Value_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MetricsServer is the server API for Metrics service.
+// All implementations must embed UnimplementedMetricsServer
+// for forward compatibility.
+//
+// Metrics - сервис приема метрик от агентов.
+type MetricsServer interface {
+	// Update обновляет одну метрику.
+	Update(context.Context, *UpdateRequest) (*UpdateResponse, error)
+	// UpdateBatch обновляет пачку метрик.
+	UpdateBatch(context.Context, *UpdateBatchRequest) (*UpdateBatchResponse, error)
+	// UpdateStream принимает поток пачек метрик и отвечает один раз по завершении потока.
+	UpdateStream(grpc.ClientStreamingServer[UpdateBatchRequest, UpdateBatchResponse]) error
+	// Value возвращает текущее значение метрики.
+	Value(context.Context, *ValueRequest) (*ValueResponse, error)
+	mustEmbedUnimplementedMetricsServer()
+}
+
+// UnimplementedMetricsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMetricsServer struct{}
+
+func (UnimplementedMetricsServer) Update(context.Context, *UpdateRequest) (*UpdateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Update not implemented")
+}
+func (UnimplementedMetricsServer) UpdateBatch(context.Context, *UpdateBatchRequest) (*UpdateBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateBatch not implemented")
+}
+func (UnimplementedMetricsServer) UpdateStream(grpc.ClientStreamingServer[UpdateBatchRequest, UpdateBatchResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method UpdateStream not implemented")
+}
+func (UnimplementedMetricsServer) Value(context.Context, *ValueRequest) (*ValueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Value not implemented")
+}
+func (UnimplementedMetricsServer) mustEmbedUnimplementedMetricsServer() {}
+func (UnimplementedMetricsServer) testEmbeddedByValue()                 {}
+
+// UnsafeMetricsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MetricsServer will
+// result in compilation errors.
+type UnsafeMetricsServer interface {
+	mustEmbedUnimplementedMetricsServer()
+}
+
+func RegisterMetricsServer(s grpc.ServiceRegistrar, srv MetricsServer) {
+	// If the following call pancis, it indicates UnimplementedMetricsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Metrics_ServiceDesc, srv)
+}
+
+func _Metrics_Update_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).Update(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metrics_Update_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).Update(ctx, req.(*UpdateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metrics_UpdateBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).UpdateBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metrics_UpdateBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).UpdateBatch(ctx, req.(*UpdateBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metrics_UpdateStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MetricsServer).UpdateStream(&grpc.GenericServerStream[UpdateBatchRequest, UpdateBatchResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Metrics_UpdateStreamServer = grpc.ClientStreamingServer[UpdateBatchRequest, UpdateBatchResponse]
+
+func _Metrics_Value_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).Value(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metrics_Value_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).Value(ctx, req.(*ValueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Metrics_ServiceDesc is the grpc.ServiceDesc for Metrics service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Metrics_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "metrics.Metrics",
+	HandlerType: (*MetricsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Update",
+			Handler:    _Metrics_Update_Handler,
+		},
+		{
+			MethodName: "UpdateBatch",
+			Handler:    _Metrics_UpdateBatch_Handler,
+		},
+		{
+			MethodName: "Value",
+			Handler:    _Metrics_Value_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "UpdateStream",
+			Handler:       _Metrics_UpdateStream_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "metrics.proto",
+}
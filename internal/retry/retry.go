@@ -0,0 +1,53 @@
+// Package retry содержит общую логику повторных попыток с паузами между ними.
+package retry
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Backoff возвращает паузу перед повтором после попытки с номером attempt (начиная с 0).
+type Backoff func(attempt int) time.Duration
+
+// Linear возвращает паузы start, start+step, start+2*step, ...
+func Linear(start, step time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		return start + time.Duration(attempt)*step
+	}
+}
+
+// Exponential возвращает паузы initial, 2*initial, 4*initial, ..., но не больше max.
+func Exponential(initial, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		delay := initial
+		for i := 0; i < attempt && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
+}
+
+// Do вызывает fn до attempts раз, пока она не вернет nil. Между попытками выдерживается
+// пауза backoff. Ожидание прерывается при отмене контекста.
+func Do(ctx context.Context, attempts int, backoff Backoff, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if i == attempts-1 {
+			break
+		}
+
+		select {
+		case <-time.After(backoff(i)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fmt.Errorf("не удалось выполнить успешно после %d попыток: %w", attempts, err)
+}
@@ -0,0 +1,49 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	linear := Linear(time.Second, 2*time.Second)
+	assert.Equal(t, time.Second, linear(0))
+	assert.Equal(t, 5*time.Second, linear(2))
+
+	exponential := Exponential(time.Second, 5*time.Second)
+	assert.Equal(t, time.Second, exponential(0))
+	assert.Equal(t, 4*time.Second, exponential(2))
+	assert.Equal(t, 5*time.Second, exponential(10))
+}
+
+func TestDo(t *testing.T) {
+	errFail := errors.New("fail")
+
+	calls := 0
+	err := Do(context.Background(), 3, Linear(0, 0), func() error {
+		calls++
+		if calls < 3 {
+			return errFail
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = Do(context.Background(), 2, Linear(0, 0), func() error {
+		calls++
+		return errFail
+	})
+	assert.ErrorIs(t, err, errFail)
+	assert.Equal(t, 2, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Do(ctx, 3, Linear(time.Hour, 0), func() error { return errFail })
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,79 @@
+package sender
+
+import (
+	"sync"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+// counterTracker переводит накопительные значения counter из хранилища агента в приращения.
+// Сервер прибавляет присланное значение counter к текущему, поэтому агент отправляет
+// только приращение с прошлой отправки. Приращение считается отправленным, только если
+// сервер ответил 200 или пачка сохранена в дисковую очередь; иначе оно возвращается
+// и уходит со следующей пачкой.
+type counterTracker struct {
+	mutex    sync.Mutex
+	reported map[string]int64 // переданные на отправку значения, включая отправляемые сейчас
+}
+
+func newCounterTracker() *counterTracker {
+	return &counterTracker{reported: make(map[string]int64)}
+}
+
+// counters - общий для всех отправок учёт приращений counter.
+var counters = newCounterTracker()
+
+// take возвращает метрики, в которых counter заменены приращениями, и резервирует
+// эти приращения, чтобы параллельная отправка их не повторила. Counter без приращения
+// в результат не попадают. Вторым значением возвращаются зарезервированные приращения
+// для rollback.
+func (c *counterTracker) take(metrics map[string]model.Metrics) (map[string]model.Metrics, map[string]int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Ряды, удалённые из хранилища агента (например, метрики завершившихся процессов),
+	// больше не учитываются.
+	for key := range c.reported {
+		if _, ok := metrics[key]; !ok {
+			delete(c.reported, key)
+		}
+	}
+
+	result := make(map[string]model.Metrics, len(metrics))
+	taken := make(map[string]int64)
+	for key, m := range metrics {
+		if m.MType != "counter" || m.Delta == nil {
+			result[key] = m
+			continue
+		}
+
+		delta := *m.Delta - c.reported[key]
+		if delta < 0 {
+			// Значение в хранилище меньше отправленного - счётчик сброшен и считается заново.
+			delta = *m.Delta
+			c.reported[key] = 0
+		}
+		if delta == 0 {
+			continue
+		}
+
+		c.reported[key] += delta
+		taken[key] = delta
+		m.Delta = &delta
+		result[key] = m
+	}
+	return result, taken
+}
+
+// rollback возвращает приращения, которые не удалось отправить. Приращения рядов,
+// удалённых за время отправки, пропускаются.
+func (c *counterTracker) rollback(taken map[string]int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, delta := range taken {
+		if _, ok := c.reported[key]; ok {
+			c.reported[key] -= delta
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/spool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func snapshot(pollCount int64, alloc float64) map[string]model.Metrics {
+	return map[string]model.Metrics{
+		model.MetricKey("counter", "PollCount", nil): {ID: "PollCount", MType: "counter", Delta: &pollCount},
+		model.MetricKey("gauge", "Alloc", nil):       {ID: "Alloc", MType: "gauge", Value: &alloc},
+	}
+}
+
+func TestCounterTracker(t *testing.T) {
+	tracker := newCounterTracker()
+	key := model.MetricKey("counter", "PollCount", nil)
+
+	deltas, taken := tracker.take(snapshot(5, 1))
+	assert.Equal(t, int64(5), *deltas[key].Delta)
+
+	// Пока первая пачка в полёте, вторая отправка получает только новое приращение.
+	deltas, _ = tracker.take(snapshot(7, 2))
+	assert.Equal(t, int64(2), *deltas[key].Delta)
+	assert.Equal(t, 2.0, *deltas[model.MetricKey("gauge", "Alloc", nil)].Value)
+
+	// Первая пачка не доставлена - её приращение уходит со следующей.
+	tracker.rollback(taken)
+	deltas, _ = tracker.take(snapshot(8, 3))
+	assert.Equal(t, int64(6), *deltas[key].Delta)
+
+	// Без новых приращений counter не отправляется.
+	deltas, _ = tracker.take(snapshot(8, 3))
+	assert.NotContains(t, deltas, key)
+	assert.Len(t, deltas, 1)
+
+	// Удалённый из хранилища ряд забывается.
+	tracker.take(map[string]model.Metrics{})
+	assert.Empty(t, tracker.reported)
+}
+
+func TestReportDeltas(t *testing.T) {
+	saved := counters
+	counters = newCounterTracker()
+	defer func() { counters = saved }()
+
+	var received int64
+	up := false
+	send := func(batch []model.Metrics) error {
+		if !up {
+			return errors.New("connection refused")
+		}
+		for _, m := range batch {
+			if m.MType == "counter" {
+				received += *m.Delta
+			}
+		}
+		return nil
+	}
+
+	// Без дисковой очереди неподтверждённые приращения отправляются повторно.
+	report(nil, flags.Flags{}, snapshot(3, 1), send)
+	up = true
+	report(nil, flags.Flags{}, snapshot(5, 1), send)
+	report(nil, flags.Flags{}, snapshot(6, 1), send)
+	assert.Equal(t, int64(6), received)
+
+	// С очередью приращения из очереди досылаются, а не отправляются повторно.
+	queue, err := spool.Open(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	up = false
+	report(queue, flags.Flags{}, snapshot(8, 1), send)
+	report(queue, flags.Flags{}, snapshot(10, 1), send)
+	up = true
+	report(queue, flags.Flags{}, snapshot(11, 1), send)
+	assert.Equal(t, int64(11), received)
+	assert.Equal(t, 0, queue.Len())
+
+	// Отклонённая сервером пачка отбрасывается, а не копится в очереди.
+	reject := func([]model.Metrics) error { return fmt.Errorf("status code 400: %w", spool.ErrRejected) }
+	report(queue, flags.Flags{}, snapshot(12, 1), reject)
+	assert.Equal(t, 0, queue.Len())
+	report(queue, flags.Flags{}, snapshot(13, 1), send)
+	assert.Equal(t, int64(12), received)
+}
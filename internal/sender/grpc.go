@@ -0,0 +1,201 @@
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	pb "github.com/lenarlenar/go-my-metrics-service/internal/proto"
+	"github.com/lenarlenar/go-my-metrics-service/internal/retry"
+	"github.com/lenarlenar/go-my-metrics-service/internal/signature"
+	"github.com/lenarlenar/go-my-metrics-service/internal/spool"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcChunkSize - максимальное количество метрик в одном сообщении потока.
+const grpcChunkSize = 100
+
+// grpcTimeout - таймаут на отправку одной пачки метрик.
+const grpcTimeout = 10 * time.Second
+
+// GRPCSender отправляет метрики на сервер по gRPC.
+type GRPCSender struct {
+	conn     *grpc.ClientConn
+	client   pb.MetricsClient
+	key      string
+	tenantID string
+	token    string
+}
+
+// NewGRPCSender создает клиента gRPC. Соединение устанавливается лениво при первом запросе.
+// Без tlsConfig соединение не шифруется. Вызовы подписываются ключом key и передают
+// арендатора и токен в метаданных, как агент передаёт их в заголовках HTTP.
+func NewGRPCSender(address string, tlsConfig *tls.Config, key, tenantID, token string) (*GRPCSender, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при создании gRPC-клиента: %w", err)
+	}
+	return &GRPCSender{
+		conn:     conn,
+		client:   pb.NewMetricsClient(conn),
+		key:      key,
+		tenantID: tenantID,
+		token:    token,
+	}, nil
+}
+
+// grpcBatch - пачка метрик, подготовленная к отправке потоком, вместе с метаданными вызова.
+// Повторные попытки отправляют её с тем же nonce, чтобы сервер не применил пачку дважды.
+type grpcBatch struct {
+	chunks []*pb.UpdateBatchRequest
+	md     metadata.MD
+}
+
+// newBatch делит метрики на сообщения по grpcChunkSize штук и подписывает их.
+func (g *GRPCSender) newBatch(metrics []model.Metrics) (grpcBatch, error) {
+	var chunks []*pb.UpdateBatchRequest
+	for start := 0; start < len(metrics); start += grpcChunkSize {
+		end := min(start+grpcChunkSize, len(metrics))
+		chunk := make([]*pb.Metric, 0, end-start)
+		for _, m := range metrics[start:end] {
+			chunk = append(chunk, pb.FromModel(m))
+		}
+		chunks = append(chunks, &pb.UpdateBatchRequest{Metrics: chunk})
+	}
+
+	md := metadata.MD{}
+	if g.tenantID != "" {
+		md.Set(tenant.Header, g.tenantID)
+	}
+	if g.token != "" {
+		md.Set("Authorization", "Bearer "+g.token)
+	}
+	if g.key != "" {
+		nonce, err := signature.NewNonce()
+		if err != nil {
+			return grpcBatch{}, fmt.Errorf("ошибка генерации nonce: %w", err)
+		}
+		timestamp := signature.Timestamp(time.Now())
+		target := signature.Target(signature.GRPCMethod, pb.Metrics_UpdateStream_FullMethodName)
+		mac := signature.New([]byte(g.key), timestamp, nonce, target)
+		for _, chunk := range chunks {
+			data, err := proto.MarshalOptions{Deterministic: true}.Marshal(chunk)
+			if err != nil {
+				return grpcBatch{}, fmt.Errorf("ошибка сериализатора: %w", err)
+			}
+			mac.Write(data)
+		}
+		md.Set(signature.TimestampHeader, timestamp)
+		md.Set(signature.NonceHeader, nonce)
+		md.Set("HashSHA256", hex.EncodeToString(mac.Sum(nil)))
+	}
+	return grpcBatch{chunks: chunks, md: md}, nil
+}
+
+// SendBatch отправляет метрики потоком пачек по grpcChunkSize штук.
+func (g *GRPCSender) SendBatch(ctx context.Context, metrics []model.Metrics) error {
+	batch, err := g.newBatch(metrics)
+	if err != nil {
+		return err
+	}
+	return g.send(ctx, batch)
+}
+
+// send отправляет подготовленную пачку одним потоком.
+func (g *GRPCSender) send(ctx context.Context, batch grpcBatch) error {
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+
+	stream, err := g.client.UpdateStream(metadata.NewOutgoingContext(ctx, batch.md))
+	if err != nil {
+		return err
+	}
+	for _, chunk := range batch.chunks {
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	log.I().Infof("gRPC-сервер принял метрик: %d\n", resp.GetAccepted())
+	return nil
+}
+
+// Close закрывает соединение с сервером.
+func (g *GRPCSender) Close() error {
+	return g.conn.Close()
+}
+
+var (
+	grpcSenders      = make(map[string]*GRPCSender)
+	grpcSendersMutex sync.Mutex
+)
+
+// getGRPCSender возвращает общий для всех воркеров клиент gRPC для адреса из flags.
+func getGRPCSender(flags flags.Flags, tlsConfig *tls.Config) (*GRPCSender, error) {
+	grpcSendersMutex.Lock()
+	defer grpcSendersMutex.Unlock()
+
+	if s, ok := grpcSenders[flags.GRPCAddress]; ok {
+		return s, nil
+	}
+	s, err := NewGRPCSender(flags.GRPCAddress, tlsConfig, flags.Key, flags.TenantID, flags.Token)
+	if err != nil {
+		return nil, err
+	}
+	grpcSenders[flags.GRPCAddress] = s
+	return s, nil
+}
+
+// sendGRPCBatch отправляет метрики по gRPC с теми же повторными попытками, что и postWithRetry.
+// Все попытки подписаны одним nonce; если сервер отвечает, что вызов с ним уже принят,
+// значит, до агента не дошёл ответ на одну из прошлых попыток, и пачка считается доставленной.
+func sendGRPCBatch(flags flags.Flags, tlsConfig *tls.Config, metrics []model.Metrics) error {
+	s, err := getGRPCSender(flags, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("ошибка при отправке метрик по gRPC: %w", err)
+	}
+	batch, err := s.newBatch(metrics)
+	if err != nil {
+		return fmt.Errorf("ошибка при отправке метрик по gRPC: %w", err)
+	}
+
+	err = retry.Do(context.Background(), retryCount, retryBackoff, func() error {
+		err := s.send(context.Background(), batch)
+		if err != nil {
+			log.I().Warnf("ошибка при отправке метрик по gRPC: %v\n", err)
+		}
+		return err
+	})
+	switch status.Code(err) {
+	case codes.AlreadyExists:
+		log.I().Infof("gRPC-сервер %s уже принял пачку метрик\n", flags.GRPCAddress)
+		return nil
+	case codes.InvalidArgument, codes.ResourceExhausted:
+		return fmt.Errorf("ошибка при отправке метрик по gRPC: %w: %w", spool.ErrRejected, err)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка при отправке метрик по gRPC: %w", err)
+	}
+	return nil
+}
@@ -3,26 +3,35 @@ package sender
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/hmac"
-	"crypto/rand"
+	"context"
 	"crypto/rsa"
-	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	urlpkg "net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/envelope"
 	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
 	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/retry"
+	"github.com/lenarlenar/go-my-metrics-service/internal/signature"
+	"github.com/lenarlenar/go-my-metrics-service/internal/spool"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tlsconfig"
 )
 
 type MetricsSender struct {
@@ -32,16 +41,32 @@ type MetricsSender struct {
 	storage    interfaces.Storage
 }
 
-func NewSender(serverAddress string, memStorage interfaces.Storage) *MetricsSender {
-	baseURL := fmt.Sprintf("http://%s", serverAddress)
+func NewSender(flags flags.Flags, memStorage interfaces.Storage) *MetricsSender {
+	baseURL := serverURL(flags)
 	updateURL := fmt.Sprintf("%s/update/", baseURL)
 	updatesURL := fmt.Sprintf("%s/updates/", baseURL)
 	return &MetricsSender{baseURL: baseURL, updateURL: updateURL, updatesURL: updatesURL, storage: memStorage}
 }
 
 func (m *MetricsSender) Run(flags flags.Flags) {
+	queue, err := OpenSpool(flags)
+	if err != nil {
+		log.I().Fatalf("ошибка открытия дисковой очереди: %v", err)
+	}
+	tlsConfig, err := clientTLSConfig(flags)
+	if err != nil {
+		log.I().Fatalf("ошибка настройки TLS: %v", err)
+	}
+
+	if flags.GRPCAddress != "" {
+		log.I().Infof("Отправка метрик по gRPC на %s\n", flags.GRPCAddress)
+		m.reportLoop(queue, flags, func(batch []model.Metrics) error {
+			return sendGRPCBatch(flags, tlsConfig, batch)
+		})
+	}
 
-	gzipIsSupported := gzipIsSupported(m.baseURL)
+	client := newHTTPClient(flags, tlsConfig)
+	gzipIsSupported := gzipIsSupported(client, m.baseURL)
 	log.I().Infof("Поддержка gzip: %v\n", gzipIsSupported)
 	var rsaPub *rsa.PublicKey
 	if flags.CryptoPath != "" {
@@ -51,20 +76,57 @@ func (m *MetricsSender) Run(flags flags.Flags) {
 			log.I().Fatalf("ошибка загрузки RSA ключа: %v", err)
 		}
 	}
+	m.reportLoop(queue, flags, func(batch []model.Metrics) error {
+		return sendPostBatchRequest(client, flags.Key, m.updatesURL, batch, gzipIsSupported, rsaPub)
+	})
+}
+
+// reportLoop отправляет метрики с интервалом ReportInterval. Одновременно выполняется
+// не больше одной отправки: пока сервер не ответил на прошлую, очередной интервал
+// пропускается, а приращения уходят со следующей пачкой. Так медленный сервер
+// не копит горутины и открытые запросы.
+func (m *MetricsSender) reportLoop(queue *spool.Spool, flags flags.Flags, send func([]model.Metrics) error) {
+	inflight := make(chan struct{}, 1)
 	for {
-		// for _, model := range m.storage.GetMetrics() {
-		// 	go sendPostRequest(m.updateURL, model)
-		// 	go sendPostWithJSONRequest(m.updateURL, model, gzipIsSupported)
-		// }
-		go sendPostBatchRequest(flags.Key, m.updatesURL, m.storage.GetMetrics(), gzipIsSupported, rsaPub)
+		select {
+		case inflight <- struct{}{}:
+			if metrics, err := m.storage.GetMetrics(context.Background()); err == nil {
+				go func() {
+					defer func() { <-inflight }()
+					report(queue, flags, metrics, send)
+				}()
+			} else {
+				<-inflight
+				log.I().Warnf("ошибка при чтении метрик: %v", err)
+			}
+		default:
+			log.I().Warn("прошлая отправка не завершена, приращения будут отправлены со следующей пачкой")
+		}
 		time.Sleep(flags.ReportInterval)
 	}
 }
 
 func Send(flags flags.Flags, metrics map[string]model.Metrics) {
-	baseURL := fmt.Sprintf("http://%s", flags.ServerAddress)
+	queue, err := OpenSpool(flags)
+	if err != nil {
+		log.I().Warnf("ошибка открытия дисковой очереди: %v", err)
+	}
+	tlsConfig, err := clientTLSConfig(flags)
+	if err != nil {
+		log.I().Fatalf("ошибка настройки TLS: %v", err)
+	}
+
+	if flags.GRPCAddress != "" {
+		report(queue, flags, metrics, func(batch []model.Metrics) error {
+			return sendGRPCBatch(flags, tlsConfig, batch)
+		})
+		return
+	}
+
+	baseURL := serverURL(flags)
 	updatesURL := fmt.Sprintf("%s/updates/", baseURL)
-	gzipIsSupported := gzipIsSupported(baseURL)
+	client := newHTTPClient(flags, tlsConfig)
+	gzipIsSupported := gzipIsSupported(client, baseURL)
 	var rsaPub *rsa.PublicKey
 	if flags.CryptoPath != "" {
 		var err error
@@ -74,7 +136,59 @@ func Send(flags flags.Flags, metrics map[string]model.Metrics) {
 		}
 	}
 
-	sendPostBatchRequest(flags.Key, updatesURL, metrics, gzipIsSupported, rsaPub)
+	report(queue, flags, metrics, func(batch []model.Metrics) error {
+		return sendPostBatchRequest(client, flags.Key, updatesURL, batch, gzipIsSupported, rsaPub)
+	})
+}
+
+// serverURL возвращает базовый адрес HTTP-сервера. Адрес можно указать со схемой,
+// без схемы используется https, если настроен TLS, иначе http.
+func serverURL(flags flags.Flags) string {
+	if strings.Contains(flags.ServerAddress, "://") {
+		return strings.TrimSuffix(flags.ServerAddress, "/")
+	}
+	if flags.TLS() {
+		return "https://" + flags.ServerAddress
+	}
+	return "http://" + flags.ServerAddress
+}
+
+// clientTLSConfig возвращает настройки TLS из флагов агента или nil, если сертификаты
+// не заданы. Для https без сертификатов используются системные CA.
+func clientTLSConfig(flags flags.Flags) (*tls.Config, error) {
+	if flags.TLSCA == "" && flags.TLSCert == "" && flags.TLSKey == "" {
+		return nil, nil
+	}
+	return tlsconfig.Client(flags.TLSCA, flags.TLSCert, flags.TLSKey)
+}
+
+// newHTTPClient создает HTTP-клиента, общего для всех запросов одной отправки.
+// Клиент передаёт в каждом запросе арендатора и токен доступа, если они заданы.
+func newHTTPClient(flags flags.Flags, tlsConfig *tls.Config) *resty.Client {
+	client := resty.New()
+	if tlsConfig != nil {
+		client.SetTLSClientConfig(tlsConfig)
+	}
+	if flags.TenantID != "" {
+		client.SetHeader(tenant.Header, flags.TenantID)
+	}
+	if flags.Token != "" {
+		client.SetAuthToken(flags.Token)
+	}
+	return client
+}
+
+// withLabels возвращает пачку метрик, дополненных метками агента.
+// Собственные метки метрики имеют приоритет над метками агента.
+func withLabels(metrics map[string]model.Metrics, labels model.Labels) []model.Metrics {
+	result := make([]model.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		if len(labels) > 0 {
+			m.Labels = m.Labels.Merge(labels)
+		}
+		result = append(result, m)
+	}
+	return result
 }
 
 func loadPublicKey(path string) (*rsa.PublicKey, error) {
@@ -125,8 +239,8 @@ func compressData(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func gzipIsSupported(baseURL string) bool {
-	resp, err := resty.New().R().
+func gzipIsSupported(client *resty.Client, baseURL string) bool {
+	resp, err := client.R().
 		SetHeader("Accept-Encoding", "gzip").
 		Get(baseURL)
 
@@ -188,94 +302,191 @@ func sendPostWithJSONRequest(url string, model model.Metrics, compress bool) {
 	log.I().Infof("Ответ от %s: %d %s\n", url, resp.StatusCode(), resp)
 }
 
-func calculateHash(data, key []byte) string {
-	h := hmac.New(sha256.New, key)
-	h.Write(data)
-	return hex.EncodeToString(h.Sum(nil))
-}
-
 func sendPostBatchRequest(
+	client *resty.Client,
 	key string,
 	url string,
-	metrics map[string]model.Metrics,
+	metrics []model.Metrics,
 	compress bool,
 	rsaPub *rsa.PublicKey,
-) {
-	metricsSlice := make([]model.Metrics, 0, len(metrics))
-	for _, m := range metrics {
-		metricsSlice = append(metricsSlice, m)
+) error {
+	jsonModel, err := json.Marshal(metrics)
+	if err != nil {
+		return fmt.Errorf("ошибка сериализатора: %w", err)
 	}
 
-	jsonModel, err := json.Marshal(metricsSlice)
+	request := client.R()
+	version, err := encodeBody(request, key, url, jsonModel, compress, rsaPub)
 	if err != nil {
-		log.I().Warnf("ошибка сериализатора: %v", err)
-		return
+		return err
 	}
 
-	client := resty.New()
-	request := client.R()
+	resp, err := postWithRetry(request, url)
+	if rsaPub != nil && negotiateEncryption(url, version, resp) {
+		return sendPostBatchRequest(client, key, url, metrics, compress, rsaPub)
+	}
+	if err != nil && replayed(resp) {
+		// Сервер обработал одну из прошлых попыток, ответ на которую не дошёл до агента.
+		log.I().Infof("сервер %s уже принял пачку метрик\n", url)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка при отправке запроса: %w", err)
+	}
+	log.I().Infof("ответ от %s: %d %s\n", url, resp.StatusCode(), resp)
+	return nil
+}
 
-	var bodyToSend []byte
+// requestPath возвращает путь запроса из адреса, как его увидит сервер.
+func requestPath(url string) string {
+	u, err := urlpkg.Parse(url)
+	if err != nil {
+		return url
+	}
+	return u.Path
+}
 
-	switch {
-	case compress && rsaPub == nil: //gzip только если нет RSA
-		request.SetHeader("Content-Encoding", "gzip")
-		request.SetHeader("Content-Type", "application/json")
+// replayed сообщает, что сервер отклонил запрос как повтор уже принятого. Сервер закрепляет
+// nonce только за успешно обработанным запросом, поэтому такой ответ означает, что одна из
+// прошлых попыток сохранена. Повтор запроса, который ещё обрабатывается, получает другую ошибку.
+func replayed(resp *resty.Response) bool {
+	return resp != nil && resp.StatusCode() == http.StatusUnauthorized &&
+		strings.Contains(resp.String(), signature.ErrReplay.Error())
+}
 
-		compressedData, err := compressData(jsonModel)
-		if err != nil {
-			log.I().Warnf("ошибка при сжатии: %v", err)
-			return
-		}
-		bodyToSend = compressedData
+// encodeBody записывает в запрос тело и заголовки, применяя слои в фиксированном порядке:
+// подпись HMAC открытого JSON с меткой времени и nonce, сжатие gzip, шифрование. Сервер снимает их в обратном
+// порядке (см. router.New). Каждый слой включается независимо от остальных.
+// Старая схема шифрования PKCS#1 v1.5 используется только со старыми серверами,
+// которые не умеют совмещать её с другими слоями, поэтому с ней тело только шифруется.
+// Возвращает версию шифрования, 0 - без шифрования.
+func encodeBody(
+	request *resty.Request,
+	key string,
+	url string,
+	data []byte,
+	compress bool,
+	rsaPub *rsa.PublicKey,
+) (int, error) {
+	version := 0
+	if rsaPub != nil {
+		version = encryptionVersion(url)
+	}
+	legacy := version == envelope.VersionPKCS1
 
-	case rsaPub != nil: // шифрование RSA, без gzip
-		request.SetHeader("Content-Type", "application/octet-stream")
+	request.SetHeader("Content-Type", "application/json")
+	body := data
 
-		encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, rsaPub, jsonModel)
+	if key != "" && !legacy {
+		// Метка времени и nonce защищают от повторной отправки перехваченного запроса.
+		nonce, err := signature.NewNonce()
 		if err != nil {
-			log.I().Warnf("ошибка при шифровании: %v", err)
-			return
+			return 0, fmt.Errorf("ошибка при создании nonce: %w", err)
 		}
-		bodyToSend = encrypted
+		timestamp := signature.Timestamp(time.Now())
+		request.SetHeader(signature.TimestampHeader, timestamp)
+		request.SetHeader(signature.NonceHeader, nonce)
+		target := signature.Target(http.MethodPost, requestPath(url))
+		request.SetHeader("HashSHA256", signature.Sign([]byte(key), timestamp, nonce, target, data))
+	}
 
-	default:
-		request.SetHeader("Content-Type", "application/json")
-		bodyToSend = jsonModel
+	if compress && !legacy {
+		compressed, err := compressData(body)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка при сжатии: %w", err)
+		}
+		request.SetHeader("Content-Encoding", "gzip")
+		body = compressed
 	}
 
-	if key != "" && rsaPub == nil && !compress { //хеш только если нет RSA и gzip
-		log.I().Info("secretKey: " + key)
-		hash := calculateHash(jsonModel, []byte(key))
-		log.I().Info("HashSHA256: " + hash)
-		request.SetHeader("HashSHA256", hash)
+	if rsaPub != nil {
+		encrypted, err := envelope.Encrypt(rsaPub, version, body)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка при шифровании: %w", err)
+		}
+		request.SetHeader("Content-Type", "application/octet-stream")
+		if !legacy {
+			request.SetHeader(envelope.Header, strconv.Itoa(version))
+		}
+		body = encrypted
 	}
 
-	request.SetBody(bodyToSend)
+	request.SetBody(body)
+	return version, nil
+}
+
+// encryptionVersions - версия схемы шифрования, согласованная с сервером, по адресу отправки.
+var encryptionVersions sync.Map
 
-	resp, err := postWithRetry(request, url)
-	if err != nil {
-		log.I().Warnf("ошибка при отправке запроса: %v", err)
-	} else {
-		log.I().Infof("ответ от %s: %d %s\n", url, resp.StatusCode(), resp)
+// encryptionVersion возвращает версию шифрования для адреса. Пока сервер не ответил,
+// используется гибридная схема.
+func encryptionVersion(url string) int {
+	if v, ok := encryptionVersions.Load(url); ok {
+		return v.(int)
 	}
+	return envelope.VersionHybrid
+}
+
+// negotiateEncryption запоминает версию шифрования по ответу сервера. Новый сервер
+// перечисляет поддерживаемые версии в заголовке ответа; старый его не присылает
+// и отвечает 400 на гибридную схему. В этом случае агент переходит на PKCS#1 v1.5
+// и возвращает true - запрос нужно повторить.
+func negotiateEncryption(url string, version int, resp *resty.Response) bool {
+	if resp == nil {
+		return false
+	}
+	supported := resp.Header().Get(envelope.SupportedHeader)
+	if supported == "" {
+		if version == envelope.VersionHybrid && resp.StatusCode() == http.StatusBadRequest {
+			log.I().Warnf("сервер %s не поддерживает гибридное шифрование, используется RSA PKCS#1 v1.5", url)
+			encryptionVersions.Store(url, envelope.VersionPKCS1)
+			return true
+		}
+		return false
+	}
+	if version != envelope.VersionHybrid &&
+		slices.Contains(strings.Split(supported, ","), strconv.Itoa(envelope.VersionHybrid)) {
+		encryptionVersions.Store(url, envelope.VersionHybrid)
+	}
+	return false
 }
 
 const retryCount = 3
 
+// retryBackoff - паузы между попытками отправки: 1с, 3с, 5с.
+var retryBackoff = retry.Linear(time.Second, 2*time.Second)
+
+// postWithRetry отправляет запрос с повторами. Последний полученный ответ
+// возвращается и вместе с ошибкой. Ответ, отклоняющий содержимое пачки,
+// возвращается как spool.ErrRejected.
 func postWithRetry(request *resty.Request, url string) (*resty.Response, error) {
-	delay := 1
-	for i := 0; i < retryCount; i++ {
-		resp, err := request.Post(url)
+	var resp *resty.Response
+	err := retry.Do(context.Background(), retryCount, retryBackoff, func() error {
+		r, err := request.Post(url)
 		if err != nil {
 			log.I().Warnf("ошибка при запросе к серверу: %v\n", err)
-		} else if resp.StatusCode() == 200 {
-			return resp, nil
-		} else {
-			log.I().Warnf("ошибка при запросе к серверу: status code %d\n", resp.StatusCode())
+			return err
+		}
+		resp = r
+		if r.StatusCode() != 200 {
+			log.I().Warnf("ошибка при запросе к серверу: status code %d\n", r.StatusCode())
+			if rejectedStatus(r.StatusCode()) {
+				return fmt.Errorf("%w: status code %d", spool.ErrRejected, r.StatusCode())
+			}
+			return fmt.Errorf("status code %d", r.StatusCode())
 		}
-		time.Sleep(time.Duration(delay) * time.Second)
-		delay += 2
+		return nil
+	})
+	return resp, err
+}
+
+// rejectedStatus сообщает, что сервер отклонил само содержимое запроса
+// и повторная отправка той же пачки не поможет.
+func rejectedStatus(code int) bool {
+	switch code {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge,
+		http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return true
 	}
-	return nil, fmt.Errorf("запрос не удалось выполнить успешно после %d попыток", retryCount)
+	return false
 }
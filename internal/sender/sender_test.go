@@ -0,0 +1,108 @@
+package sender
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty/v2"
+	agentflags "github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/alerting"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/server/router"
+	"github.com/lenarlenar/go-my-metrics-service/internal/service"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestSendPostBatchRequestLayers проверяет, что сервер снимает подпись, сжатие и шифрование
+// в любом их сочетании.
+func TestSendPostBatchRequestLayers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	for _, key := range []string{"", "secret"} {
+		for _, compress := range []bool{false, true} {
+			for _, encrypt := range []bool{false, true} {
+				name := fmt.Sprintf("key=%t,gzip=%t,rsa=%t", key != "", compress, encrypt)
+				t.Run(name, func(t *testing.T) {
+					var serverKey *rsa.PrivateKey
+					var pubKey *rsa.PublicKey
+					if encrypt {
+						serverKey, pubKey = privKey, &privKey.PublicKey
+					}
+
+					s := storage.NewMemStorage()
+					engine, err := alerting.NewEngine(s, nil)
+					require.NoError(t, err)
+					srv := httptest.NewServer(router.New(flags.Config{Key: key, ReplayWindow: time.Minute, NonceCacheSize: 100}, service.NewService(s), serverKey, engine, nil, nil))
+					defer srv.Close()
+
+					delta := int64(3)
+					metrics := []model.Metrics{{ID: "PollCount", MType: "counter", Delta: &delta}}
+					require.NoError(t, sendPostBatchRequest(resty.New(), key, srv.URL+"/updates/", metrics, compress, pubKey))
+
+					stored, err := s.GetMetrics(context.Background())
+					require.NoError(t, err)
+					require.Contains(t, stored, model.MetricKey("counter", "PollCount", nil))
+					assert.Equal(t, delta, *stored[model.MetricKey("counter", "PollCount", nil)].Delta)
+				})
+			}
+		}
+	}
+}
+
+// TestGRPCSenderSigned проверяет, что сервер принимает подпись агента для потока
+// из нескольких сообщений, а повтор вызова с тем же nonce считается доставленным.
+func TestGRPCSenderSigned(t *testing.T) {
+	s := storage.NewMemStorage()
+	config := flags.Config{Key: "secret", StrictAuth: true, ReplayWindow: time.Minute, NonceCacheSize: 100}
+	server := router.NewGRPC(config, service.NewService(s), nil, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	sender, err := NewGRPCSender(listener.Addr().String(), nil, "secret", "", "")
+	require.NoError(t, err)
+	defer sender.Close()
+
+	metrics := make([]model.Metrics, 0, 2*grpcChunkSize+1)
+	for i := 0; i < cap(metrics); i++ {
+		delta := int64(1)
+		metrics = append(metrics, model.Metrics{ID: fmt.Sprintf("counter%d", i), MType: "counter", Delta: &delta})
+	}
+	batch, err := sender.newBatch(metrics)
+	require.NoError(t, err)
+	require.NoError(t, sender.send(context.Background(), batch))
+	err = sender.send(context.Background(), batch)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	stored, err := s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, stored, len(metrics))
+	assert.Equal(t, int64(1), *stored[model.MetricKey("counter", "counter0", nil)].Delta)
+
+	unsigned, err := NewGRPCSender(listener.Addr().String(), nil, "", "", "")
+	require.NoError(t, err)
+	defer unsigned.Close()
+	err = unsigned.SendBatch(context.Background(), metrics)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServerURL(t *testing.T) {
+	assert.Equal(t, "http://localhost:8080", serverURL(agentflags.Flags{ServerAddress: "localhost:8080"}))
+	assert.Equal(t, "https://localhost:8080", serverURL(agentflags.Flags{ServerAddress: "localhost:8080", TLSCA: "ca.crt"}))
+	assert.Equal(t, "https://metrics.example.com", serverURL(agentflags.Flags{ServerAddress: "https://metrics.example.com/"}))
+}
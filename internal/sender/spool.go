@@ -0,0 +1,99 @@
+package sender
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/agent/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/spool"
+)
+
+var (
+	spools      = make(map[string]*spool.Spool)
+	spoolsMutex sync.Mutex
+)
+
+// OpenSpool возвращает общую для всех воркеров дисковую очередь из flags.SpoolDir.
+// Если каталог не задан, очередь отключена и возвращается nil.
+func OpenSpool(flags flags.Flags) (*spool.Spool, error) {
+	if flags.SpoolDir == "" {
+		return nil, nil
+	}
+
+	spoolsMutex.Lock()
+	defer spoolsMutex.Unlock()
+
+	if q, ok := spools[flags.SpoolDir]; ok {
+		return q, nil
+	}
+	q, err := spool.Open(flags.SpoolDir, spool.DefaultSegmentSize, flags.SpoolMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if n := q.Len(); n > 0 {
+		log.I().Infof("в дисковой очереди %d неотправленных сегментов", n)
+	}
+	spools[flags.SpoolDir] = q
+	return q, nil
+}
+
+// report отправляет приращения метрик из снимка хранилища агента.
+// Если пачку не удалось ни отправить, ни сохранить в очередь, приращения counter
+// возвращаются и уйдут со следующей пачкой.
+func report(queue *spool.Spool, flags flags.Flags, metrics map[string]model.Metrics, send func([]model.Metrics) error) {
+	deltas, taken := counters.take(metrics)
+	if !deliver(queue, withLabels(deltas, flags.Labels), send) {
+		counters.rollback(taken)
+	}
+}
+
+// deliver отправляет пачку, предварительно дослав накопленные в очереди пачки,
+// чтобы сервер получил их по порядку. Если сервер недоступен, пачка сохраняется
+// в очередь и будет отправлена вместе со следующей; пачка, которую сервер отклонил
+// с spool.ErrRejected, отбрасывается. Возвращает false, если пачку не удалось
+// ни отправить, ни сохранить.
+func deliver(queue *spool.Spool, batch []model.Metrics, send func([]model.Metrics) error) bool {
+	if queue == nil {
+		if len(batch) == 0 {
+			return true
+		}
+		if err := send(batch); err != nil {
+			log.I().Warnf("%v", err)
+			return errors.Is(err, spool.ErrRejected)
+		}
+		return true
+	}
+
+	if n, err := queue.Replay(send); err != nil {
+		log.I().Warnf("ошибка при досылке метрик из дисковой очереди: %v", err)
+		return enqueue(queue, batch)
+	} else if n > 0 {
+		log.I().Infof("дослано сегментов из дисковой очереди: %d", n)
+	}
+	if len(batch) == 0 {
+		return true
+	}
+
+	if err := send(batch); err != nil {
+		log.I().Warnf("%v", err)
+		if errors.Is(err, spool.ErrRejected) {
+			// Сервер не примет пачку и при повторе, в очереди она задержала бы следующие.
+			log.I().Warn("пачка метрик отклонена сервером и отброшена")
+			return true
+		}
+		return enqueue(queue, batch)
+	}
+	return true
+}
+
+// enqueue сохраняет пачку в дисковую очередь.
+func enqueue(queue *spool.Spool, batch []model.Metrics) bool {
+	if err := queue.Append(batch); err != nil {
+		log.I().Warnf("ошибка при сохранении метрик в дисковую очередь: %v", err)
+		return false
+	}
+	log.I().Info("метрики сохранены в дисковую очередь")
+	return true
+}
@@ -7,7 +7,10 @@ import (
 	"time"
 
 	"github.com/caarlos0/env"
+	"github.com/lenarlenar/go-my-metrics-service/internal/alerting"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/middleware"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
 )
 
 const (
@@ -19,25 +22,71 @@ const (
 	DefaultDatabaseDSN      = "" //"host=localhost port=5432 user=postgres password=admin dbname=postgres sslmode=disable"
 	DefaultKey              = ""
 	DefaultCryptoPath       = ""
+	DefaultGRPCAddress      = ""
+	DefaultAlertIntervalSec = 15
+	DefaultStatsDAddress    = ""
+	DefaultGraphiteAddress  = ""
+	DefaultTLSCert          = ""
+	DefaultTLSKey           = ""
+	DefaultTLSClientCA      = ""
+	DefaultReplayWindowSec  = 300
+	DefaultNonceCacheSize   = 100000
+	DefaultStrictAuth       = false
+
+	DefaultAllowUnauthenticatedIngest = false
 )
 
 type JSONConfig struct {
-	ServerAddress   string `json:"address"`
-	StoreInterval   int    `json:"store_interval"`
-	FileStoragePath string `json:"store_file"`
-	Restore         bool   `json:"restore"`
-	DatabaseDSN     string `json:"database_dsn"`
-	CryptoPath      string `json:"crypto_key"`
+	ServerAddress   string                       `json:"address"`
+	StoreInterval   int                          `json:"store_interval"`
+	FileStoragePath string                       `json:"store_file"`
+	Restore         bool                         `json:"restore"`
+	DatabaseDSN     string                       `json:"database_dsn"`
+	CryptoPath      string                       `json:"crypto_key"`
+	GRPCAddress     string                       `json:"grpc_address"`
+	AlertRules      []alerting.RuleConfig        `json:"alert_rules"`
+	AlertInterval   int                          `json:"alert_interval"`
+	Notifications   alerting.NotificationsConfig `json:"notifications"`
+	StatsDAddress   string                       `json:"statsd_address"`
+	GraphiteAddress string                       `json:"graphite_address"`
+	TLSCert         string                       `json:"tls_cert"`
+	TLSKey          string                       `json:"tls_key"`
+	TLSClientCA     string                       `json:"tls_client_ca"`
+	Tenants         []tenant.Config              `json:"tenants"`
+	ReplayWindow    *int                         `json:"replay_window"`
+	NonceCacheSize  *int                         `json:"nonce_cache_size"`
+	StrictAuth      bool                         `json:"strict_auth"`
+	Tokens          []middleware.TokenConfig     `json:"tokens"`
+
+	AllowUnauthenticatedIngest bool `json:"allow_unauthenticated_ingest"`
 }
 
 type Config struct {
-	ServerAddress   string        // адрес сервера, по умолчанию "localhost:8080"
-	StoreInterval   time.Duration // интервал сохранения метрик в файл
-	FileStoragePath string        // путь к файлу хранения метрик
-	Restore         bool          // восстанавливать метрики из файла при старте
-	DatabaseDSN     string        // строка подключения к БД PostgreSQL
-	Key             string        // ключ для HMAC-подписи
-	CryptoPath      string        // путь до файла с приватным ключом
+	ServerAddress   string                       // адрес сервера, по умолчанию "localhost:8080"
+	StoreInterval   time.Duration                // интервал сохранения метрик в файл
+	FileStoragePath string                       // путь к файлу хранения метрик
+	Restore         bool                         // восстанавливать метрики из файла при старте
+	DatabaseDSN     string                       // строка подключения к БД PostgreSQL
+	Key             string                       // ключ для HMAC-подписи
+	CryptoPath      string                       // путь до файла с приватным ключом
+	GRPCAddress     string                       // адрес gRPC-сервера, пустая строка отключает gRPC
+	AlertRules      []alerting.RuleConfig        // правила алертинга, задаются только в JSON-конфиге
+	AlertInterval   time.Duration                // интервал вычисления правил алертинга
+	Notifications   alerting.NotificationsConfig // доставка уведомлений об алертах, задается только в JSON-конфиге
+	StatsDAddress   string                       // UDP-адрес приёма метрик StatsD, пустая строка отключает приём
+	GraphiteAddress string                       // TCP-адрес приёма метрик Graphite, пустая строка отключает приём
+	TLSCert         string                       // путь к сертификату сервера, включает HTTPS и TLS для gRPC
+	TLSKey          string                       // путь к ключу сертификата сервера
+	TLSClientCA     string                       // путь к сертификатам CA клиентов, включает проверку клиентов (mTLS)
+	Tenants         []tenant.Config              // арендаторы, задаются только в JSON-конфиге
+	ReplayWindow    time.Duration                // допустимое расхождение метки времени подписанного запроса с часами сервера, 0 - без защиты от повторов
+	NonceCacheSize  int                          // максимальное число запоминаемых nonce подписанных запросов, 0 - без защиты от повторов
+	StrictAuth      bool                         // требовать аутентификацию всех изменяющих запросов
+	Tokens          []middleware.TokenConfig     // токены API с ролями, задаются только в JSON-конфиге
+
+	// AllowUnauthenticatedIngest разрешает приём StatsD и Graphite в строгом режиме.
+	// Эти протоколы не поддерживают аутентификацию, и без флага сервер с ними не запускается.
+	AllowUnauthenticatedIngest bool
 }
 
 type EnvConfig struct {
@@ -49,6 +98,17 @@ type EnvConfig struct {
 	DatabaseDSN     string `env:"DATABASE_DSN"`
 	Key             string `env:"KEY"`
 	CryptoPath      string `env:"CRYPTO_KEY"`
+	GRPCAddress     string `env:"GRPC_ADDRESS"`
+	StatsDAddress   string `env:"STATSD_ADDRESS"`
+	GraphiteAddress string `env:"GRAPHITE_ADDRESS"`
+	TLSCert         string `env:"TLS_CERT"`
+	TLSKey          string `env:"TLS_KEY"`
+	TLSClientCA     string `env:"TLS_CLIENT_CA"`
+	ReplayWindow    int    `env:"REPLAY_WINDOW"`
+	NonceCacheSize  int    `env:"NONCE_CACHE_SIZE"`
+	StrictAuth      bool   `env:"STRICT_AUTH"`
+
+	AllowUnauthenticatedIngest bool `env:"ALLOW_UNAUTHENTICATED_INGEST"`
 }
 
 func Parse() Config {
@@ -64,6 +124,19 @@ func Parse() Config {
 	databaseDSN := flag.String("d", DefaultDatabaseDSN, "Загружать или нет ранее сохраненные файлы")
 	key := flag.String("k", DefaultKey, "Ключ для шифрования")
 	cryptoPath := flag.String("crypto-key", DefaultCryptoPath, "Путь до файла с приватным ключом")
+	grpcAddress := flag.String("g", DefaultGRPCAddress, "Адрес gRPC-сервера")
+	statsdAddress := flag.String("statsd", DefaultStatsDAddress, "UDP-адрес для приёма метрик StatsD")
+	graphiteAddress := flag.String("graphite", DefaultGraphiteAddress, "TCP-адрес для приёма метрик Graphite")
+	tlsCert := flag.String("tls-cert", DefaultTLSCert, "Путь к сертификату сервера, включает HTTPS")
+	tlsKey := flag.String("tls-key", DefaultTLSKey, "Путь к ключу сертификата сервера")
+	tlsClientCA := flag.String("tls-client-ca", DefaultTLSClientCA, "Путь к сертификатам CA для проверки клиентов (mTLS)")
+	replayWindow := flag.Int("replay-window", DefaultReplayWindowSec,
+		"Допустимое расхождение часов агента и сервера в секундах, 0 - без защиты от повторов")
+	nonceCacheSize := flag.Int("nonce-cache-size", DefaultNonceCacheSize,
+		"Максимальное число запоминаемых nonce подписанных запросов, 0 - без защиты от повторов")
+	strictAuth := flag.Bool("strict-auth", DefaultStrictAuth, "Отклонять изменяющие запросы без подписи, токена или сертификата клиента")
+	allowUnauthenticatedIngest := flag.Bool("allow-unauthenticated-ingest", DefaultAllowUnauthenticatedIngest,
+		"Разрешить приём StatsD и Graphite без аутентификации в строгом режиме")
 	configPath := flag.String("c", DefaultConfigPath, "Путь до файла с приватным ключом")
 	flag.Parse()
 
@@ -126,6 +199,68 @@ func Parse() Config {
 			jsonConfig.CryptoPath,
 			DefaultCryptoPath,
 		),
+		GRPCAddress: coalesceString(
+			envConfig.GRPCAddress,
+			*grpcAddress,
+			jsonConfig.GRPCAddress,
+			DefaultGRPCAddress,
+		),
+		AlertRules: jsonConfig.AlertRules,
+		AlertInterval: time.Duration(coalesceInt(
+			jsonConfig.AlertInterval,
+			DefaultAlertIntervalSec,
+		)) * time.Second,
+		Notifications: jsonConfig.Notifications,
+		Tenants:       jsonConfig.Tenants,
+		Tokens:        jsonConfig.Tokens,
+		StatsDAddress: coalesceString(
+			envConfig.StatsDAddress,
+			*statsdAddress,
+			jsonConfig.StatsDAddress,
+			DefaultStatsDAddress,
+		),
+		GraphiteAddress: coalesceString(
+			envConfig.GraphiteAddress,
+			*graphiteAddress,
+			jsonConfig.GraphiteAddress,
+			DefaultGraphiteAddress,
+		),
+		TLSCert: coalesceString(
+			envConfig.TLSCert,
+			*tlsCert,
+			jsonConfig.TLSCert,
+			DefaultTLSCert,
+		),
+		TLSKey: coalesceString(
+			envConfig.TLSKey,
+			*tlsKey,
+			jsonConfig.TLSKey,
+			DefaultTLSKey,
+		),
+		TLSClientCA: coalesceString(
+			envConfig.TLSClientCA,
+			*tlsClientCA,
+			jsonConfig.TLSClientCA,
+			DefaultTLSClientCA,
+		),
+		// 0 - допустимое значение, поэтому источник выбирается по тому, задан ли в нём параметр.
+		ReplayWindow: time.Duration(coalesceIntPtr(
+			DefaultReplayWindowSec,
+			lookupIntEnv("REPLAY_WINDOW", envConfig.ReplayWindow),
+			intFlagIfPassed("replay-window", *replayWindow),
+			jsonConfig.ReplayWindow,
+		)) * time.Second,
+		NonceCacheSize: coalesceIntPtr(
+			DefaultNonceCacheSize,
+			lookupIntEnv("NONCE_CACHE_SIZE", envConfig.NonceCacheSize),
+			intFlagIfPassed("nonce-cache-size", *nonceCacheSize),
+			jsonConfig.NonceCacheSize,
+		),
+		// Строгий режим включается любым источником настроек: отключить его, задав
+		// false в источнике с большим приоритетом, нельзя.
+		StrictAuth: envConfig.StrictAuth || *strictAuth || jsonConfig.StrictAuth || DefaultStrictAuth,
+		AllowUnauthenticatedIngest: envConfig.AllowUnauthenticatedIngest || *allowUnauthenticatedIngest ||
+			jsonConfig.AllowUnauthenticatedIngest || DefaultAllowUnauthenticatedIngest,
 	}
 }
 
@@ -168,6 +303,35 @@ func coalesceBoolPtr(values ...bool) bool {
 	return false
 }
 
+// coalesceIntPtr возвращает первое заданное значение, а если не задано ни одно - def.
+func coalesceIntPtr(def int, values ...*int) int {
+	for _, v := range values {
+		if v != nil {
+			return *v
+		}
+	}
+	return def
+}
+
+// lookupIntEnv возвращает val, только если переменная окружения name задана.
+func lookupIntEnv(name string, val int) *int {
+	if _, found := os.LookupEnv(name); found {
+		return &val
+	}
+	return nil
+}
+
+// intFlagIfPassed возвращает val, только если флаг name передан в командной строке.
+func intFlagIfPassed(name string, val int) *int {
+	var passed *int
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = &val
+		}
+	})
+	return passed
+}
+
 func lookupBoolEnv(name string, val bool) bool {
 	_, found := os.LookupEnv(name)
 	if found {
@@ -0,0 +1,136 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/middleware"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	pb "github.com/lenarlenar/go-my-metrics-service/internal/proto"
+	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/service"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsServer реализует gRPC-сервис Metrics поверх той же бизнес-логики, что и HTTP-хендлеры.
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	metricsService *service.MetricsService
+}
+
+// grpcRoles - роли, нужные для вызова методов сервиса Metrics.
+var grpcRoles = map[string]middleware.Role{
+	pb.Metrics_Update_FullMethodName:       middleware.RoleWriter,
+	pb.Metrics_UpdateBatch_FullMethodName:  middleware.RoleWriter,
+	pb.Metrics_UpdateStream_FullMethodName: middleware.RoleWriter,
+	pb.Metrics_Value_FullMethodName:        middleware.RoleReader,
+}
+
+// NewGRPC создает gRPC-сервер с зарегистрированным сервисом Metrics. Вызовы проверяются
+// по тем же правилам аутентификации, что и запросы HTTP (см. middleware.GRPCAuth).
+func NewGRPC(
+	config flags.Config,
+	metricsService *service.MetricsService,
+	tenants *tenant.Registry,
+	roles *middleware.RoleTokens,
+	opts ...grpc.ServerOption,
+) *grpc.Server {
+	auth := middleware.NewGRPCAuth(middleware.AuthPolicy{
+		Key:    config.Key,
+		Replay: replayGuard(config),
+		Strict: config.StrictAuth,
+	}, roles, tenants, grpcRoles)
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(auth.UnaryInterceptor()),
+		grpc.ChainStreamInterceptor(auth.StreamInterceptor()),
+	)
+	server := grpc.NewServer(opts...)
+	pb.RegisterMetricsServer(server, &MetricsServer{metricsService: metricsService})
+	return server
+}
+
+// Update обновляет одну метрику и возвращает её актуальное значение.
+func (s *MetricsServer) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	metric := pb.ToModel(req.GetMetric())
+	if err := s.metricsService.Update(ctx, metric); err != nil {
+		return nil, toStatus(err)
+	}
+
+	updated, err := s.metricsService.Value(ctx, metric.MType, metric.ID, metric.Labels)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.UpdateResponse{Metric: pb.FromModel(updated)}, nil
+}
+
+// UpdateBatch обновляет пачку метрик.
+func (s *MetricsServer) UpdateBatch(ctx context.Context, req *pb.UpdateBatchRequest) (*pb.UpdateBatchResponse, error) {
+	metrics := pb.ToModelBatch(req.GetMetrics())
+	if err := s.metricsService.UpdateBatch(ctx, metrics); err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.UpdateBatchResponse{Accepted: int64(len(metrics))}, nil
+}
+
+// maxStreamMetrics - максимальное число метрик в одном потоке UpdateStream.
+const maxStreamMetrics = 100_000
+
+// UpdateStream принимает пачки метрик из потока, пока клиент его не закроет,
+// и применяет их одной пачкой. Если поток прервался или одна из пачек неверна,
+// не применяется ничего, поэтому агент может повторить отправку целиком,
+// не задваивая приращения counter.
+func (s *MetricsServer) UpdateStream(stream grpc.ClientStreamingServer[pb.UpdateBatchRequest, pb.UpdateBatchResponse]) error {
+	metrics := make([]model.Metrics, 0)
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		metrics = append(metrics, pb.ToModelBatch(req.GetMetrics())...)
+		if len(metrics) > maxStreamMetrics {
+			return status.Errorf(codes.ResourceExhausted, "в потоке больше %d метрик", maxStreamMetrics)
+		}
+	}
+
+	if err := s.metricsService.UpdateBatch(stream.Context(), metrics); err != nil {
+		return toStatus(err)
+	}
+	return stream.SendAndClose(&pb.UpdateBatchResponse{Accepted: int64(len(metrics))})
+}
+
+// Value возвращает метрику по типу и имени.
+func (s *MetricsServer) Value(ctx context.Context, req *pb.ValueRequest) (*pb.ValueResponse, error) {
+	var labels model.Labels
+	if len(req.GetLabels()) > 0 {
+		labels = req.GetLabels()
+	}
+	metric, err := s.metricsService.Value(ctx, pb.MTypeToModel(req.GetType()), req.GetId(), labels)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.ValueResponse{Metric: pb.FromModel(metric)}, nil
+}
+
+// toStatus переводит ошибки бизнес-логики в коды gRPC.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, interfaces.ErrStorageUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, service.ErrMetricNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, service.ErrUnknownMetricType), errors.Is(err, service.ErrMissingValue),
+		errors.Is(err, service.ErrInvalidLabel), errors.Is(err, service.ErrEmptyName),
+		errors.Is(err, model.ErrInvalidName):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,270 @@
+package router
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/middleware"
+	pb "github.com/lenarlenar/go-my-metrics-service/internal/proto"
+	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/service"
+	"github.com/lenarlenar/go-my-metrics-service/internal/signature"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestClient запускает gRPC-сервер с хранилищем в памяти и переданной конфигурацией
+// и возвращает клиента к нему.
+func newTestClient(t *testing.T, config flags.Config) pb.MetricsClient {
+	t.Helper()
+	tenants, err := tenant.NewRegistry(config.Tenants)
+	require.NoError(t, err)
+	roles, err := middleware.NewRoleTokens(config.Tokens, tenants)
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewGRPC(config, service.NewService(tenant.NewStorage(storage.NewMemStorage())), tenants, roles)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewMetricsClient(conn)
+}
+
+// signedContext подписывает сообщения вызова method ключом key так же, как агент.
+func signedContext(t *testing.T, key, method string, msgs ...proto.Message) context.Context {
+	t.Helper()
+	timestamp := signature.Timestamp(time.Now())
+	nonce, err := signature.NewNonce()
+	require.NoError(t, err)
+	mac := signature.New([]byte(key), timestamp, nonce, signature.Target(signature.GRPCMethod, method))
+	for _, m := range msgs {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+		require.NoError(t, err)
+		mac.Write(data)
+	}
+	return metadata.AppendToOutgoingContext(context.Background(),
+		signature.TimestampHeader, timestamp,
+		signature.NonceHeader, nonce,
+		"HashSHA256", hex.EncodeToString(mac.Sum(nil)),
+	)
+}
+
+func TestGRPCUpdateStream(t *testing.T) {
+	client := newTestClient(t, flags.Config{})
+	ctx := context.Background()
+
+	stream, err := client.UpdateStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err = stream.Send(&pb.UpdateBatchRequest{Metrics: []*pb.Metric{
+			{Id: "Alloc", Type: pb.Metric_GAUGE, Value: 1.5},
+			{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: 3},
+		}})
+		require.NoError(t, err)
+	}
+	resp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), resp.GetAccepted())
+
+	value, err := client.Value(ctx, &pb.ValueRequest{Id: "PollCount", Type: pb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), value.GetMetric().GetDelta())
+
+	value, err = client.Value(ctx, &pb.ValueRequest{Id: "Alloc", Type: pb.Metric_GAUGE})
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value.GetMetric().GetValue())
+}
+
+func TestGRPCErrors(t *testing.T) {
+	client := newTestClient(t, flags.Config{})
+	ctx := context.Background()
+
+	_, err := client.Value(ctx, &pb.ValueRequest{Id: "unknown", Type: pb.Metric_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.Value(ctx, &pb.ValueRequest{Id: "unknown"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.UpdateBatch(ctx, &pb.UpdateBatchRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.Metric_GAUGE, Value: 1},
+		{Id: "bad"},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Value(ctx, &pb.ValueRequest{Id: "Alloc", Type: pb.Metric_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err), "пачка с ошибкой не должна применяться частично")
+}
+
+func TestGRPCUpdateStreamAtomic(t *testing.T) {
+	client := newTestClient(t, flags.Config{})
+	ctx := context.Background()
+
+	stream, err := client.UpdateStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.UpdateBatchRequest{Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: 3},
+	}}))
+	require.NoError(t, stream.Send(&pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "bad"}}}))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Приращение из первой пачки не применено, повторная отправка потока его не задвоит.
+	_, err = client.Value(ctx, &pb.ValueRequest{Id: "PollCount", Type: pb.Metric_COUNTER})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	client := newTestClient(t, flags.Config{Key: "secret", ReplayWindow: time.Minute, NonceCacheSize: 10})
+	req := &pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: 1}}}
+
+	_, err := client.UpdateBatch(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := signedContext(t, "secret", pb.Metrics_UpdateBatch_FullMethodName, req)
+	_, err = client.UpdateBatch(ctx, req)
+	require.NoError(t, err)
+	// Повтор принятого вызова не применяется второй раз.
+	_, err = client.UpdateBatch(ctx, req)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// Подпись другого метода или другим ключом не подходит.
+	_, err = client.UpdateBatch(signedContext(t, "secret", pb.Metrics_Update_FullMethodName, req), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.UpdateBatch(signedContext(t, "other", pb.Metrics_UpdateBatch_FullMethodName, req), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Чтение политика не затрагивает.
+	value, err := client.Value(context.Background(), &pb.ValueRequest{Id: "PollCount", Type: pb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value.GetMetric().GetDelta())
+}
+
+func TestGRPCAuthenticationStream(t *testing.T) {
+	client := newTestClient(t, flags.Config{Key: "secret", ReplayWindow: time.Minute, NonceCacheSize: 10})
+	chunks := []*pb.UpdateBatchRequest{
+		{Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: 3}}},
+		{Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: 100}}},
+	}
+	send := func(ctx context.Context) error {
+		stream, err := client.UpdateStream(ctx)
+		require.NoError(t, err)
+		for _, chunk := range chunks {
+			require.NoError(t, stream.Send(chunk))
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+
+	// Подписана только первая пачка: поток отклоняется целиком.
+	err := send(signedContext(t, "secret", pb.Metrics_UpdateStream_FullMethodName, chunks[0]))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.Value(context.Background(), &pb.ValueRequest{Id: "PollCount", Type: pb.Metric_COUNTER})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	err = send(signedContext(t, "secret", pb.Metrics_UpdateStream_FullMethodName, chunks[0], chunks[1]))
+	require.NoError(t, err)
+	value, err := client.Value(context.Background(), &pb.ValueRequest{Id: "PollCount", Type: pb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(103), value.GetMetric().GetDelta())
+}
+
+func TestGRPCStrictAuthentication(t *testing.T) {
+	client := newTestClient(t, flags.Config{
+		StrictAuth: true,
+		Tenants:    []tenant.Config{{ID: "payments", Token: "payments-token"}},
+	})
+	req := &pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "Alloc", Type: pb.Metric_GAUGE, Value: 1}}}
+
+	_, err := client.UpdateBatch(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.UpdateBatch(signedContext(t, "any", pb.Metrics_UpdateBatch_FullMethodName, req), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	bad := metadata.AppendToOutgoingContext(context.Background(), "Authorization", "Bearer unknown")
+	_, err = client.UpdateBatch(bad, req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Токен арендатора подтверждает вызов, метрики попадают к арендатору.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "Authorization", "Bearer payments-token")
+	_, err = client.UpdateBatch(ctx, req)
+	require.NoError(t, err)
+	_, err = client.Value(ctx, &pb.ValueRequest{Id: "Alloc", Type: pb.Metric_GAUGE})
+	require.NoError(t, err)
+	_, err = client.Value(context.Background(), &pb.ValueRequest{Id: "Alloc", Type: pb.Metric_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCRoles(t *testing.T) {
+	client := newTestClient(t, flags.Config{
+		Tenants: []tenant.Config{{ID: "payments", Token: "payments-token"}},
+		Tokens: []middleware.TokenConfig{
+			{Token: "reader-token", Role: "reader"},
+			{Token: "writer-token", Role: "writer"},
+			{Token: "admin-token", Role: "admin"},
+			{Token: "payments-reader", Role: "reader", Tenant: "payments"},
+		},
+	})
+	withToken := func(token string, kv ...string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), append([]string{"Authorization", "Bearer " + token}, kv...)...)
+	}
+	req := &pb.UpdateBatchRequest{Metrics: []*pb.Metric{{Id: "Alloc", Type: pb.Metric_GAUGE, Value: 1}}}
+	value := &pb.ValueRequest{Id: "Alloc", Type: pb.Metric_GAUGE}
+	stream := func(ctx context.Context) error {
+		s, err := client.UpdateStream(ctx)
+		require.NoError(t, err)
+		require.NoError(t, s.Send(req))
+		_, err = s.CloseAndRecv()
+		return err
+	}
+
+	_, err := client.Value(context.Background(), value)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.UpdateBatch(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Читателю доступно только чтение.
+	_, err = client.Value(withToken("reader-token"), value)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.UpdateBatch(withToken("reader-token"), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Update(withToken("reader-token"), &pb.UpdateRequest{Metric: req.GetMetrics()[0]})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, codes.PermissionDenied, status.Code(stream(withToken("reader-token"))))
+
+	_, err = client.UpdateBatch(withToken("writer-token"), req)
+	require.NoError(t, err)
+	_, err = client.Value(withToken("writer-token"), value)
+	require.NoError(t, err)
+
+	// Токен арендатора пишет метрики арендатора; токен роли, привязанный к арендатору,
+	// видит только их, администратор выбирает арендатора метаданными.
+	require.NoError(t, stream(withToken("payments-token")))
+	_, err = client.Value(withToken("payments-reader", tenant.Header, "search"), value)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Value(withToken("reader-token", tenant.Header, "payments"), value)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Value(withToken("payments-reader"), value)
+	require.NoError(t, err)
+	_, err = client.Value(withToken("admin-token", tenant.Header, "payments"), value)
+	require.NoError(t, err)
+}
@@ -5,35 +5,87 @@ import (
 	"crypto/rsa"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/alerting"
 	"github.com/lenarlenar/go-my-metrics-service/internal/middleware"
 	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
 	"github.com/lenarlenar/go-my-metrics-service/internal/service"
+	"github.com/lenarlenar/go-my-metrics-service/internal/signature"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
 )
 
 // New создает новый экземпляр роутера с зарегистрированными маршрутами и middleware.
-func New(config flags.Config, metricsService *service.MetricsService, rsaKey *rsa.PrivateKey) *gin.Engine {
+func New(
+	config flags.Config,
+	metricsService *service.MetricsService,
+	rsaKey *rsa.PrivateKey,
+	alertEngine *alerting.Engine,
+	tenants *tenant.Registry,
+	roles *middleware.RoleTokens,
+) *gin.Engine {
 	router := gin.New()
 
-	// Подключение middleware: логирование и gzip
+	// Подключение middleware: логирование, gzip, определение роли и арендатора
 	router.Use(middleware.Logger())
 	router.Use(middleware.GzipCompression())
 	router.Use(middleware.GzipUnpack())
+	router.Use(middleware.Roles(roles, tenants))
+	router.Use(middleware.Tenants(tenants))
 
-	// Группа роутов с проверкой подписи
-	updatesGroup := router.Group("/updates")
-	updatesGroup.Use(middleware.CheckHash(config.Key))
-	updatesGroup.Use(middleware.RSADecrypt(rsaKey))
+	// Записи и администрирование используют общий кэш одноразовых значений.
+	authenticate := middleware.Authenticate(middleware.AuthPolicy{
+		Key:    config.Key,
+		Replay: replayGuard(config),
+		Strict: config.StrictAuth,
+	})
+
+	// Все изменяющие маршруты проходят одну цепочку. Агент подписывает JSON, сжимает
+	// и шифрует его, поэтому слои снимаются в обратном порядке: расшифровка, распаковка,
+	// аутентификация.
+	writes := router.Group("")
+	writes.Use(middleware.RSADecrypt(rsaKey))
+	writes.Use(middleware.GzipUnpack())
+	writes.Use(authenticate)
+	writes.Use(middleware.RequireRole(roles, middleware.RoleWriter))
+	{
+		writes.POST("/updates/", metricsService.UpdateBatchHandler)
+		writes.POST("/update/", metricsService.UpdateJSONHandler)
+		writes.POST("/update/:type/:name/:value", metricsService.UpdateHandler)
+	}
+
+	// Удаление и сброс метрик доступны только по токену администратора,
+	// без него маршруты отвечают 403 при любых настройках аутентификации.
+	admin := router.Group("")
+	admin.Use(authenticate)
+	admin.Use(middleware.RequireConfiguredRole(roles, middleware.RoleAdmin))
+	{
+		admin.DELETE("/value/:type/:name", metricsService.DeleteHandler)
+		admin.POST("/delete/", metricsService.DeleteBatchHandler)
+		admin.POST("/reset/counter/:name", metricsService.ResetCounterHandler)
+	}
+
+	// Маршруты чтения
+	reads := router.Group("")
+	reads.Use(middleware.RequireRole(roles, middleware.RoleReader))
 	{
-		updatesGroup.POST("/", metricsService.UpdateBatchHandler)
+		reads.GET("/", metricsService.IndexHandler)
+		reads.GET("/metrics", metricsService.PrometheusHandler)
+		reads.GET("/alerts", alertEngine.AlertsHandler)
+		reads.POST("/value/", metricsService.ValueJSONHandler)
+		reads.GET("/value/:type/:name/", metricsService.ValueHandler)
+		reads.GET("/history/:type/:name", metricsService.HistoryHandler)
 	}
 
-	// Общие маршруты
-	router.GET("/", metricsService.IndexHandler)
+	// Проверка доступности открыта всем
 	router.GET("/ping", metricsService.PingHandler)
-	router.POST("/value/", metricsService.ValueJSONHandler)
-	router.POST("/update/", metricsService.UpdateJSONHandler)
-	router.GET("/value/:type/:name/", metricsService.ValueHandler)
-	router.POST("/update/:type/:name/:value", metricsService.UpdateHandler)
 
 	return router
 }
+
+// replayGuard создает защиту от повторных запросов. Без окна метка времени
+// подписанного запроса проверяется только подписью.
+func replayGuard(config flags.Config) *signature.ReplayGuard {
+	if config.ReplayWindow <= 0 || config.NonceCacheSize <= 0 {
+		return nil
+	}
+	return signature.NewReplayGuard(config.ReplayWindow, config.NonceCacheSize)
+}
@@ -0,0 +1,284 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/alerting"
+	"github.com/lenarlenar/go-my-metrics-service/internal/middleware"
+	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/service"
+	"github.com/lenarlenar/go-my-metrics-service/internal/signature"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRouter создает роутер с хранилищем в памяти и переданной конфигурацией.
+func newTestRouter(t *testing.T, config flags.Config) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s := storage.NewMemStorage()
+	engine, err := alerting.NewEngine(s, nil)
+	require.NoError(t, err)
+	tenants, err := tenant.NewRegistry(config.Tenants)
+	require.NoError(t, err)
+	roles, err := middleware.NewRoleTokens(config.Tokens, tenants)
+	require.NoError(t, err)
+	return New(config, service.NewService(tenant.NewStorage(s)), nil, engine, tenants, roles)
+}
+
+func sign(body, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(body))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestTenants(t *testing.T) {
+	r := newTestRouter(t, flags.Config{Tenants: []tenant.Config{
+		{ID: "payments", Key: "payments-key"},
+		{ID: "search", Token: "search-token"},
+	}})
+
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Арендатор с ключом подписывает пачку.
+	body := `[{"id":"Alloc","type":"gauge","value":1}]`
+	w := do(http.MethodPost, "/updates/", body, map[string]string{
+		"Content-Type": "application/json",
+		tenant.Header:  "payments",
+		"HashSHA256":   sign(body, "payments-key"),
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Арендатор с токеном пишет и читает свою метрику с тем же именем.
+	search := map[string]string{"Authorization": "Bearer search-token"}
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/2", "", search).Code)
+	w = do(http.MethodGet, "/value/gauge/Alloc/", "", search)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Body.String())
+
+	// Метрики арендаторов не видны запросам по умолчанию.
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/value/gauge/Alloc/", "", nil).Code)
+
+	// Подпись чужим ключом, неизвестный токен и чтение без подтверждения отклоняются.
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/updates/", body, map[string]string{
+		"Content-Type": "application/json",
+		tenant.Header:  "payments",
+		"HashSHA256":   sign(body, "other-key"),
+	}).Code)
+	assert.Equal(t, http.StatusUnauthorized,
+		do(http.MethodGet, "/value/gauge/Alloc/", "", map[string]string{"Authorization": "Bearer wrong"}).Code)
+	assert.Equal(t, http.StatusUnauthorized,
+		do(http.MethodGet, "/value/gauge/Alloc/", "", map[string]string{tenant.Header: "payments"}).Code)
+	assert.Equal(t, http.StatusUnauthorized,
+		do(http.MethodGet, "/value/gauge/Alloc/", "", map[string]string{tenant.Header: "search"}).Code)
+}
+
+func TestReplayProtection(t *testing.T) {
+	r := newTestRouter(t, flags.Config{Key: "secret", ReplayWindow: time.Minute, NonceCacheSize: 100})
+
+	body := `[{"id":"PollCount","type":"counter","delta":1}]`
+	post := func(headers map[string]string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	signed := func(ts time.Time, nonce string) map[string]string {
+		timestamp := signature.Timestamp(ts)
+		return map[string]string{
+			signature.TimestampHeader: timestamp,
+			signature.NonceHeader:     nonce,
+			"HashSHA256":              signature.Sign([]byte("secret"), timestamp, nonce, "POST /updates/", []byte(body)),
+		}
+	}
+
+	headers := signed(time.Now(), "n1")
+	assert.Equal(t, http.StatusOK, post(headers))
+	assert.Equal(t, http.StatusUnauthorized, post(headers))
+	assert.Equal(t, http.StatusOK, post(signed(time.Now(), "n2")))
+	assert.Equal(t, http.StatusUnauthorized, post(signed(time.Now().Add(-time.Hour), "n3")))
+
+	// Подмена метки времени ломает подпись.
+	headers = signed(time.Now(), "n4")
+	headers[signature.TimestampHeader] = signature.Timestamp(time.Now().Add(time.Second))
+	assert.Equal(t, http.StatusBadRequest, post(headers))
+
+	// Старые агенты подписывают только тело.
+	assert.Equal(t, http.StatusOK, post(map[string]string{"HashSHA256": sign(body, "secret")}))
+
+	// Отклонённый запрос можно повторить с тем же nonce: повтором он не считается.
+	invalid := `[{"id":"PollCount","type":"histogram"}]`
+	timestamp := signature.Timestamp(time.Now())
+	headers = map[string]string{
+		signature.TimestampHeader: timestamp,
+		signature.NonceHeader:     "n5",
+		"HashSHA256":              signature.Sign([]byte("secret"), timestamp, "n5", "POST /updates/", []byte(invalid)),
+	}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(invalid))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestWriteAuthentication(t *testing.T) {
+	post := func(r *gin.Engine, path string, headers map[string]string, state *tls.ConnectionState) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.TLS = state
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	signed := func(key, target string) map[string]string {
+		timestamp := signature.Timestamp(time.Now())
+		nonce, err := signature.NewNonce()
+		require.NoError(t, err)
+		return map[string]string{
+			signature.TimestampHeader: timestamp,
+			signature.NonceHeader:     nonce,
+			"HashSHA256":              signature.Sign([]byte(key), timestamp, nonce, target, nil),
+		}
+	}
+	clientCert := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+	const path = "/update/gauge/Alloc/1"
+
+	// Без ключа и строгого режима запись открыта, как раньше.
+	r := newTestRouter(t, flags.Config{})
+	assert.Equal(t, http.StatusOK, post(r, path, nil, nil))
+
+	// С ключом подпись нужна на всех изменяющих маршрутах, а не только на /updates/.
+	r = newTestRouter(t, flags.Config{Key: "secret"})
+	assert.Equal(t, http.StatusUnauthorized, post(r, path, nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, post(r, "/update/", nil, nil))
+	assert.Equal(t, http.StatusOK, post(r, path, signed("secret", "POST "+path), nil))
+	assert.Equal(t, http.StatusOK, post(r, path, map[string]string{"HashSHA256": sign("", "secret")}, nil))
+	// Подпись другого пути не подходит: данные метрики передаются в URL.
+	assert.Equal(t, http.StatusBadRequest, post(r, "/update/gauge/Alloc/100", signed("secret", "POST "+path), nil))
+	assert.Equal(t, http.StatusOK, post(r, path, nil, clientCert("agent")))
+	// Чтение политика не затрагивает.
+	assert.Equal(t, http.StatusOK, statusOf(r, http.MethodGet, "/value/gauge/Alloc/"))
+
+	// Строгий режим не пропускает запросы без подтверждения и подпись без метки времени.
+	r = newTestRouter(t, flags.Config{StrictAuth: true})
+	assert.Equal(t, http.StatusUnauthorized, post(r, path, nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, post(r, path, map[string]string{"HashSHA256": sign("", "any")}, nil))
+	assert.Equal(t, http.StatusOK, post(r, path, nil, clientCert("agent")))
+
+	r = newTestRouter(t, flags.Config{Key: "secret", StrictAuth: true})
+	assert.Equal(t, http.StatusUnauthorized, post(r, path, map[string]string{"HashSHA256": sign("", "secret")}, nil))
+	assert.Equal(t, http.StatusOK, post(r, path, signed("secret", "POST "+path), nil))
+
+	// Сертификат с CN арендатора подтверждает арендатора без ключа.
+	r = newTestRouter(t, flags.Config{StrictAuth: true, Tenants: []tenant.Config{{ID: "payments", Token: "t"}}})
+	tenantHeader := map[string]string{tenant.Header: "payments"}
+	assert.Equal(t, http.StatusOK, post(r, path, tenantHeader, clientCert("payments")))
+	assert.Equal(t, http.StatusUnauthorized, post(r, path, tenantHeader, clientCert("search")))
+}
+
+// statusOf выполняет запрос без тела и возвращает код ответа.
+func statusOf(r *gin.Engine, method, path string) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code
+}
+
+func TestRoles(t *testing.T) {
+	r := newTestRouter(t, flags.Config{
+		Key:     "secret",
+		Tenants: []tenant.Config{{ID: "payments", Token: "payments-token"}},
+		Tokens: []middleware.TokenConfig{
+			{Token: "dashboard", Role: "reader"},
+			{Token: "payments-dashboard", Role: "reader", Tenant: "payments"},
+			{Token: "ops", Role: "admin"},
+		},
+	})
+	send := func(method, path string, headers map[string]string) int {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	bearer := func(token string) map[string]string { return map[string]string{"Authorization": "Bearer " + token} }
+
+	// Агент пишет с подписью, агент арендатора - со своим токеном.
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/update/gauge/Alloc/1",
+		map[string]string{"HashSHA256": sign("", "secret")}))
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/update/gauge/Alloc/2", bearer("payments-token")))
+
+	// Дашборд читает, но не пишет; без токена чтение закрыто, /ping открыт.
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/value/gauge/Alloc/", bearer("dashboard")))
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/", bearer("dashboard")))
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/update/gauge/Alloc/3", bearer("dashboard")))
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/value/gauge/Alloc/", nil))
+	// MemStorage не поддерживает Ping, важно лишь, что запрос дошёл до хендлера.
+	assert.Equal(t, http.StatusInternalServerError, send(http.MethodGet, "/ping", nil))
+
+	// Токен арендатора читает только его метрики, чужого арендатора выбрать нельзя.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/value/gauge/Alloc/", nil)
+	req.Header.Set("Authorization", "Bearer payments-dashboard")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "2", w.Body.String())
+	assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "/value/gauge/Alloc/",
+		map[string]string{"Authorization": "Bearer dashboard", tenant.Header: "payments"}))
+
+	// Администратор выбирает арендатора заголовком.
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/value/gauge/Alloc/",
+		map[string]string{"Authorization": "Bearer ops", tenant.Header: "payments"}))
+
+	// Удалять метрики может только администратор, подписи агента недостаточно.
+	assert.Equal(t, http.StatusForbidden, send(http.MethodDelete, "/value/gauge/Alloc",
+		map[string]string{"HashSHA256": sign("", "secret")}))
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodDelete, "/value/gauge/Alloc", bearer("dashboard")))
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/value/gauge/Alloc",
+		map[string]string{"Authorization": "Bearer ops", tenant.Header: "payments"}))
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/value/gauge/Alloc/", bearer("payments-dashboard")))
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/value/gauge/Alloc/", bearer("dashboard")))
+}
+
+func TestAdminRoutesWithoutAdminToken(t *testing.T) {
+	// Без токена администратора удаление закрыто, даже когда запись открыта всем.
+	r := newTestRouter(t, flags.Config{})
+	require.Equal(t, http.StatusOK, statusOf(r, http.MethodPost, "/update/gauge/Alloc/1"))
+	assert.Equal(t, http.StatusForbidden, statusOf(r, http.MethodDelete, "/value/gauge/Alloc"))
+	assert.Equal(t, http.StatusForbidden, statusOf(r, http.MethodPost, "/reset/counter/PollCount"))
+	assert.Equal(t, http.StatusOK, statusOf(r, http.MethodGet, "/value/gauge/Alloc/"))
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+// ErrEmptyDeleteRequest возвращается, если в запросе массового удаления не заданы ни префикс, ни метрики.
+// Пустой префикс не означает «удалить всё», чтобы случайный запрос не очистил хранилище.
+var ErrEmptyDeleteRequest = errors.New("prefix or metrics must be set")
+
+// DeleteRequest - запрос массового удаления метрик. Удаляются метрики из списка Metrics
+// (значения не нужны) и все метрики, имя которых начинается с Prefix.
+type DeleteRequest struct {
+	Prefix  string          `json:"prefix,omitempty"`
+	Metrics []model.Metrics `json:"metrics,omitempty"`
+}
+
+// DeleteResponse - ответ на запрос массового удаления.
+type DeleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// Delete удаляет метрику вместе с историей.
+// Возвращает ErrUnknownMetricType для неизвестного типа и ErrMetricNotFound, если метрики нет.
+func (s *MetricsService) Delete(ctx context.Context, mType, id string, labels model.Labels) error {
+	if !validType(mType) {
+		return ErrUnknownMetricType
+	}
+	deleted, err := s.storage.Delete(ctx, mType, id, labels)
+	if err != nil {
+		return fmt.Errorf("ошибка при удалении метрики %q: %w", id, err)
+	}
+	if !deleted {
+		return ErrMetricNotFound
+	}
+	return nil
+}
+
+// DeleteBatch удаляет метрики из запроса и возвращает число удалённых.
+// Отсутствующие метрики из списка пропускаются.
+func (s *MetricsService) DeleteBatch(ctx context.Context, request DeleteRequest) (int, error) {
+	if request.Prefix == "" && len(request.Metrics) == 0 {
+		return 0, ErrEmptyDeleteRequest
+	}
+	for _, metric := range request.Metrics {
+		if !validType(metric.MType) {
+			return 0, fmt.Errorf("metric %q: %w", metric.ID, ErrUnknownMetricType)
+		}
+	}
+
+	total := 0
+	for _, metric := range request.Metrics {
+		deleted, err := s.storage.Delete(ctx, metric.MType, metric.ID, metric.Labels)
+		if err != nil {
+			return total, fmt.Errorf("ошибка при удалении метрики %q: %w", metric.ID, err)
+		}
+		if deleted {
+			total++
+		}
+	}
+	if request.Prefix != "" {
+		deleted, err := s.storage.DeleteByPrefix(ctx, request.Prefix)
+		if err != nil {
+			return total, fmt.Errorf("ошибка при удалении метрик с префиксом %q: %w", request.Prefix, err)
+		}
+		total += deleted
+	}
+	return total, nil
+}
+
+// ResetCounter обнуляет counter. Возвращает ErrMetricNotFound, если counter нет.
+func (s *MetricsService) ResetCounter(ctx context.Context, id string, labels model.Labels) error {
+	reset, err := s.storage.ResetCounter(ctx, id, labels)
+	if err != nil {
+		return fmt.Errorf("ошибка при сбросе counter %q: %w", id, err)
+	}
+	if !reset {
+		return ErrMetricNotFound
+	}
+	return nil
+}
+
+// DeleteHandler удаляет метрику по типу и имени из URL.
+// Метки временного ряда задаются параметром labels в формате k1=v1,k2=v2.
+func (s *MetricsService) DeleteHandler(c *gin.Context) {
+	labels, err := model.ParseLabels(c.Query("labels"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid labels: "+err.Error())
+		return
+	}
+	if err := s.Delete(c.Request.Context(), c.Param("type"), c.Param("name"), labels); err != nil {
+		writeError(c, err)
+		return
+	}
+
+	c.String(http.StatusOK, "Запрос успешно обработан")
+}
+
+// DeleteBatchHandler удаляет метрики по JSON-запросу DeleteRequest.
+func (s *MetricsService) DeleteBatchHandler(c *gin.Context) {
+	var request DeleteRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deleted, err := s.DeleteBatch(c.Request.Context(), request)
+	if err != nil {
+		writeJSONError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, DeleteResponse{Deleted: deleted})
+}
+
+// ResetCounterHandler обнуляет counter по имени из URL.
+// Метки временного ряда задаются параметром labels в формате k1=v1,k2=v2.
+func (s *MetricsService) ResetCounterHandler(c *gin.Context) {
+	labels, err := model.ParseLabels(c.Query("labels"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid labels: "+err.Error())
+		return
+	}
+	if err := s.ResetCounter(c.Request.Context(), c.Param("name"), labels); err != nil {
+		writeError(c, err)
+		return
+	}
+
+	c.String(http.StatusOK, "Запрос успешно обработан")
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+// defaultHistoryRange - интервал истории по умолчанию, если параметр from не задан.
+const defaultHistoryRange = time.Hour
+
+// HistoryResponse - ответ на запрос истории метрики.
+type HistoryResponse struct {
+	ID     string         `json:"id"`
+	MType  string         `json:"type"`
+	Labels model.Labels   `json:"labels,omitempty"`
+	Step   string         `json:"step,omitempty"`
+	Points []model.Sample `json:"points"`
+}
+
+// HistoryHandler возвращает историю значений метрики.
+// Параметры запроса:
+//   - from, to — границы интервала в формате RFC3339 или unix-секундах (по умолчанию последний час);
+//   - step — шаг прореживания в формате time.Duration или в секундах (по умолчанию без прореживания);
+//   - labels — метки временного ряда в формате k1=v1,k2=v2.
+func (s *MetricsService) HistoryHandler(c *gin.Context) {
+	metricType := c.Param("type")
+	metricName := c.Param("name")
+	if metricType != "gauge" && metricType != "counter" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrUnknownMetricType.Error()})
+		return
+	}
+
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+			return
+		}
+		to = t
+	}
+
+	from := to.Add(-defaultHistoryRange)
+	if v := c.Query("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+			return
+		}
+		from = t
+	}
+
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+		return
+	}
+
+	var step time.Duration
+	if v := c.Query("step"); v != "" {
+		d, err := parseStep(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid step: " + err.Error()})
+			return
+		}
+		step = d
+	}
+
+	labels, err := model.ParseLabels(c.Query("labels"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid labels: " + err.Error()})
+		return
+	}
+
+	samples, err := s.storage.GetHistory(c.Request.Context(), metricType, metricName, labels, from, to)
+	if err != nil {
+		writeJSONError(c, err)
+		return
+	}
+	response := HistoryResponse{ID: metricName, MType: metricType, Labels: labels, Points: samples}
+	if step > 0 {
+		response.Step = step.String()
+		response.Points = Downsample(metricType, samples, from, step)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Downsample группирует значения в интервалы длины step, начиная с from.
+// Для gauge в точку попадает среднее значение за интервал, для counter — сумма приращений.
+// Время точки — начало интервала; пустые интервалы пропускаются.
+func Downsample(mType string, samples []model.Sample, from time.Time, step time.Duration) []model.Sample {
+	points := make([]model.Sample, 0)
+	if step <= 0 {
+		return points
+	}
+
+	var (
+		bucket int64 = -1
+		sum    float64
+		count  int
+	)
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		value := sum
+		if mType == "gauge" {
+			value = sum / float64(count)
+		}
+		points = append(points, model.Sample{
+			Timestamp: from.Add(time.Duration(bucket) * step),
+			Value:     value,
+		})
+	}
+
+	for _, sample := range samples {
+		b := int64(sample.Timestamp.Sub(from) / step)
+		if b != bucket {
+			flush()
+			bucket, sum, count = b, 0, 0
+		}
+		sum += sample.Value
+		count++
+	}
+	flush()
+
+	return points
+}
+
+// parseTime разбирает время в формате RFC3339 или unix-секундах.
+func parseTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parseStep разбирает шаг в формате time.Duration ("30s", "5m") или в секундах.
+func parseStep(v string) (time.Duration, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
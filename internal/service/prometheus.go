@@ -0,0 +1,160 @@
+package service
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+const (
+	// prometheusContentType - Content-Type текстового формата Prometheus 0.0.4.
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// openMetricsContentType - Content-Type формата OpenMetrics 1.0.0.
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// PrometheusHandler отдаёт все метрики в текстовом формате экспозиции Prometheus.
+// Если клиент указал в Accept application/openmetrics-text, ответ формируется в формате OpenMetrics.
+func (s *MetricsService) PrometheusHandler(c *gin.Context) {
+	openMetrics := strings.Contains(c.GetHeader("Accept"), "application/openmetrics-text")
+
+	type series struct {
+		metric model.Metrics
+		family string
+		labels string
+		value  string
+	}
+
+	metrics, err := s.storage.GetMetrics(c.Request.Context())
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	all := make([]series, 0)
+	for _, m := range metrics {
+		family := SanitizeMetricName(m.ID)
+
+		var value string
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			value = strconv.FormatFloat(*m.Value, 'g', -1, 64)
+		case m.MType == "counter" && m.Delta != nil:
+			value = strconv.FormatInt(*m.Delta, 10)
+			// По соглашению имена счётчиков оканчиваются на _total.
+			// В OpenMetrics суффикс есть только у значения, но не у семейства.
+			family = strings.TrimSuffix(family, "_total")
+			if !openMetrics {
+				family += "_total"
+			}
+		default:
+			continue
+		}
+
+		all = append(all, series{metric: m, family: family, labels: formatLabels(m.Labels), value: value})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].family != all[j].family {
+			return all[i].family < all[j].family
+		}
+		return all[i].labels < all[j].labels
+	})
+
+	var sb strings.Builder
+	familyTypes := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, ser := range all {
+		m := ser.metric
+		if mType, ok := familyTypes[ser.family]; ok && mType != m.MType {
+			log.I().Warnf("метрика %q пропущена: семейство %q уже имеет тип %s", m.ID, ser.family, mType)
+			continue
+		}
+		if seen[ser.family+ser.labels] {
+			log.I().Warnf("метрика %q пропущена: ряд %s%s уже занят", m.ID, ser.family, ser.labels)
+			continue
+		}
+		seen[ser.family+ser.labels] = true
+
+		if _, ok := familyTypes[ser.family]; !ok {
+			familyTypes[ser.family] = m.MType
+			sb.WriteString("# HELP " + ser.family + " " + escapeHelp(m.ID) + "\n")
+			sb.WriteString("# TYPE " + ser.family + " " + m.MType + "\n")
+		}
+
+		name := ser.family
+		if m.MType == "counter" && openMetrics {
+			name += "_total"
+		}
+		sb.WriteString(name + ser.labels + " " + ser.value + "\n")
+	}
+
+	if openMetrics {
+		sb.WriteString("# EOF\n")
+		c.Data(http.StatusOK, openMetricsContentType, []byte(sb.String()))
+		return
+	}
+	c.Data(http.StatusOK, prometheusContentType, []byte(sb.String()))
+}
+
+// SanitizeMetricName приводит имя метрики к виду [a-zA-Z_:][a-zA-Z0-9_:]*,
+// заменяя недопустимые символы на подчёркивание.
+func SanitizeMetricName(name string) string {
+	if name == "" {
+		return "_"
+	}
+
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+// formatLabels форматирует метки в виде {k1="v1",k2="v2"} с отсортированными ключами.
+// Имена меток приводятся к виду [a-zA-Z_][a-zA-Z0-9_]*.
+func formatLabels(labels model.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		name := strings.ReplaceAll(SanitizeMetricName(k), ":", "_")
+		parts = append(parts, name+`="`+escapeLabelValue(labels[k])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// escapeLabelValue экранирует обратный слэш, кавычку и перевод строки в значении метки.
+func escapeLabelValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+// escapeHelp экранирует обратный слэш и перевод строки в тексте HELP.
+func escapeHelp(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
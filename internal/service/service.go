@@ -2,7 +2,10 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"html"
 	"net/http"
 	"strconv"
 
@@ -10,6 +13,7 @@ import (
 	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
 	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
 )
 
 // MetricsService предоставляет методы для обработки запросов к метрикам.
@@ -22,12 +26,148 @@ func NewService(s interfaces.Storage) *MetricsService {
 	return &MetricsService{storage: s}
 }
 
+var (
+	// ErrUnknownMetricType возвращается, если тип метрики не gauge и не counter.
+	ErrUnknownMetricType = errors.New("unknown metric type")
+	// ErrMissingValue возвращается, если у метрики не задано значение для её типа.
+	ErrMissingValue = errors.New("metric value is missing")
+	// ErrMetricNotFound возвращается, если метрики с таким типом и именем нет в хранилище.
+	ErrMetricNotFound = errors.New("unknown metric name")
+)
+
+// Update применяет метрику к хранилищу: gauge перезаписывается, counter увеличивается.
+// Используется как HTTP-, так и gRPC-транспортом.
+func (s *MetricsService) Update(ctx context.Context, metric model.Metrics) error {
+	if err := validate(metric); err != nil {
+		return err
+	}
+
+	var err error
+	if metric.MType == "gauge" {
+		err = s.storage.SetGauge(ctx, metric.ID, *metric.Value, metric.Labels)
+	} else {
+		err = s.storage.AddCounter(ctx, metric.ID, *metric.Delta, metric.Labels)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка при сохранении метрики %q: %w", metric.ID, err)
+	}
+	return nil
+}
+
+// UpdateBatch проверяет пачку метрик и атомарно применяет её к хранилищу.
+func (s *MetricsService) UpdateBatch(ctx context.Context, metrics []model.Metrics) error {
+	for _, metric := range metrics {
+		if err := validate(metric); err != nil {
+			return fmt.Errorf("metric %q: %w", metric.ID, err)
+		}
+	}
+	if err := s.storage.UpdateBatch(ctx, metrics); err != nil {
+		return fmt.Errorf("ошибка при сохранении пачки метрик: %w", err)
+	}
+	return nil
+}
+
+// Value возвращает метрику по типу, имени и меткам.
+// Возвращает ErrUnknownMetricType для неизвестного типа и ErrMetricNotFound, если метрики нет.
+func (s *MetricsService) Value(ctx context.Context, mType, id string, labels model.Labels) (model.Metrics, error) {
+	if !validType(mType) {
+		return model.Metrics{}, ErrUnknownMetricType
+	}
+	metrics, err := s.storage.GetMetrics(ctx)
+	if err != nil {
+		return model.Metrics{}, err
+	}
+	metric, ok := metrics[model.MetricKey(mType, id, labels)]
+	if !ok {
+		return model.Metrics{}, ErrMetricNotFound
+	}
+	return metric, nil
+}
+
+var (
+	// ErrInvalidLabel возвращается, если у метрики есть метка с пустым именем.
+	ErrInvalidLabel = errors.New("label name must not be empty")
+	// ErrEmptyName возвращается, если у метрики не задано имя.
+	ErrEmptyName = errors.New("metric name must not be empty")
+)
+
+// validType проверяет, что тип метрики - gauge или counter.
+func validType(mType string) bool {
+	return mType == "gauge" || mType == "counter"
+}
+
+// statusCode возвращает HTTP-код ответа для ошибки бизнес-логики.
+// Недоступность хранилища - 503, неподтверждённый арендатор - 401, прочие ошибки, не связанные с проверкой запроса, - 500.
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, interfaces.ErrStorageUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, tenant.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrMetricNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnknownMetricType), errors.Is(err, ErrMissingValue),
+		errors.Is(err, ErrInvalidLabel), errors.Is(err, ErrEmptyName), errors.Is(err, ErrEmptyDeleteRequest),
+		errors.Is(err, model.ErrInvalidName):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// errorMessage возвращает текст ошибки для клиента. Детали ошибок сервера
+// пишутся в лог и не раскрываются клиенту.
+func errorMessage(c *gin.Context, err error, code int) string {
+	if code < http.StatusInternalServerError {
+		return err.Error()
+	}
+	log.I().Warnf("ошибка при обработке запроса %s: %v", c.Request.URL.Path, err)
+	return http.StatusText(code)
+}
+
+// writeError отвечает клиенту текстовой ошибкой с кодом статуса для err.
+func writeError(c *gin.Context, err error) {
+	code := statusCode(err)
+	c.String(code, errorMessage(c, err, code))
+}
+
+// writeJSONError отвечает клиенту ошибкой в формате JSON с кодом статуса для err.
+func writeJSONError(c *gin.Context, err error) {
+	code := statusCode(err)
+	c.JSON(code, gin.H{"error": errorMessage(c, err, code)})
+}
+
+// validate проверяет, что тип метрики известен и значение для него задано.
+func validate(metric model.Metrics) error {
+	for k := range metric.Labels {
+		if k == "" {
+			return ErrInvalidLabel
+		}
+	}
+	if metric.ID == "" {
+		return ErrEmptyName
+	}
+	if err := model.ValidateNames(metric.ID, metric.Labels); err != nil {
+		return err
+	}
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil {
+			return ErrMissingValue
+		}
+	case "counter":
+		if metric.Delta == nil {
+			return ErrMissingValue
+		}
+	default:
+		return ErrUnknownMetricType
+	}
+	return nil
+}
+
 // PingHandler проверяет доступность хранилища и возвращает "pong", если всё ок.
 func (s *MetricsService) PingHandler(c *gin.Context) {
-	err := s.storage.Ping()
-	if err != nil {
-		log.I().Warnf("Ошибка при попытке вызова метода Ping к базе данных: %v", err)
-		c.String(http.StatusInternalServerError, "Internal Server Error")
+	if err := s.storage.Ping(c.Request.Context()); err != nil {
+		writeError(c, err)
 		return
 	}
 
@@ -37,14 +177,22 @@ func (s *MetricsService) PingHandler(c *gin.Context) {
 // IndexHandler возвращает HTML-страницу со списком всех метрик.
 func (s *MetricsService) IndexHandler(c *gin.Context) {
 
+	metrics, err := s.storage.GetMetrics(c.Request.Context())
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
 	tableRows := ""
 
-	for k, v := range s.storage.GetMetrics() {
-		switch v.MType {
-		case "gauge":
-			tableRows += "<tr><td>" + k + "</td><td>" + fmt.Sprintf("%g", *v.Value) + "</td></tr>"
-		case "counter":
-			tableRows += "<tr><td>" + k + "</td><td>" + fmt.Sprintf("%d", *v.Delta) + "</td></tr>"
+	// Имена и метки приходят от клиентов, поэтому экранируются.
+	for _, v := range metrics {
+		name := html.EscapeString(model.SeriesKey(v.ID, v.Labels))
+		switch {
+		case v.MType == "gauge" && v.Value != nil:
+			tableRows += "<tr><td>" + name + "</td><td>" + fmt.Sprintf("%g", *v.Value) + "</td></tr>"
+		case v.MType == "counter" && v.Delta != nil:
+			tableRows += "<tr><td>" + name + "</td><td>" + fmt.Sprintf("%d", *v.Delta) + "</td></tr>"
 		}
 	}
 
@@ -83,20 +231,19 @@ func (s *MetricsService) IndexHandler(c *gin.Context) {
 
 // ValueHandler возвращает значение метрики по имени и типу из URL.
 func (s *MetricsService) ValueHandler(c *gin.Context) {
-	metricType := c.Param("type")
-	metricName := c.Param("name")
-
-	if metric, ok := s.storage.GetMetrics()[metricName]; ok {
-		var value string
-		if metricType == "gauge" {
-			value = fmt.Sprintf("%g", *metric.Value)
-		} else {
-			value = fmt.Sprintf("%d", *metric.Delta)
-		}
+	metric, err := s.Value(c.Request.Context(), c.Param("type"), c.Param("name"), nil)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
 
-		c.String(http.StatusOK, value)
-	} else {
-		c.String(http.StatusNotFound, "Unknown metric name")
+	switch {
+	case metric.MType == "gauge" && metric.Value != nil:
+		c.String(http.StatusOK, fmt.Sprintf("%g", *metric.Value))
+	case metric.MType == "counter" && metric.Delta != nil:
+		c.String(http.StatusOK, fmt.Sprintf("%d", *metric.Delta))
+	default:
+		c.String(http.StatusNotFound, ErrMetricNotFound.Error())
 	}
 }
 
@@ -106,21 +253,30 @@ func (s *MetricsService) UpdateHandler(c *gin.Context) {
 	metricName := c.Param("name")
 	metricValue := c.Param("value")
 
+	metric := model.Metrics{ID: metricName, MType: metricType}
 	switch metricType {
 	case "gauge":
-		if metricValue, err := strconv.ParseFloat(metricValue, 64); err != nil {
+		metricValue, err := strconv.ParseFloat(metricValue, 64)
+		if err != nil {
 			c.String(http.StatusBadRequest, "Value must be float64")
-		} else {
-			s.storage.SetGauge(metricName, metricValue)
+			return
 		}
+		metric.Value = &metricValue
 	case "counter":
-		if metricValue, err := strconv.ParseInt(metricValue, 0, 64); err != nil {
+		metricValue, err := strconv.ParseInt(metricValue, 0, 64)
+		if err != nil {
 			c.String(http.StatusBadRequest, "Value must be int64")
-		} else {
-			s.storage.AddCounter(metricName, metricValue)
+			return
 		}
+		metric.Delta = &metricValue
 	default:
-		c.String(http.StatusBadRequest, "Unknown metric name")
+		c.String(http.StatusBadRequest, ErrUnknownMetricType.Error())
+		return
+	}
+
+	if err := s.Update(c.Request.Context(), metric); err != nil {
+		writeError(c, err)
+		return
 	}
 
 	c.String(http.StatusOK, "Запрос успешно обработан")
@@ -134,11 +290,12 @@ func (s *MetricsService) ValueJSONHandler(c *gin.Context) {
 		return
 	}
 
-	if metric, ok := s.storage.GetMetrics()[requestMetric.ID]; ok {
-		c.JSON(http.StatusOK, metric)
-	} else {
-		c.JSON(http.StatusNotFound, "Unknown metric name")
+	metric, err := s.Value(c.Request.Context(), requestMetric.MType, requestMetric.ID, requestMetric.Labels)
+	if err != nil {
+		writeJSONError(c, err)
+		return
 	}
+	c.JSON(http.StatusOK, metric)
 }
 
 // UpdateJSONHandler обновляет метрику из JSON-запроса.
@@ -149,16 +306,16 @@ func (s *MetricsService) UpdateJSONHandler(c *gin.Context) {
 		return
 	}
 
-	switch metric.MType {
-	case "gauge":
-		s.storage.SetGauge(metric.ID, *metric.Value)
-	case "counter":
-		s.storage.AddCounter(metric.ID, *metric.Delta)
-	default:
-		c.JSON(http.StatusBadRequest, "Unknown metric name")
+	if err := s.Update(c.Request.Context(), metric); err != nil {
+		writeJSONError(c, err)
+		return
 	}
 
-	updatedMetric := s.storage.GetMetrics()[metric.ID]
+	updatedMetric, err := s.Value(c.Request.Context(), metric.MType, metric.ID, metric.Labels)
+	if err != nil {
+		writeJSONError(c, err)
+		return
+	}
 	c.JSON(http.StatusOK, updatedMetric)
 }
 
@@ -169,16 +326,10 @@ func (s *MetricsService) UpdateBatchHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	for _, metric := range metrics {
-		switch metric.MType {
-		case "gauge":
-			s.storage.SetGauge(metric.ID, *metric.Value)
-		case "counter":
-			s.storage.AddCounter(metric.ID, *metric.Delta)
-		default:
-			log.I().Warnf("не известный тип метрики: %v", metric.MType)
-			c.JSON(http.StatusBadRequest, "Unknown metric name")
-		}
+	if err := s.UpdateBatch(c.Request.Context(), metrics); err != nil {
+		log.I().Warnf("ошибка при обновлении пачки метрик: %v", err)
+		writeJSONError(c, err)
+		return
 	}
 
 	c.JSON(http.StatusOK, "OK")
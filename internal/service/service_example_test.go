@@ -2,10 +2,13 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/lenarlenar/go-my-metrics-service/internal/model"
@@ -15,21 +18,69 @@ type fakeStorage struct {
 	metrics map[string]model.Metrics
 }
 
-func (f *fakeStorage) Ping() error { return nil }
+func (f *fakeStorage) Ping(_ context.Context) error { return nil }
 
-func (f *fakeStorage) GetMetrics() map[string]model.Metrics {
-	return f.metrics
+func (f *fakeStorage) GetMetrics(_ context.Context) (map[string]model.Metrics, error) {
+	return f.metrics, nil
 }
 
-func (f *fakeStorage) SetGauge(name string, value float64) {
-	f.metrics[name] = model.Metrics{ID: name, MType: "gauge", Value: &value}
+func (f *fakeStorage) SetGauge(_ context.Context, name string, value float64, labels model.Labels) error {
+	key := model.MetricKey("gauge", name, labels)
+	f.metrics[key] = model.Metrics{ID: name, MType: "gauge", Value: &value, Labels: labels}
+	return nil
 }
 
-func (f *fakeStorage) AddCounter(name string, delta int64) {
-	if m, ok := f.metrics[name]; ok && m.Delta != nil {
+func (f *fakeStorage) AddCounter(_ context.Context, name string, delta int64, labels model.Labels) error {
+	key := model.MetricKey("counter", name, labels)
+	if m, ok := f.metrics[key]; ok && m.Delta != nil {
 		delta += *m.Delta
 	}
-	f.metrics[name] = model.Metrics{ID: name, MType: "counter", Delta: &delta}
+	f.metrics[key] = model.Metrics{ID: name, MType: "counter", Delta: &delta, Labels: labels}
+	return nil
+}
+
+func (f *fakeStorage) UpdateBatch(ctx context.Context, metrics []model.Metrics) error {
+	for _, m := range metrics {
+		if m.MType == "gauge" {
+			f.SetGauge(ctx, m.ID, *m.Value, m.Labels)
+		} else {
+			f.AddCounter(ctx, m.ID, *m.Delta, m.Labels)
+		}
+	}
+	return nil
+}
+
+func (f *fakeStorage) GetHistory(_ context.Context, mType, name string, labels model.Labels, from, to time.Time) ([]model.Sample, error) {
+	return []model.Sample{}, nil
+}
+
+func (f *fakeStorage) Delete(_ context.Context, mType, name string, labels model.Labels) (bool, error) {
+	key := model.MetricKey(mType, name, labels)
+	_, ok := f.metrics[key]
+	delete(f.metrics, key)
+	return ok, nil
+}
+
+func (f *fakeStorage) DeleteByPrefix(_ context.Context, prefix string) (int, error) {
+	deleted := 0
+	for key, m := range f.metrics {
+		if strings.HasPrefix(m.ID, prefix) {
+			delete(f.metrics, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (f *fakeStorage) ResetCounter(_ context.Context, name string, labels model.Labels) (bool, error) {
+	key := model.MetricKey("counter", name, labels)
+	m, ok := f.metrics[key]
+	if ok {
+		zero := int64(0)
+		m.Delta = &zero
+		f.metrics[key] = m
+	}
+	return ok, nil
 }
 
 // Пример PingHandler
@@ -55,8 +106,8 @@ func ExampleMetricsService_IndexHandler() {
 	gin.SetMode(gin.TestMode)
 	storage := &fakeStorage{
 		metrics: map[string]model.Metrics{
-			"temp":   {ID: "temp", MType: "gauge", Value: float64Ptr(42.5)},
-			"visits": {ID: "visits", MType: "counter", Delta: int64Ptr(100)},
+			"gauge:temp":     {ID: "temp", MType: "gauge", Value: float64Ptr(42.5)},
+			"counter:visits": {ID: "visits", MType: "counter", Delta: int64Ptr(100)},
 		},
 	}
 	s := NewService(storage)
@@ -78,7 +129,7 @@ func ExampleMetricsService_ValueHandler() {
 	gin.SetMode(gin.TestMode)
 	storage := &fakeStorage{
 		metrics: map[string]model.Metrics{
-			"temp": {ID: "temp", MType: "gauge", Value: float64Ptr(42.5)},
+			"gauge:temp": {ID: "temp", MType: "gauge", Value: float64Ptr(42.5)},
 		},
 	}
 	s := NewService(storage)
@@ -120,7 +171,7 @@ func ExampleMetricsService_ValueJSONHandler() {
 	gin.SetMode(gin.TestMode)
 	storage := &fakeStorage{
 		metrics: map[string]model.Metrics{
-			"cpu": {ID: "cpu", MType: "gauge", Value: float64Ptr(99.9)},
+			"gauge:cpu": {ID: "cpu", MType: "gauge", Value: float64Ptr(99.9)},
 		},
 	}
 	s := NewService(storage)
@@ -2,12 +2,18 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
 	"github.com/lenarlenar/go-my-metrics-service/internal/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -18,21 +24,50 @@ type MockStorage struct {
 	mock.Mock
 }
 
-func (m *MockStorage) SetGauge(n string, v float64) {
-	m.Called(n, v)
+func (m *MockStorage) SetGauge(ctx context.Context, n string, v float64, labels model.Labels) error {
+	args := m.Called(ctx, n, v, labels)
+	return args.Error(0)
+}
+
+func (m *MockStorage) AddCounter(ctx context.Context, n string, v int64, labels model.Labels) error {
+	args := m.Called(ctx, n, v, labels)
+	return args.Error(0)
+}
+
+func (m *MockStorage) UpdateBatch(ctx context.Context, metrics []model.Metrics) error {
+	args := m.Called(ctx, metrics)
+	return args.Error(0)
+}
+
+func (m *MockStorage) GetMetrics(ctx context.Context) (map[string]model.Metrics, error) {
+	args := m.Called(ctx)
+	metrics, _ := args.Get(0).(map[string]model.Metrics)
+	return metrics, args.Error(1)
+}
+
+func (m *MockStorage) GetHistory(ctx context.Context, mType, n string, labels model.Labels, from, to time.Time) ([]model.Sample, error) {
+	args := m.Called(ctx, mType, n, labels, from, to)
+	samples, _ := args.Get(0).([]model.Sample)
+	return samples, args.Error(1)
 }
 
-func (m *MockStorage) AddCounter(n string, v int64) {
-	m.Called(n, v)
+func (m *MockStorage) Delete(ctx context.Context, mType, n string, labels model.Labels) (bool, error) {
+	args := m.Called(ctx, mType, n, labels)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *MockStorage) GetMetrics() map[string]model.Metrics {
-	args := m.Called()
-	return args.Get(0).(map[string]model.Metrics)
+func (m *MockStorage) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	args := m.Called(ctx, prefix)
+	return args.Int(0), args.Error(1)
 }
 
-func (m *MockStorage) Ping() error {
-	args := m.Called()
+func (m *MockStorage) ResetCounter(ctx context.Context, n string, labels model.Labels) (bool, error) {
+	args := m.Called(ctx, n, labels)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockStorage) Ping(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
 
@@ -45,12 +80,17 @@ func SetupRouter(s *MetricsService) *gin.Engine {
 	r.POST("/value/", s.ValueJSONHandler)
 	r.POST("/update/", s.UpdateJSONHandler)
 	r.POST("/updates/", s.UpdateBatchHandler)
+	r.GET("/history/:type/:name", s.HistoryHandler)
+	r.GET("/metrics", s.PrometheusHandler)
+	r.DELETE("/value/:type/:name", s.DeleteHandler)
+	r.POST("/delete/", s.DeleteBatchHandler)
+	r.POST("/reset/counter/:name", s.ResetCounterHandler)
 	return r
 }
 
 func TestPingHandler(t *testing.T) {
 	mockStorage := new(MockStorage)
-	mockStorage.On("Ping").Return(nil)
+	mockStorage.On("Ping", mock.Anything).Return(nil)
 
 	service := NewService(mockStorage)
 	r := SetupRouter(service)
@@ -63,10 +103,12 @@ func TestPingHandler(t *testing.T) {
 
 func TestIndexHandler(t *testing.T) {
 	mockStorage := new(MockStorage)
-	mockStorage.On("GetMetrics").Return(map[string]model.Metrics{
-		"metric1": {ID: "metric1", MType: "gauge", Value: float64Ptr(10.5)},
-		"metric2": {ID: "metric2", MType: "counter", Delta: int64Ptr(20)},
-	})
+	mockStorage.On("GetMetrics", mock.Anything).Return(map[string]model.Metrics{
+		"gauge:metric1":   {ID: "metric1", MType: "gauge", Value: float64Ptr(10.5)},
+		"counter:metric2": {ID: "metric2", MType: "counter", Delta: int64Ptr(20)},
+		"gauge:metric3": {ID: "metric3", MType: "gauge", Value: float64Ptr(1),
+			Labels: model.Labels{"host": "<script>alert(1)</script>"}},
+	}, nil)
 
 	service := NewService(mockStorage)
 	r := SetupRouter(service)
@@ -78,13 +120,15 @@ func TestIndexHandler(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "10.5")
 	assert.Contains(t, w.Body.String(), "metric2")
 	assert.Contains(t, w.Body.String(), "20")
+	assert.NotContains(t, w.Body.String(), "<script>")
+	assert.Contains(t, w.Body.String(), "&lt;script&gt;")
 }
 
 func TestValueHandler(t *testing.T) {
 	mockStorage := new(MockStorage)
-	mockStorage.On("GetMetrics").Return(map[string]model.Metrics{
-		"metric1": {ID: "metric1", MType: "gauge", Value: float64Ptr(10.5)},
-	})
+	mockStorage.On("GetMetrics", mock.Anything).Return(map[string]model.Metrics{
+		"gauge:metric1": {ID: "metric1", MType: "gauge", Value: float64Ptr(10.5)},
+	}, nil)
 
 	service := NewService(mockStorage)
 	r := SetupRouter(service)
@@ -97,7 +141,7 @@ func TestValueHandler(t *testing.T) {
 
 func TestUpdateHandler(t *testing.T) {
 	mockStorage := new(MockStorage)
-	mockStorage.On("SetGauge", "metric1", 20.5).Return(nil)
+	mockStorage.On("SetGauge", mock.Anything, "metric1", 20.5, model.Labels(nil)).Return(nil)
 
 	service := NewService(mockStorage)
 	r := SetupRouter(service)
@@ -110,14 +154,14 @@ func TestUpdateHandler(t *testing.T) {
 
 func TestValueJSONHandler(t *testing.T) {
 	mockStorage := new(MockStorage)
-	mockStorage.On("GetMetrics").Return(map[string]model.Metrics{
-		"metric1": {ID: "metric1", MType: "gauge", Value: float64Ptr(10.5)},
-	})
+	mockStorage.On("GetMetrics", mock.Anything).Return(map[string]model.Metrics{
+		"gauge:metric1": {ID: "metric1", MType: "gauge", Value: float64Ptr(10.5)},
+	}, nil)
 
 	service := NewService(mockStorage)
 	r := SetupRouter(service)
 
-	w := performRequest(r, "POST", "/value/", `{"id":"metric1"}`)
+	w := performRequest(r, "POST", "/value/", `{"id":"metric1","type":"gauge"}`)
 
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.JSONEq(t, `{"id":"metric1","type":"gauge","value":10.5}`, w.Body.String())
@@ -125,10 +169,10 @@ func TestValueJSONHandler(t *testing.T) {
 
 func TestUpdateJSONHandler(t *testing.T) {
 	mockStorage := new(MockStorage)
-	mockStorage.On("SetGauge", "metric1", 20.5).Return(nil)
-	mockStorage.On("GetMetrics").Return(map[string]model.Metrics{
-		"metric1": {ID: "metric1", MType: "gauge", Value: float64Ptr(20.5)},
-	})
+	mockStorage.On("SetGauge", mock.Anything, "metric1", 20.5, model.Labels(nil)).Return(nil)
+	mockStorage.On("GetMetrics", mock.Anything).Return(map[string]model.Metrics{
+		"gauge:metric1": {ID: "metric1", MType: "gauge", Value: float64Ptr(20.5)},
+	}, nil)
 
 	service := NewService(mockStorage)
 	r := SetupRouter(service)
@@ -141,8 +185,11 @@ func TestUpdateJSONHandler(t *testing.T) {
 
 func TestUpdateBatchHandler(t *testing.T) {
 	mockStorage := new(MockStorage)
-	mockStorage.On("SetGauge", "metric1", 20.5).Return(nil)
-	mockStorage.On("AddCounter", "metric2", int64(5)).Return(nil)
+	mockStorage.On("UpdateBatch", mock.Anything, []model.Metrics{
+		{ID: "metric1", MType: "gauge", Value: float64Ptr(20.5)},
+		{ID: "metric2", MType: "counter", Delta: int64Ptr(5)},
+	}).Return(nil).Once()
+	mockStorage.On("UpdateBatch", mock.Anything, mock.Anything).Return(errors.New("connection refused"))
 
 	service := NewService(mockStorage)
 	r := SetupRouter(service)
@@ -151,6 +198,174 @@ func TestUpdateBatchHandler(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Equal(t, `"OK"`, w.Body.String())
+
+	w = performRequest(r, "POST", "/updates/", `[{"id":"metric1","type":"gauge","value":1}]`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	mockStorage.AssertNumberOfCalls(t, "UpdateBatch", 2)
+}
+
+func TestStorageErrorStatus(t *testing.T) {
+	unavailable := fmt.Errorf("%w: connection refused", interfaces.ErrStorageUnavailable)
+
+	mockStorage := new(MockStorage)
+	mockStorage.On("GetMetrics", mock.Anything).Return(nil, unavailable).Once()
+	mockStorage.On("GetMetrics", mock.Anything).Return(nil, errors.New("scan error")).Once()
+	mockStorage.On("Ping", mock.Anything).Return(unavailable)
+
+	service := NewService(mockStorage)
+	r := SetupRouter(service)
+
+	w := performRequest(r, "GET", "/value/gauge/metric1/")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = performRequest(r, "GET", "/value/gauge/metric1/")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = performRequest(r, "GET", "/ping")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestDeleteHandlers(t *testing.T) {
+	mockStorage := new(MockStorage)
+	mockStorage.On("Delete", mock.Anything, "gauge", "metric1", model.Labels{"host": "a"}).Return(true, nil)
+	mockStorage.On("Delete", mock.Anything, "gauge", "metric2", model.Labels(nil)).Return(false, nil)
+	mockStorage.On("DeleteByPrefix", mock.Anything, "web1.").Return(3, nil)
+	mockStorage.On("ResetCounter", mock.Anything, "PollCount", model.Labels(nil)).Return(true, nil)
+	mockStorage.On("ResetCounter", mock.Anything, "Missing", model.Labels(nil)).Return(false, nil)
+
+	service := NewService(mockStorage)
+	r := SetupRouter(service)
+
+	w := performRequest(r, "DELETE", "/value/gauge/metric1?labels=host=a")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(r, "DELETE", "/value/gauge/metric2")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequest(r, "DELETE", "/value/histogram/metric1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(r, "POST", "/delete/", `{"prefix":"web1.","metrics":[{"id":"metric1","type":"gauge","labels":{"host":"a"}},{"id":"metric2","type":"gauge"}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"deleted":4}`, w.Body.String())
+	// Пустой запрос не удаляет все метрики.
+	w = performRequest(r, "POST", "/delete/", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	mockStorage.AssertNumberOfCalls(t, "DeleteByPrefix", 1)
+
+	w = performRequest(r, "POST", "/reset/counter/PollCount")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(r, "POST", "/reset/counter/Missing")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	from := time.Unix(1000, 0)
+	to := time.Unix(1100, 0)
+	mockStorage := new(MockStorage)
+	mockStorage.On("GetHistory", mock.Anything, "counter", "PollCount", model.Labels(nil), from, to).Return([]model.Sample{
+		{Timestamp: time.Unix(1001, 0), Value: 1},
+		{Timestamp: time.Unix(1005, 0), Value: 2},
+		{Timestamp: time.Unix(1070, 0), Value: 3},
+	}, nil)
+
+	service := NewService(mockStorage)
+	r := SetupRouter(service)
+
+	w := performRequest(r, "GET", "/history/counter/PollCount?from=1000&to=1100&step=1m")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","step":"1m0s","points":[
+		{"ts":"`+time.Unix(1000, 0).Format(time.RFC3339Nano)+`","value":3},
+		{"ts":"`+time.Unix(1060, 0).Format(time.RFC3339Nano)+`","value":3}
+	]}`, w.Body.String())
+
+	w = performRequest(r, "GET", "/history/unknown/PollCount")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(r, "GET", "/history/gauge/Alloc?from=2000&to=1000")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUpdateJSONHandlerWithLabels(t *testing.T) {
+	storage := &fakeStorage{metrics: make(map[string]model.Metrics)}
+	service := NewService(storage)
+	r := SetupRouter(service)
+
+	w := performRequest(r, "POST", "/update/", `{"id":"CPUutilization","type":"gauge","value":12.5,"labels":{"cpu":"1","host":"a"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"CPUutilization","type":"gauge","value":12.5,"labels":{"cpu":"1","host":"a"}}`, w.Body.String())
+
+	w = performRequest(r, "POST", "/update/", `{"id":"CPUutilization","type":"gauge","value":7,"labels":{"cpu":"2","host":"a"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(r, "POST", "/value/", `{"id":"CPUutilization","type":"gauge","labels":{"host":"a","cpu":"1"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"CPUutilization","type":"gauge","value":12.5,"labels":{"cpu":"1","host":"a"}}`, w.Body.String())
+
+	w = performRequest(r, "POST", "/value/", `{"id":"CPUutilization","type":"gauge"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(r, "GET", "/metrics")
+	assert.Contains(t, w.Body.String(), `# TYPE CPUutilization gauge
+CPUutilization{cpu="1",host="a"} 12.5
+CPUutilization{cpu="2",host="a"} 7
+`)
+}
+
+func TestDownsample(t *testing.T) {
+	from := time.Unix(0, 0)
+	samples := []model.Sample{
+		{Timestamp: time.Unix(1, 0), Value: 10},
+		{Timestamp: time.Unix(9, 0), Value: 20},
+		{Timestamp: time.Unix(25, 0), Value: 5},
+	}
+
+	gauge := Downsample("gauge", samples, from, 10*time.Second)
+	assert.Equal(t, []model.Sample{
+		{Timestamp: time.Unix(0, 0), Value: 15},
+		{Timestamp: time.Unix(20, 0), Value: 5},
+	}, gauge)
+
+	counter := Downsample("counter", samples, from, 10*time.Second)
+	assert.Equal(t, []model.Sample{
+		{Timestamp: time.Unix(0, 0), Value: 30},
+		{Timestamp: time.Unix(20, 0), Value: 5},
+	}, counter)
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	mockStorage := new(MockStorage)
+	mockStorage.On("GetMetrics", mock.Anything).Return(map[string]model.Metrics{
+		"HeapAlloc":       {ID: "HeapAlloc", MType: "gauge", Value: float64Ptr(10.5)},
+		"PollCount":       {ID: "PollCount", MType: "counter", Delta: int64Ptr(20)},
+		"1cpu.usage-idle": {ID: "1cpu.usage-idle", MType: "gauge", Value: float64Ptr(0.25)},
+	}, nil)
+
+	service := NewService(mockStorage)
+	r := SetupRouter(service)
+
+	w := performRequest(r, "GET", "/metrics")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, prometheusContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP HeapAlloc HeapAlloc
+# TYPE HeapAlloc gauge
+HeapAlloc 10.5
+# HELP PollCount_total PollCount
+# TYPE PollCount_total counter
+PollCount_total 20
+# HELP _1cpu_usage_idle 1cpu.usage-idle
+# TYPE _1cpu_usage_idle gauge
+_1cpu_usage_idle 0.25
+`, w.Body.String())
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, openMetricsContentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "# TYPE PollCount counter\nPollCount_total 20\n")
+	assert.True(t, strings.HasSuffix(w.Body.String(), "# EOF\n"))
 }
 
 func performRequest(r http.Handler, method, path string, body ...string) *httptest.ResponseRecorder {
@@ -176,3 +391,52 @@ func float64Ptr(f float64) *float64 {
 func int64Ptr(i int64) *int64 {
 	return &i
 }
+
+func TestMetricTypeValidation(t *testing.T) {
+	storage := &fakeStorage{metrics: make(map[string]model.Metrics)}
+	service := NewService(storage)
+	r := SetupRouter(service)
+
+	performRequest(r, "POST", "/update/gauge/Alloc/1.5")
+	performRequest(r, "POST", "/update/counter/Alloc/3")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+		want   string
+	}{
+		{name: "gauge value", method: "GET", path: "/value/gauge/Alloc/", code: http.StatusOK, want: "1.5"},
+		{name: "counter with same name", method: "GET", path: "/value/counter/Alloc/", code: http.StatusOK, want: "3"},
+		{name: "unknown type", method: "GET", path: "/value/histogram/Alloc/", code: http.StatusBadRequest},
+		{name: "unknown counter", method: "GET", path: "/value/counter/HeapAlloc/", code: http.StatusNotFound},
+		{name: "update unknown type", method: "POST", path: "/update/histogram/Alloc/1", code: http.StatusBadRequest},
+		{name: "update bad value", method: "POST", path: "/update/counter/Alloc/1.5", code: http.StatusBadRequest},
+		{name: "json update forged key", method: "POST", path: "/update/",
+			body: `{"id":"Alloc{__tenant__=\"payments\"}","type":"counter","delta":1}`, code: http.StatusBadRequest},
+		{name: "json value without type", method: "POST", path: "/value/", body: `{"id":"Alloc"}`, code: http.StatusBadRequest},
+		{name: "json value unknown", method: "POST", path: "/value/", body: `{"id":"HeapAlloc","type":"gauge"}`, code: http.StatusNotFound},
+		{name: "json value counter", method: "POST", path: "/value/", body: `{"id":"Alloc","type":"counter"}`, code: http.StatusOK,
+			want: `{"id":"Alloc","type":"counter","delta":3}`},
+		{name: "json update gauge without value", method: "POST", path: "/update/", body: `{"id":"Alloc","type":"gauge","delta":1}`, code: http.StatusBadRequest},
+		{name: "json update without name", method: "POST", path: "/update/", body: `{"type":"gauge","value":1}`, code: http.StatusBadRequest},
+		{name: "batch with counter without delta", method: "POST", path: "/updates/", body: `[{"id":"Alloc","type":"counter"}]`, code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w *httptest.ResponseRecorder
+			if test.body != "" {
+				w = performRequest(r, test.method, test.path, test.body)
+			} else {
+				w = performRequest(r, test.method, test.path)
+			}
+			assert.Equal(t, test.code, w.Code)
+			if test.want != "" {
+				assert.Equal(t, test.want, w.Body.String())
+			}
+		})
+	}
+}
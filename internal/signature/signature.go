@@ -0,0 +1,221 @@
+// Package signature подписывает запросы агента HMAC-SHA256 с меткой времени и одноразовым
+// значением (nonce) и защищает сервер от повторной отправки перехваченных запросов.
+//
+// Подписывается строка "метка времени\nnonce\nметод путь\nтело"; метка времени - Unix-время
+// в секундах. Путь входит в подпись, потому что у части маршрутов данные метрики передаются в URL.
+// Сервер принимает запрос, только если метка времени отличается от его часов не больше
+// чем на окно, а nonce за это окно ещё не встречался.
+package signature
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// TimestampHeader - заголовок с меткой времени запроса.
+	TimestampHeader = "X-Timestamp"
+	// NonceHeader - заголовок с одноразовым значением запроса.
+	NonceHeader = "X-Nonce"
+	// GRPCMethod - метод в подписи вызова gRPC, путь - полное имя метода.
+	// Вызов gRPC подписывается по сообщениям в детерминированной сериализации protobuf.
+	GRPCMethod = "GRPC"
+)
+
+var (
+	// ErrStale - метка времени запроса вне допустимого окна или не разбирается.
+	ErrStale = errors.New("request timestamp is outside the allowed window")
+	// ErrReplay - nonce уже использован успешно обработанным запросом.
+	ErrReplay = errors.New("request nonce has already been used")
+	// ErrInProgress - запрос с этим nonce ещё обрабатывается; повтор нужно отправить позже.
+	ErrInProgress = errors.New("request with this nonce is still being processed")
+)
+
+// Sign возвращает подпись запроса в виде hex-строки. target - метод и путь запроса,
+// например "POST /updates/".
+func Sign(key []byte, timestamp, nonce, target string, body []byte) string {
+	h := New(key, timestamp, nonce, target)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// New возвращает HMAC, в который уже записаны метка времени, nonce и target,
+// для подписи тела, поступающего частями. Подпись - hex-строка h.Sum(nil).
+func New(key []byte, timestamp, nonce, target string) hash.Hash {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(timestamp + "\n" + nonce + "\n" + target + "\n"))
+	return h
+}
+
+// Target возвращает метод и путь запроса в том виде, в каком они подписываются.
+func Target(method, path string) string {
+	return method + " " + path
+}
+
+// NewNonce возвращает случайное одноразовое значение.
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Timestamp возвращает метку времени для заголовка TimestampHeader.
+func Timestamp(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// ParseTimestamp разбирает значение заголовка TimestampHeader.
+func ParseTimestamp(s string) (time.Time, error) {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrStale
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// ReplayGuard помнит nonce запросов за окно допустимого расхождения часов.
+// Nonce резервируется на время обработки запроса (Reserve), после чего закрепляется
+// при успехе (Commit) или освобождается при ошибке (Release). Поэтому ErrReplay означает,
+// что запрос с этим nonce был успешно обработан. Число запомненных nonce ограничено; если
+// приходится вытеснить ещё действующий nonce, вытесняется nonce с самой ранней меткой
+// времени, а запросы с меткой времени раньше вытесненного отклоняются как устаревшие -
+// их повтор нельзя было бы обнаружить. Запросы с той же меткой времени, что у вытесненного,
+// принимаются, кроме повтора самих вытесненных nonce.
+type ReplayGuard struct {
+	window time.Duration
+	size   int
+
+	mu        sync.Mutex
+	seen      map[string]*reservation // nonce -> резервирование
+	queue     reservations            // резервирования по возрастанию метки времени
+	floor     time.Time               // самая поздняя метка времени вытесненных действующих nonce
+	floorKeys map[string]struct{}     // вытесненные nonce с меткой времени floor
+}
+
+type reservation struct {
+	key       string
+	timestamp time.Time
+	done      bool // запрос обработан успешно
+	index     int  // позиция в куче queue
+}
+
+// reservations - куча резервирований с самой ранней меткой времени в начале.
+type reservations []*reservation
+
+func (q reservations) Len() int           { return len(q) }
+func (q reservations) Less(i, j int) bool { return q[i].timestamp.Before(q[j].timestamp) }
+
+func (q reservations) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *reservations) Push(x any) {
+	r := x.(*reservation)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+
+func (q *reservations) Pop() any {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return r
+}
+
+// NewReplayGuard создает защиту с окном window и не более size запомненными nonce.
+func NewReplayGuard(window time.Duration, size int) *ReplayGuard {
+	return &ReplayGuard{
+		window: window,
+		size:   size,
+		seen:   make(map[string]*reservation),
+
+		floorKeys: make(map[string]struct{}),
+	}
+}
+
+// Reserve проверяет метку времени и резервирует nonce. key - nonce, при необходимости
+// дополненный областью видимости (например, арендатором). Возвращает ErrReplay, если
+// nonce уже закреплён, и ErrInProgress, если запрос с ним ещё обрабатывается.
+func (g *ReplayGuard) Reserve(key string, timestamp, now time.Time) error {
+	if timestamp.Before(now.Add(-g.window)) || timestamp.After(now.Add(g.window)) {
+		return ErrStale
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.expire(now)
+	if timestamp.Before(g.floor) {
+		return ErrStale
+	}
+	if _, ok := g.floorKeys[key]; ok && timestamp.Equal(g.floor) {
+		return ErrStale
+	}
+	if r, ok := g.seen[key]; ok {
+		if r.done {
+			return ErrReplay
+		}
+		return ErrInProgress
+	}
+
+	for len(g.queue) >= g.size && len(g.queue) > 0 {
+		evicted := heap.Pop(&g.queue).(*reservation)
+		delete(g.seen, evicted.key)
+		if evicted.timestamp.After(g.floor) {
+			g.floor = evicted.timestamp
+			clear(g.floorKeys)
+		}
+		if evicted.timestamp.Equal(g.floor) {
+			g.floorKeys[evicted.key] = struct{}{}
+		}
+	}
+
+	r := &reservation{key: key, timestamp: timestamp}
+	heap.Push(&g.queue, r)
+	g.seen[key] = r
+	return nil
+}
+
+// Commit закрепляет nonce успешно обработанного запроса: его повтор получит ErrReplay.
+func (g *ReplayGuard) Commit(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r, ok := g.seen[key]; ok {
+		r.done = true
+	}
+}
+
+// Release забывает nonce запроса, который не был обработан, чтобы агент мог его повторить.
+func (g *ReplayGuard) Release(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r, ok := g.seen[key]; ok {
+		heap.Remove(&g.queue, r.index)
+		delete(g.seen, key)
+	}
+}
+
+// expire удаляет nonce, метки времени которых уже вышли из окна.
+func (g *ReplayGuard) expire(now time.Time) {
+	limit := now.Add(-g.window)
+	for len(g.queue) > 0 && g.queue[0].timestamp.Before(limit) {
+		evicted := heap.Pop(&g.queue).(*reservation)
+		delete(g.seen, evicted.key)
+	}
+	if g.floor.Before(limit) {
+		clear(g.floorKeys)
+	}
+}
@@ -0,0 +1,96 @@
+package signature
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	key := []byte("secret")
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+	sign := Sign(key, "1700000000", "n1", "POST /updates/", body)
+
+	assert.Equal(t, sign, Sign(key, "1700000000", "n1", "POST /updates/", body))
+	assert.NotEqual(t, sign, Sign(key, "1700000001", "n1", "POST /updates/", body))
+	assert.NotEqual(t, sign, Sign(key, "1700000000", "n2", "POST /updates/", body))
+	assert.NotEqual(t, sign, Sign(key, "1700000000", "n1", "POST /update/", body))
+	assert.NotEqual(t, sign, Sign([]byte("other"), "1700000000", "n1", "POST /updates/", body))
+
+	ts, err := ParseTimestamp(Timestamp(time.Unix(1700000000, 0)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000), ts.Unix())
+	_, err = ParseTimestamp("yesterday")
+	assert.ErrorIs(t, err, ErrStale)
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := NewReplayGuard(time.Minute, 10)
+
+	require.NoError(t, g.Reserve("a", now, now))
+	assert.ErrorIs(t, g.Reserve("a", now, now), ErrInProgress)
+	g.Commit("a")
+	assert.ErrorIs(t, g.Reserve("a", now, now), ErrReplay)
+	assert.ErrorIs(t, g.Reserve("b", now.Add(-2*time.Minute), now), ErrStale)
+	assert.ErrorIs(t, g.Reserve("b", now.Add(2*time.Minute), now), ErrStale)
+
+	// Освобождённый nonce можно использовать повторно.
+	g.Release("a")
+	require.NoError(t, g.Reserve("a", now, now))
+
+	// Вышедший из окна nonce забывается, но и запрос с ним уже устарел.
+	later := now.Add(2 * time.Minute)
+	require.NoError(t, g.Reserve("c", later, later))
+	assert.ErrorIs(t, g.Reserve("a", now, later), ErrStale)
+	assert.NotContains(t, g.seen, "a")
+}
+
+func TestReplayGuardBounded(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := NewReplayGuard(time.Minute, 2)
+
+	require.NoError(t, g.Reserve("a", now.Add(-30*time.Second), now))
+	require.NoError(t, g.Reserve("b", now.Add(-20*time.Second), now))
+	require.NoError(t, g.Reserve("c", now.Add(-10*time.Second), now))
+	assert.Len(t, g.seen, 2)
+
+	// "a" вытеснен до истечения окна: его повтор отклоняется по метке времени.
+	assert.ErrorIs(t, g.Reserve("a", now.Add(-30*time.Second), now), ErrStale)
+	require.NoError(t, g.Reserve("d", now, now))
+}
+
+func TestReplayGuardSameSecond(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := NewReplayGuard(time.Minute, 2)
+
+	require.NoError(t, g.Reserve("a", now, now))
+	require.NoError(t, g.Reserve("b", now, now))
+	require.NoError(t, g.Reserve("c", now, now))
+
+	// Вытеснен nonce с той же секундой: другие запросы этой секунды принимаются,
+	// повтор вытесненного - нет.
+	assert.ErrorIs(t, g.Reserve("a", now, now), ErrStale)
+	require.NoError(t, g.Reserve("d", now, now))
+	assert.ErrorIs(t, g.Reserve("e", now.Add(-time.Second), now), ErrStale)
+}
+
+func TestReplayGuardExpireOutOfOrder(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := NewReplayGuard(time.Minute, 10)
+
+	// Запросы приходят не по порядку меток времени.
+	require.NoError(t, g.Reserve("new", now.Add(30*time.Second), now))
+	require.NoError(t, g.Reserve("old", now.Add(-50*time.Second), now))
+
+	later := now.Add(20 * time.Second)
+	require.NoError(t, g.Reserve("x", later, later))
+	assert.NotContains(t, g.seen, "old")
+	assert.Contains(t, g.seen, "new")
+
+	// Освобождённый nonce не остаётся в очереди и не занимает место.
+	g.Release("x")
+	assert.Len(t, g.queue, 1)
+}
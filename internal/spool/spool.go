@@ -0,0 +1,479 @@
+// Package spool реализует дисковую очередь агента для пачек метрик, которые не удалось
+// отправить на сервер. Пачки дописываются в сегментные файлы и досылаются по порядку,
+// когда сервер снова доступен.
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+const (
+	// DefaultSegmentSize - размер сегмента, после которого запись продолжается в новый файл.
+	DefaultSegmentSize = 1 << 20
+
+	segmentExt = ".seg"
+	// rejectedExt - расширение сегментов, убранных из очереди: Open их не читает,
+	// а файл остаётся для разбора.
+	rejectedExt = ".rejected"
+	// maxReadFailures - число неудачных чтений сегмента подряд, после которого он убирается из очереди.
+	maxReadFailures = 3
+)
+
+// ErrRejected - сервер отклонил пачку как неверную, и повторная отправка не поможет.
+// Функция send в Replay оборачивает этой ошибкой такие ответы сервера.
+var ErrRejected = errors.New("batch rejected by server")
+
+// segment - файл очереди. Каждая строка файла - одна пачка метрик в JSON.
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// Spool - дисковая очередь пачек метрик.
+//
+// Значение counter в пачке - приращение, как его понимает AddCounter сервера.
+// При досылке пачки одного сегмента объединяются: приращения counter складываются,
+// для gauge остаётся последнее значение. Поэтому сервер получает ровно те приращения,
+// которые получил бы без сбоя, и ни одно не теряется и не учитывается дважды.
+type Spool struct {
+	mutex       sync.Mutex
+	replayMutex sync.Mutex
+
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	segments []segment // по возрастанию seq, последний открыт на запись, если file != nil
+	file     *os.File
+	nextSeq  uint64
+	sending  uint64         // сегмент, который сейчас отправляет Replay, 0 - нет такого
+	failures map[uint64]int // число неудачных чтений сегмента подряд
+}
+
+// Open открывает очередь в каталоге dir, создавая его при необходимости.
+// Сегменты, оставшиеся от прошлого запуска, будут досланы при следующем Replay.
+// maxSize ограничивает суммарный размер сегментов, 0 - без ограничения.
+func Open(dir string, segmentSize, maxSize int64) (*Spool, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if maxSize > 0 && segmentSize > maxSize {
+		segmentSize = maxSize
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("ошибка при создании каталога очереди: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при чтении каталога очереди: %w", err)
+	}
+
+	s := &Spool{dir: dir, segmentSize: segmentSize, maxSize: maxSize, nextSeq: 1, failures: make(map[uint64]int)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при чтении сегмента %s: %w", name, err)
+		}
+		s.segments = append(s.segments, segment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	if len(s.segments) > 0 {
+		s.nextSeq = s.segments[len(s.segments)-1].seq + 1
+	}
+	return s, nil
+}
+
+// Append дописывает пачку в конец очереди и сбрасывает её на диск. Пачка больше
+// размера сегмента занимает сегмент целиком.
+// Если очередь превысила maxSize, она уплотняется, а при нехватке места
+// отбрасываются самые старые сегменты. Ошибка уплотнения только пишется в лог:
+// пачка к этому моменту уже сохранена.
+func (s *Spool) Append(batch []model.Metrics) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file != nil && s.segments[len(s.segments)-1].size+int64(len(line)) > s.segmentSize {
+		if err := s.seal(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.create(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.write(line); err != nil {
+		return err
+	}
+	if err := s.enforceLimit(); err != nil {
+		log.I().Warnf("ошибка при уплотнении дисковой очереди: %v", err)
+	}
+	return nil
+}
+
+// Replay досылает сегменты очереди от старых к новым. Пачки сегмента объединяются
+// и передаются в send одной пачкой; после успешной отправки сегмент удаляется.
+// На первой ошибке досылка прекращается, неотправленные сегменты остаются в очереди.
+// Сегмент, который сервер отклонил с ErrRejected или который не удалось прочитать
+// maxReadFailures раз подряд, убирается из очереди в файл с расширением rejectedExt,
+// чтобы не задерживать следующие. Возвращает количество отправленных сегментов.
+func (s *Spool) Replay(send func([]model.Metrics) error) (int, error) {
+	s.replayMutex.Lock()
+	defer s.replayMutex.Unlock()
+
+	// Текущий сегмент закрывается, чтобы новые пачки, пришедшие во время отправки,
+	// попали в следующий сегмент и не были удалены вместе с отправленным.
+	s.mutex.Lock()
+	if err := s.seal(); err != nil {
+		s.mutex.Unlock()
+		return 0, err
+	}
+	segments := append([]segment(nil), s.segments...)
+	s.mutex.Unlock()
+
+	sent := 0
+	for _, seg := range segments {
+		if !s.startSending(seg.seq) {
+			// Сегмент уплотнён или отброшен при переполнении очереди, пока шла отправка.
+			continue
+		}
+		batches, err := s.read(seg.seq)
+		if err != nil {
+			s.mutex.Lock()
+			s.sending = 0
+			s.failures[seg.seq]++
+			if s.failures[seg.seq] < maxReadFailures {
+				s.mutex.Unlock()
+				return sent, err
+			}
+			log.I().Warnf("сегмент %s не читается: %v", s.path(seg.seq), err)
+			err = s.reject(seg.seq)
+			s.mutex.Unlock()
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if batch := Merge(batches...); len(batch) > 0 {
+			if err := send(batch); err != nil {
+				if !errors.Is(err, ErrRejected) {
+					s.setSending(0)
+					return sent, err
+				}
+				log.I().Warnf("сервер отклонил сегмент %s: %v", s.path(seg.seq), err)
+				s.mutex.Lock()
+				s.sending = 0
+				err = s.reject(seg.seq)
+				s.mutex.Unlock()
+				if err != nil {
+					return sent, err
+				}
+				continue
+			}
+		}
+
+		s.mutex.Lock()
+		s.sending = 0
+		err = s.remove(seg.seq)
+		s.mutex.Unlock()
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// Len возвращает количество сегментов в очереди.
+func (s *Spool) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.segments)
+}
+
+// Size возвращает суммарный размер сегментов в байтах.
+func (s *Spool) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size()
+}
+
+// Close закрывает текущий сегмент. Данные очереди остаются на диске.
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.seal()
+}
+
+// Merge объединяет пачки в одну: приращения counter складываются,
+// для gauge остаётся последнее значение. Порядок метрик - порядок первого появления.
+func Merge(batches ...[]model.Metrics) []model.Metrics {
+	index := make(map[string]int)
+	result := make([]model.Metrics, 0)
+	for _, batch := range batches {
+		for _, m := range batch {
+			key := m.Key()
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(result)
+				result = append(result, m)
+				continue
+			}
+			if m.MType == "counter" && result[i].Delta != nil && m.Delta != nil {
+				delta := *result[i].Delta + *m.Delta
+				result[i].Delta = &delta
+			} else {
+				result[i] = m
+			}
+		}
+	}
+	return result
+}
+
+// startSending отмечает сегмент как отправляемый, чтобы уплотнение его не трогало.
+// Возвращает false, если сегмента уже нет в очереди.
+func (s *Spool) startSending(seq uint64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, seg := range s.segments {
+		if seg.seq == seq {
+			s.sending = seq
+			return true
+		}
+	}
+	return false
+}
+
+// setSending меняет отправляемый сегмент.
+func (s *Spool) setSending(seq uint64) {
+	s.mutex.Lock()
+	s.sending = seq
+	s.mutex.Unlock()
+}
+
+// size возвращает суммарный размер сегментов. Вызывается под блокировкой.
+func (s *Spool) size() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// path возвращает путь к файлу сегмента.
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// create открывает новый сегмент на запись. Вызывается под блокировкой.
+func (s *Spool) create() error {
+	seq := s.nextSeq
+	file, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("ошибка при создании сегмента очереди: %w", err)
+	}
+	s.nextSeq++
+	s.file = file
+	s.segments = append(s.segments, segment{seq: seq})
+	return nil
+}
+
+// write дописывает строку в текущий сегмент. Вызывается под блокировкой.
+func (s *Spool) write(line []byte) error {
+	last := &s.segments[len(s.segments)-1]
+	n, err := s.file.Write(line)
+	last.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("ошибка при записи в очередь: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("ошибка при записи в очередь: %w", err)
+	}
+	return nil
+}
+
+// seal закрывает текущий сегмент, дальнейшие пачки пойдут в новый. Вызывается под блокировкой.
+func (s *Spool) seal() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// remove удаляет сегмент из очереди. Вызывается под блокировкой.
+func (s *Spool) remove(seq uint64) error {
+	for i, seg := range s.segments {
+		if seg.seq != seq {
+			continue
+		}
+		if s.file != nil && i == len(s.segments)-1 {
+			if err := s.seal(); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(s.path(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("ошибка при удалении сегмента очереди: %w", err)
+		}
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		delete(s.failures, seq)
+		return nil
+	}
+	return nil
+}
+
+// reject убирает сегмент из очереди, оставляя файл с расширением rejectedExt.
+// Вызывается под блокировкой.
+func (s *Spool) reject(seq uint64) error {
+	path := s.path(seq)
+	if err := os.Rename(path, path+rejectedExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ошибка при удалении сегмента из очереди: %w", err)
+	}
+	log.I().Warnf("сегмент убран из очереди в %s", path+rejectedExt)
+	return s.remove(seq)
+}
+
+// read читает пачки сегмента. Длина строки не ограничена: Append пишет пачку
+// больше размера сегмента одной строкой. Повреждённые строки (например, недописанная
+// при сбое последняя строка) пропускаются.
+func (s *Spool) read(seq uint64) ([][]model.Metrics, error) {
+	file, err := os.Open(s.path(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	batches := make([][]model.Metrics, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var batch []model.Metrics
+			if err := json.Unmarshal(line, &batch); err != nil {
+				log.I().Warnf("пропущена повреждённая пачка в сегменте %s: %v", s.path(seq), err)
+			} else {
+				batches = append(batches, batch)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return batches, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при чтении сегмента очереди: %w", err)
+		}
+	}
+}
+
+// enforceLimit удерживает размер очереди в пределах maxSize. Сначала сегменты
+// уплотняются в один, это не теряет данных: размер уплотнённой очереди ограничен
+// числом различных метрик. Если и этого мало, отбрасываются самые старые сегменты.
+// Вызывается под блокировкой.
+func (s *Spool) enforceLimit() error {
+	if s.maxSize <= 0 || s.size() <= s.maxSize {
+		return nil
+	}
+	if err := s.compact(); err != nil {
+		return err
+	}
+	for s.size() > s.maxSize {
+		i := 0
+		if len(s.segments) > 0 && s.segments[0].seq == s.sending {
+			i = 1
+		}
+		if i >= len(s.segments) {
+			break
+		}
+		oldest := s.segments[i]
+		log.I().Warnf("очередь метрик переполнена, отброшен сегмент %s", s.path(oldest.seq))
+		if err := s.remove(oldest.seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact объединяет сегменты очереди в один новый сегмент. Сегмент, который
+// сейчас отправляет Replay, не трогается. Вызывается под блокировкой.
+func (s *Spool) compact() error {
+	if err := s.seal(); err != nil {
+		return err
+	}
+
+	old := make([]segment, 0, len(s.segments))
+	for _, seg := range s.segments {
+		if seg.seq != s.sending {
+			old = append(old, seg)
+		}
+	}
+	if len(old) == 0 {
+		return nil
+	}
+
+	batches := make([][]model.Metrics, 0)
+	for _, seg := range old {
+		b, err := s.read(seg.seq)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		batches = append(batches, b...)
+	}
+
+	line, err := json.Marshal(Merge(batches...))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// Новый сегмент пишется во временный файл и появляется в очереди только целиком.
+	seq := s.nextSeq
+	tmp := s.path(seq) + ".tmp"
+	if err := os.WriteFile(tmp, line, 0o600); err != nil {
+		return fmt.Errorf("ошибка при уплотнении очереди: %w", err)
+	}
+	if err := os.Rename(tmp, s.path(seq)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("ошибка при уплотнении очереди: %w", err)
+	}
+	s.nextSeq++
+
+	for _, seg := range old {
+		if err := s.remove(seg.seq); err != nil {
+			return err
+		}
+	}
+	s.segments = append(s.segments, segment{seq: seq, size: int64(len(line))})
+	return nil
+}
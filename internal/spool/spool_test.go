@@ -0,0 +1,202 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(name string, value float64) model.Metrics {
+	return model.Metrics{ID: name, MType: "gauge", Value: &value}
+}
+
+func counter(name string, delta int64) model.Metrics {
+	return model.Metrics{ID: name, MType: "counter", Delta: &delta}
+}
+
+// collect возвращает функцию отправки, запоминающую отправленные пачки.
+func collect(sent *[][]model.Metrics) func([]model.Metrics) error {
+	return func(batch []model.Metrics) error {
+		*sent = append(*sent, batch)
+		return nil
+	}
+}
+
+func TestMerge(t *testing.T) {
+	merged := Merge(
+		[]model.Metrics{counter("PollCount", 2), gauge("Alloc", 1)},
+		[]model.Metrics{gauge("Alloc", 5), counter("PollCount", 3)},
+		[]model.Metrics{counter("PollCount", 1), gauge("PollCount", 7)},
+	)
+
+	require.Len(t, merged, 3)
+	assert.Equal(t, int64(6), *merged[0].Delta)
+	assert.Equal(t, 5.0, *merged[1].Value)
+	assert.Equal(t, 7.0, *merged[2].Value)
+}
+
+func TestSpoolReplay(t *testing.T) {
+	q, err := Open(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 2), gauge("Alloc", 1)}))
+	require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 3), gauge("Alloc", 2)}))
+
+	// Сервер недоступен - очередь не меняется.
+	n, err := q.Replay(func([]model.Metrics) error { return errors.New("connection refused") })
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, q.Len())
+
+	var sent [][]model.Metrics
+	n, err = q.Replay(collect(&sent))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Len(t, sent, 1)
+	assert.Equal(t, []model.Metrics{counter("PollCount", 5), gauge("Alloc", 2)}, sent[0])
+	assert.Equal(t, 0, q.Len())
+
+	// Повторная досылка ничего не отправляет.
+	sent = nil
+	_, err = q.Replay(collect(&sent))
+	require.NoError(t, err)
+	assert.Empty(t, sent)
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 2)}))
+	require.NoError(t, q.Close())
+
+	// После перезапуска агента пачки досылаются, а новые пишутся в следующий сегмент.
+	q, err = Open(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 3)}))
+	assert.Equal(t, 2, q.Len())
+
+	var sent [][]model.Metrics
+	n, err := q.Replay(collect(&sent))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, [][]model.Metrics{{counter("PollCount", 2)}, {counter("PollCount", 3)}}, sent)
+}
+
+func TestSpoolSegments(t *testing.T) {
+	q, err := Open(t.TempDir(), 64, 0)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 1)}))
+	}
+	assert.Greater(t, q.Len(), 1)
+
+	// Первый сегмент отправлен, второй нет - в очереди остаются только неотправленные пачки.
+	var sent [][]model.Metrics
+	calls := 0
+	_, err = q.Replay(func(batch []model.Metrics) error {
+		calls++
+		if calls > 1 {
+			return errors.New("connection refused")
+		}
+		sent = append(sent, batch)
+		return nil
+	})
+	require.Error(t, err)
+
+	_, err = q.Replay(collect(&sent))
+	require.NoError(t, err)
+
+	var total int64
+	for _, batch := range sent {
+		for _, m := range batch {
+			total += *m.Delta
+		}
+	}
+	assert.Equal(t, int64(5), total)
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	q, err := Open(t.TempDir(), 64, 256)
+	require.NoError(t, err)
+
+	// Пачки одной и той же метрики уплотняются, поэтому очередь не растёт и приращения не теряются.
+	for i := 0; i < 100; i++ {
+		require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 1), gauge("Alloc", float64(i))}))
+		assert.LessOrEqual(t, q.Size(), int64(256))
+	}
+
+	var sent [][]model.Metrics
+	_, err = q.Replay(collect(&sent))
+	require.NoError(t, err)
+	merged := Merge(sent...)
+	require.Len(t, merged, 2)
+	assert.Equal(t, int64(100), *merged[0].Delta)
+	assert.Equal(t, 99.0, *merged[1].Value)
+}
+
+func TestSpoolOversizedBatch(t *testing.T) {
+	q, err := Open(t.TempDir(), 64, 4096)
+	require.NoError(t, err)
+
+	// Пачка больше сегмента пишется одной строкой и не мешает досылке и уплотнению.
+	large := make([]model.Metrics, 0, 20)
+	for i := 0; i < 20; i++ {
+		large = append(large, counter(fmt.Sprintf("counter%d", i), 1))
+	}
+	require.NoError(t, q.Append(large))
+	require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 1)}))
+
+	var sent [][]model.Metrics
+	n, err := q.Replay(collect(&sent))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Len(t, Merge(sent...), 21)
+}
+
+func TestSpoolRejected(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, 64, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Append([]model.Metrics{counter("bad name", 1), counter("a", 1), counter("b", 1)}))
+	require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 1), counter("c", 1), counter("d", 1)}))
+	require.Equal(t, 2, q.Len())
+
+	// Отклонённый сервером сегмент убирается из очереди и не задерживает следующий.
+	var sent [][]model.Metrics
+	n, err := q.Replay(func(batch []model.Metrics) error {
+		if batch[0].ID == "bad name" {
+			return fmt.Errorf("status code 400: %w", ErrRejected)
+		}
+		sent = append(sent, batch)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, q.Len())
+	require.Len(t, sent, 1)
+	rejected, err := filepath.Glob(filepath.Join(dir, "*"+rejectedExt))
+	require.NoError(t, err)
+	assert.Len(t, rejected, 1)
+
+	// Сегмент, который не читается, убирается после maxReadFailures попыток.
+	require.NoError(t, q.Append([]model.Metrics{counter("PollCount", 1)}))
+	require.NoError(t, q.Close())
+	path := q.path(q.segments[0].seq)
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.Mkdir(path, 0o700))
+	for i := 1; i < maxReadFailures; i++ {
+		_, err = q.Replay(collect(&sent))
+		require.Error(t, err)
+		assert.Equal(t, 1, q.Len())
+	}
+	_, err = q.Replay(collect(&sent))
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+}
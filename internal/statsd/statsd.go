@@ -0,0 +1,195 @@
+// Package statsd принимает метрики в формате StatsD и записывает их в хранилище метрик.
+// Используется агентом для метрик локальных приложений и сервером для приёма
+// метрик напрямую от сервисов.
+//
+// Поддерживаются строки вида name:value|g и name:value|c, для counter - частота
+// выборки |@rate, а также метки в стиле DogStatsD |#k1:v1,k2:v2.
+// В одном пакете может быть несколько строк, разделённых переводом строки.
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/log"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+// maxPacketSize - максимальный размер UDP-датаграммы.
+const maxPacketSize = 65535
+
+// ErrInvalidLine - строка не соответствует формату StatsD.
+var ErrInvalidLine = errors.New("invalid statsd line")
+
+// ParseLine разбирает одну строку StatsD в метрику.
+func ParseLine(line string) (model.Metrics, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return model.Metrics{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return model.Metrics{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+	value, mType := fields[0], fields[1]
+
+	rate := 1.0
+	var labels model.Labels
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			r, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return model.Metrics{}, fmt.Errorf("%w: неверная частота выборки в %q", ErrInvalidLine, line)
+			}
+			rate = r
+		case strings.HasPrefix(field, "#"):
+			labels = parseTags(field[1:])
+		default:
+			return model.Metrics{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+		}
+	}
+
+	if err := model.ValidateNames(name, labels); err != nil {
+		return model.Metrics{}, fmt.Errorf("%w: %w", ErrInvalidLine, err)
+	}
+
+	switch mType {
+	case "g":
+		// Значения со знаком в StatsD означают изменение gauge, а не новое значение.
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			return model.Metrics{}, fmt.Errorf("%w: изменение gauge со знаком не поддерживается: %q", ErrInvalidLine, line)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return model.Metrics{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+		}
+		return model.Metrics{ID: name, MType: "gauge", Value: &v, Labels: labels}, nil
+	case "c":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return model.Metrics{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+		}
+		// NaN не проходит ни одно сравнение, поэтому отсекается вместе с переполнением int64.
+		scaled := math.Round(v / rate)
+		if !(scaled >= math.MinInt64 && scaled < math.MaxInt64) {
+			return model.Metrics{}, fmt.Errorf("%w: значение counter вне диапазона int64: %q", ErrInvalidLine, line)
+		}
+		delta := int64(scaled)
+		return model.Metrics{ID: name, MType: "counter", Delta: &delta, Labels: labels}, nil
+	default:
+		return model.Metrics{}, fmt.Errorf("%w: неподдерживаемый тип %q", ErrInvalidLine, mType)
+	}
+}
+
+// parseTags разбирает метки DogStatsD k1:v1,k2:v2. Метка без значения получает пустое значение.
+func parseTags(s string) model.Labels {
+	labels := make(model.Labels)
+	for _, tag := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(tag, ":")
+		if k = strings.TrimSpace(k); k != "" {
+			labels[k] = strings.TrimSpace(v)
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// ParsePacket разбирает строки пакета. Неверные строки пропускаются,
+// их ошибки возвращаются вместе с разобранными метриками.
+func ParsePacket(packet []byte) ([]model.Metrics, error) {
+	var errs []error
+	metrics := make([]model.Metrics, 0)
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m, err := ParseLine(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, errors.Join(errs...)
+}
+
+// Listener принимает датаграммы StatsD по UDP или через Unix-сокет
+// и записывает метрики каждого пакета в хранилище одной пачкой.
+type Listener struct {
+	conn    net.PacketConn
+	storage interfaces.Storage
+	path    string // путь к Unix-сокету, удаляется при остановке
+}
+
+// Listen открывает сокет. network - "udp" или "unixgram"; для Unix-сокета address - путь к файлу,
+// оставшийся от прошлого запуска файл сокета удаляется.
+func Listen(network, address string, storage interfaces.Storage) (*Listener, error) {
+	l := &Listener{storage: storage}
+	if network == "unixgram" {
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("ошибка при удалении старого сокета StatsD: %w", err)
+		}
+		l.path = address
+	}
+
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при открытии сокета StatsD: %w", err)
+	}
+	l.conn = conn
+	return l, nil
+}
+
+// Addr возвращает адрес, на котором слушает Listener.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Serve принимает пакеты до отмены контекста, после чего закрывает сокет.
+func (l *Listener) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		l.conn.Close()
+		if l.path != "" {
+			os.Remove(l.path)
+		}
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.I().Warnf("ошибка при чтении пакета StatsD: %v", err)
+			continue
+		}
+		l.handle(ctx, buf[:n])
+	}
+}
+
+// handle разбирает пакет и сохраняет метрики.
+func (l *Listener) handle(ctx context.Context, packet []byte) {
+	metrics, err := ParsePacket(packet)
+	if err != nil {
+		log.I().Warnf("ошибка разбора пакета StatsD: %v", err)
+	}
+	if len(metrics) == 0 {
+		return
+	}
+	if err := l.storage.UpdateBatch(ctx, metrics); err != nil {
+		log.I().Warnf("ошибка при сохранении метрик StatsD: %v", err)
+	}
+}
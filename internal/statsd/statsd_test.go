@@ -0,0 +1,132 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	delta := func(d int64) *int64 { return &d }
+
+	tests := []struct {
+		line    string
+		want    model.Metrics
+		wantErr bool
+	}{
+		{line: "queue_size:42|g", want: model.Metrics{ID: "queue_size", MType: "gauge", Value: value(42)}},
+		{line: "temp:36.6|g", want: model.Metrics{ID: "temp", MType: "gauge", Value: value(36.6)}},
+		{line: "requests:3|c", want: model.Metrics{ID: "requests", MType: "counter", Delta: delta(3)}},
+		{line: "requests:1|c|@0.1", want: model.Metrics{ID: "requests", MType: "counter", Delta: delta(10)}},
+		{line: "requests:1|c|#route:/api,method:GET", want: model.Metrics{ID: "requests", MType: "counter", Delta: delta(1),
+			Labels: model.Labels{"route": "/api", "method": "GET"}}},
+		{line: "queue_size:+1|g", wantErr: true},
+		{line: "latency:12|ms", wantErr: true},
+		{line: "requests:x|c", wantErr: true},
+		{line: "requests:1|c|@2", wantErr: true},
+		{line: "requests|c", wantErr: true},
+		{line: ":1|c", wantErr: true},
+		{line: `orders{__tenant__="payments"}:1|c`, wantErr: true},
+		{line: "requests:1|c|#a=b:1", wantErr: true},
+		{line: "temp:NaN|g", wantErr: true},
+		{line: "temp:Inf|g", wantErr: true},
+		{line: "requests:NaN|c", wantErr: true},
+		{line: "requests:1e19|c", wantErr: true},
+		{line: "requests:1e18|c|@0.01", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			m, err := ParseLine(test.line)
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, m)
+		})
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	metrics, err := ParsePacket([]byte("a:1|c\nbad\n\nb:2|g\n"))
+	assert.Error(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "a", metrics[0].ID)
+	assert.Equal(t, "b", metrics[1].ID)
+}
+
+// serve запускает Listener и возвращает хранилище, в которое он пишет.
+func serve(t *testing.T, network, address string) (*Listener, *storage.MemStorage) {
+	s := storage.NewMemStorage()
+	l, err := Listen(network, address, s)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return l, s
+}
+
+func waitMetrics(t *testing.T, s *storage.MemStorage, n int) map[string]model.Metrics {
+	var metrics map[string]model.Metrics
+	require.Eventually(t, func() bool {
+		var err error
+		metrics, err = s.GetMetrics(context.Background())
+		return err == nil && len(metrics) >= n
+	}, time.Second, 10*time.Millisecond)
+	return metrics
+}
+
+func TestListenerUDP(t *testing.T) {
+	l, s := serve(t, "udp", "127.0.0.1:0")
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("jobs:2|c\nqueue_size:7|g"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("jobs:3|c"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		metrics, err := s.GetMetrics(context.Background())
+		if err != nil {
+			return false
+		}
+		jobs, ok := metrics[model.MetricKey("counter", "jobs", nil)]
+		return ok && *jobs.Delta == 5
+	}, time.Second, 10*time.Millisecond)
+
+	metrics := waitMetrics(t, s, 2)
+	assert.Equal(t, 7.0, *metrics[model.MetricKey("gauge", "queue_size", nil)].Value)
+}
+
+func TestListenerUnixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	_, s := serve(t, "unixgram", path)
+
+	conn, err := net.Dial("unixgram", path)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("jobs:1|c|#queue:mail"))
+	require.NoError(t, err)
+
+	metrics := waitMetrics(t, s, 1)
+	assert.Contains(t, metrics, model.MetricKey("counter", "jobs", model.Labels{"queue": "mail"}))
+}
@@ -4,120 +4,325 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"time"
 
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
 	"github.com/lenarlenar/go-my-metrics-service/internal/model"
-	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage/migrations"
+	"github.com/lib/pq"
 )
 
 // DBStorage представляет хранилище метрик, использующее PostgreSQL.
 type DBStorage struct {
-	DB          *sql.DB
-	databaseDSN string
+	DB *sql.DB
 }
 
 // NewDBStorage создает новое хранилище на базе PostgreSQL, проверяет соединение
-// и создает таблицу при необходимости.
-func NewDBStorage(config flags.Config) *DBStorage {
-	storage := &DBStorage{
-		databaseDSN: config.DatabaseDSN,
+// и применяет миграции схемы.
+func NewDBStorage(config Config) (*DBStorage, error) {
+	db, err := sql.Open("postgres", config.DatabaseDSN)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при попытке подключиться к базе данных: %w", err)
 	}
 
-	if err := storage.Ping(); err == nil {
-		if err := storage.CreateTable(); err != nil {
-			panic(err)
-		}
-	} else {
-		panic(err)
+	storage := &DBStorage{DB: db}
+	if err := storage.Ping(context.Background()); err != nil {
+		db.Close()
+		return nil, err
 	}
-
-	return storage
+	if err := storage.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
 }
 
-// CreateTable создает таблицу metrics, если она ещё не существует.
-func (m *DBStorage) CreateTable() error {
-	_, err := m.DB.ExecContext(context.Background(), `CREATE TABLE IF NOT EXISTS metrics (
-		id SERIAL PRIMARY KEY,
-		type TEXT NOT NULL,
-		name TEXT NOT NULL,
-		value DOUBLE PRECISION,
-		delta BIGINT
-	);`)
+// Migrate применяет к базе данных все ещё не применённые миграции схемы.
+func (m *DBStorage) Migrate() error {
+	migrator, err := migrations.New(m.DB)
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	applied, err := migrator.Up(context.Background())
 	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
+		return fmt.Errorf("failed to migrate: %w", err)
+	}
+	if applied > 0 {
+		log.I().Infof("применено миграций схемы: %d", applied)
 	}
 	return nil
 }
 
 // GetMetrics возвращает все метрики из базы данных в виде map.
-func (m *DBStorage) GetMetrics() map[string]model.Metrics {
-	rows, err := m.DB.QueryContext(context.Background(), `SELECT * FROM metrics`)
-	if err == nil {
-		metrics := make(map[string]model.Metrics)
-		for rows.Next() {
-			var m model.Metrics
-			var id interface{}
-			err = rows.Scan(&id, &m.MType, &m.ID, &m.Value, &m.Delta)
-			if err != nil {
-				panic(err)
-			}
-			metrics[m.ID] = m
-		}
-		defer rows.Close()
-		err = rows.Err()
-		if err != nil {
-			panic(err)
+func (m *DBStorage) GetMetrics(ctx context.Context) (map[string]model.Metrics, error) {
+	rows, err := m.DB.QueryContext(ctx, `SELECT type, name, value, delta, labels FROM metrics`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при попытке получить метрики из бд: %w", wrapDBError(err))
+	}
+	defer rows.Close()
+
+	metrics := make(map[string]model.Metrics)
+	for rows.Next() {
+		var m model.Metrics
+		var labels string
+		if err := rows.Scan(&m.MType, &m.ID, &m.Value, &m.Delta, &labels); err != nil {
+			return nil, fmt.Errorf("ошибка при попытке получить метрики из бд: %w", wrapDBError(err))
 		}
-		return metrics
-	} else {
-		panic(err)
+		m.Labels = decodeLabels(labels)
+		metrics[m.Key()] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при попытке получить метрики из бд: %w", wrapDBError(err))
 	}
+	return metrics, nil
 }
 
+// Запросы upsert опираются на уникальный индекс metrics_type_name_labels_idx из миграции 0001.
+// Приращение counter выполняется одним запросом, поэтому параллельные агенты не теряют значения.
+const (
+	upsertGaugeQuery = `INSERT INTO metrics (type, name, value, delta, labels)
+	VALUES ('gauge', $1, $2, NULL, $3)
+	ON CONFLICT (type, name, labels) DO UPDATE SET value = EXCLUDED.value`
+	upsertCounterQuery = `INSERT INTO metrics (type, name, value, delta, labels)
+	VALUES ('counter', $1, NULL, $2, $3)
+	ON CONFLICT (type, name, labels) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta`
+	insertSampleQuery = `INSERT INTO metric_samples (type, name, labels, ts, value)
+	VALUES ($1, $2, $3, $4, $5)`
+)
+
 // SetGauge сохраняет значение метрики типа gauge в базу данных.
-func (m *DBStorage) SetGauge(n string, v float64) {
-	_, err := m.DB.ExecContext(context.Background(), `INSERT INTO metrics (type, name, value, delta)
-	VALUES ($1, $2, $3, $4)`,
-		"gauge", n, v, nil)
-	if err != nil {
-		log.I().Warnf("ошибка при попытке добавить в бд метрику типа gauge: %w", err)
-	}
+func (m *DBStorage) SetGauge(ctx context.Context, n string, v float64, labels model.Labels) error {
+	return m.UpdateBatch(ctx, []model.Metrics{{ID: n, MType: "gauge", Value: &v, Labels: labels}})
 }
 
 // AddCounter увеличивает значение метрики counter или создает новую, если она отсутствует.
-func (m *DBStorage) AddCounter(n string, v int64) {
-	row := m.DB.QueryRowContext(context.Background(), `SELECT delta FROM metrics
-			WHERE type = 'counter' AND name = $1`, n)
-	var oldValue int64
-	err := row.Scan(&oldValue)
-	if err == nil {
-		newDelta := oldValue + v
-		_, err := m.DB.ExecContext(context.Background(), `UPDATE metrics
-			SET delta = $1
-			WHERE type = 'counter' AND name = $2`, newDelta, n)
-		if err != nil {
-			log.I().Warnf("ошибка при попытке обновить в бд метрику типа counter: %w", err)
+func (m *DBStorage) AddCounter(ctx context.Context, n string, v int64, labels model.Labels) error {
+	return m.UpdateBatch(ctx, []model.Metrics{{ID: n, MType: "counter", Delta: &v, Labels: labels}})
+}
+
+// UpdateBatch применяет пачку метрик и сохраняет их историю в одной транзакции.
+// При ошибке транзакция откатывается, и ни одна метрика пачки не применяется.
+// Строки обновляются в порядке ключей, поэтому транзакции агентов с пересекающимися
+// рядами блокируют их в одном порядке и не попадают во взаимную блокировку.
+func (m *DBStorage) UpdateBatch(ctx context.Context, metrics []model.Metrics) error {
+	if err := checkBatch(metrics); err != nil {
+		return err
+	}
+	metrics = sortedBatch(metrics)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ошибка при открытии транзакции: %w", wrapDBError(err))
+	}
+	defer tx.Rollback()
+
+	gaugeStmt, err := tx.PrepareContext(ctx, upsertGaugeQuery)
+	if err != nil {
+		return fmt.Errorf("ошибка при подготовке запроса: %w", wrapDBError(err))
+	}
+	defer gaugeStmt.Close()
+
+	counterStmt, err := tx.PrepareContext(ctx, upsertCounterQuery)
+	if err != nil {
+		return fmt.Errorf("ошибка при подготовке запроса: %w", wrapDBError(err))
+	}
+	defer counterStmt.Close()
+
+	sampleStmt, err := tx.PrepareContext(ctx, insertSampleQuery)
+	if err != nil {
+		return fmt.Errorf("ошибка при подготовке запроса: %w", wrapDBError(err))
+	}
+	defer sampleStmt.Close()
+
+	now := time.Now()
+	for _, metric := range metrics {
+		labels := encodeLabels(metric.Labels)
+		var value float64
+		if metric.MType == "gauge" {
+			value = *metric.Value
+			_, err = gaugeStmt.ExecContext(ctx, metric.ID, value, labels)
+		} else {
+			value = float64(*metric.Delta)
+			_, err = counterStmt.ExecContext(ctx, metric.ID, *metric.Delta, labels)
 		}
-	} else if err == sql.ErrNoRows {
-		_, err := m.DB.ExecContext(context.Background(), `INSERT INTO metrics (type, name, value, delta)
-		VALUES ($1, $2, $3, $4)`,
-			"counter", n, nil, v)
 		if err != nil {
-			log.I().Warnf("ошибка при попытке добавить в бд метрику типа counter: %w", err)
+			return fmt.Errorf("ошибка при сохранении метрики %q: %w", metric.ID, wrapDBError(err))
+		}
+
+		if _, err = sampleStmt.ExecContext(ctx, metric.MType, metric.ID, labels, now, value); err != nil {
+			return fmt.Errorf("ошибка при сохранении истории метрики %q: %w", metric.ID, wrapDBError(err))
+		}
+	}
+
+	return wrapDBError(tx.Commit())
+}
+
+// GetHistory возвращает значения метрики за интервал [from, to], упорядоченные по времени.
+func (m *DBStorage) GetHistory(ctx context.Context, mType, n string, labels model.Labels, from, to time.Time) ([]model.Sample, error) {
+	rows, err := m.DB.QueryContext(ctx, `SELECT ts, value FROM metric_samples
+		WHERE type = $1 AND name = $2 AND labels = $3 AND ts BETWEEN $4 AND $5
+		ORDER BY ts`, mType, n, encodeLabels(labels), from, to)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при попытке получить из бд историю метрики: %w", wrapDBError(err))
+	}
+	defer rows.Close()
+
+	samples := make([]model.Sample, 0)
+	for rows.Next() {
+		var s model.Sample
+		if err := rows.Scan(&s.Timestamp, &s.Value); err != nil {
+			return nil, fmt.Errorf("ошибка при попытке получить из бд историю метрики: %w", wrapDBError(err))
 		}
-	} else {
-		panic(err)
+		samples = append(samples, s)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при попытке получить из бд историю метрики: %w", wrapDBError(err))
+	}
+	return samples, nil
+}
+
+// Delete удаляет метрику и её историю в одной транзакции.
+func (m *DBStorage) Delete(ctx context.Context, mType, n string, labels model.Labels) (bool, error) {
+	deleted, err := m.delete(ctx,
+		`DELETE FROM metrics WHERE type = $1 AND name = $2 AND labels = $3`,
+		`DELETE FROM metric_samples WHERE type = $1 AND name = $2 AND labels = $3`,
+		mType, n, encodeLabels(labels))
+	if err != nil {
+		return false, fmt.Errorf("ошибка при удалении метрики %q: %w", n, err)
+	}
+	return deleted > 0, nil
+}
+
+// DeleteByPrefix удаляет метрики с именем, начинающимся с prefix, и их историю в одной транзакции.
+// Сравнение через left() не требует экранировать символы шаблонов LIKE в префиксе.
+func (m *DBStorage) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	deleted, err := m.delete(ctx,
+		`DELETE FROM metrics WHERE left(name, length($1)) = $1`,
+		`DELETE FROM metric_samples WHERE left(name, length($1)) = $1`,
+		prefix)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка при удалении метрик с префиксом %q: %w", prefix, err)
+	}
+	return int(deleted), nil
+}
+
+// delete выполняет удаление метрик и их истории в одной транзакции
+// и возвращает число удалённых метрик.
+func (m *DBStorage) delete(ctx context.Context, metricsQuery, samplesQuery string, args ...any) (int64, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка при открытии транзакции: %w", wrapDBError(err))
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, metricsQuery, args...)
+	if err != nil {
+		return 0, wrapDBError(err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, wrapDBError(err)
+	}
+	if _, err := tx.ExecContext(ctx, samplesQuery, args...); err != nil {
+		return 0, wrapDBError(err)
+	}
+	return deleted, wrapDBError(tx.Commit())
 }
 
-// Ping проверяет соединение с базой данных и инициализирует объект DB.
-func (m *DBStorage) Ping() error {
-	db, err := sql.Open("postgres", m.databaseDSN)
-	m.DB = db
+// ResetCounter обнуляет значение counter. История приращений сохраняется.
+func (m *DBStorage) ResetCounter(ctx context.Context, n string, labels model.Labels) (bool, error) {
+	result, err := m.DB.ExecContext(ctx, `UPDATE metrics SET delta = 0
+		WHERE type = 'counter' AND name = $1 AND labels = $2`, n, encodeLabels(labels))
+	if err != nil {
+		return false, fmt.Errorf("ошибка при сбросе counter %q: %w", n, wrapDBError(err))
+	}
+	updated, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("ошибка при попытке подключиться к базе данных: %w", err)
+		return false, fmt.Errorf("ошибка при сбросе counter %q: %w", n, wrapDBError(err))
 	}
+	return updated > 0, nil
+}
 
-	return db.Ping()
+// GetNotificationState возвращает состояние уведомления по ключу.
+func (m *DBStorage) GetNotificationState(ctx context.Context, key string) (model.NotificationState, bool, error) {
+	state := model.NotificationState{Key: key}
+	row := m.DB.QueryRowContext(ctx, `SELECT fingerprint, sent_at FROM alert_notifications
+		WHERE key = $1`, key)
+	if err := row.Scan(&state.Fingerprint, &state.SentAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.NotificationState{}, false, nil
+		}
+		return model.NotificationState{}, false,
+			fmt.Errorf("ошибка при попытке получить из бд состояние уведомления: %w", wrapDBError(err))
+	}
+	return state, true, nil
+}
+
+// SetNotificationState сохраняет состояние уведомления, перезаписывая предыдущее.
+func (m *DBStorage) SetNotificationState(ctx context.Context, state model.NotificationState) error {
+	_, err := m.DB.ExecContext(ctx, `INSERT INTO alert_notifications (key, fingerprint, sent_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, sent_at = EXCLUDED.sent_at`,
+		state.Key, state.Fingerprint, state.SentAt)
+	if err != nil {
+		return fmt.Errorf("ошибка при попытке сохранить в бд состояние уведомления: %w", wrapDBError(err))
+	}
+	return nil
+}
+
+// Ping проверяет соединение с базой данных.
+func (m *DBStorage) Ping(ctx context.Context) error {
+	if err := m.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("ошибка при попытке подключиться к базе данных: %w", wrapDBError(err))
+	}
+	return nil
+}
+
+// wrapDBError помечает ошибки соединения с базой данных как interfaces.ErrStorageUnavailable.
+// Остальные ошибки возвращаются без изменений.
+func wrapDBError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var netErr net.Error
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+	case errors.As(err, &pqErr) && (pqErr.Code.Class() == "08" || pqErr.Code.Class() == "57"):
+		// 08 - connection exception, 57 - operator intervention (например, остановка сервера).
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %w", interfaces.ErrStorageUnavailable, err)
+}
+
+// encodeLabels сериализует метки в JSON с отсортированными ключами,
+// чтобы одинаковые наборы меток давали одинаковую строку.
+func encodeLabels(labels model.Labels) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// decodeLabels восстанавливает метки из JSON. Пустой набор возвращается как nil.
+func decodeLabels(data string) model.Labels {
+	var labels model.Labels
+	if err := json.Unmarshal([]byte(data), &labels); err != nil || len(labels) == 0 {
+		return nil
+	}
+	return labels
 }
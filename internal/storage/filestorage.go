@@ -3,30 +3,52 @@ package storage
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
 	"github.com/lenarlenar/go-my-metrics-service/internal/model"
-	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
 )
 
 // FileStorage реализует интерфейс Storage, сохраняя метрики в файл.
 type FileStorage struct {
 	mutex   sync.Mutex
 	metrics map[string]model.Metrics
+	history metricHistory
+
+	notifications     map[string]model.NotificationState
+	notificationsPath string
+}
+
+// historyFileSuffix - суффикс файла, в котором хранится история значений метрик.
+const historyFileSuffix = ".history"
+
+// notificationsFileSuffix - суффикс файла, в котором хранится состояние уведомлений об алертах.
+const notificationsFileSuffix = ".notifications"
+
+// historyRecord - строка файла истории в формате JSON Lines.
+type historyRecord struct {
+	MType string `json:"type"`
+	ID    string `json:"id"`
+	model.Sample
 }
 
 // NewFileStorage создает новое файловое хранилище. При флаге Restore пытается загрузить данные из файла.
 // Также запускает фоновую горутину, которая сохраняет метрики через заданный интервал.
-func NewFileStorage(config flags.Config) (*FileStorage, error) {
+func NewFileStorage(config Config) (*FileStorage, error) {
 
 	fs := &FileStorage{
 		metrics: make(map[string]model.Metrics),
+		history: make(metricHistory),
+
+		notifications:     make(map[string]model.NotificationState),
+		notificationsPath: config.FileStoragePath + notificationsFileSuffix,
 	}
 
 	file, err := os.OpenFile(config.FileStoragePath, os.O_RDWR|os.O_CREATE, 0666)
@@ -34,50 +56,152 @@ func NewFileStorage(config flags.Config) (*FileStorage, error) {
 		return nil, fmt.Errorf("ошибка при попытке открыть файл: %w", err)
 	}
 
+	historyFile, err := os.OpenFile(config.FileStoragePath+historyFileSuffix, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при попытке открыть файл истории: %w", err)
+	}
+
 	if config.Restore {
 		fs.load(file)
+		fs.loadHistory(historyFile)
 	}
+	// Состояние уведомлений загружается всегда, иначе после рестарта уведомления продублируются.
+	fs.loadNotifications()
 
 	go func() {
 		for {
 			time.Sleep(config.StoreInterval)
 			fs.save(file)
+			fs.saveHistory(historyFile)
 		}
 	}()
 
 	return fs, nil
 }
 
-// GetMetrics возвращает все сохранённые метрики.
-func (fs *FileStorage) GetMetrics() map[string]model.Metrics {
+// GetMetrics возвращает копию всех сохранённых метрик.
+func (fs *FileStorage) GetMetrics(_ context.Context) (map[string]model.Metrics, error) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
-	return fs.metrics
+	return fs.copyMetrics(), nil
+}
+
+// copyMetrics возвращает копию карты метрик. Вызывается под блокировкой.
+func (fs *FileStorage) copyMetrics() map[string]model.Metrics {
+	metrics := make(map[string]model.Metrics, len(fs.metrics))
+	for k, v := range fs.metrics {
+		metrics[k] = v
+	}
+	return metrics
 }
 
 // SetGauge сохраняет метрику типа gauge.
-func (fs *FileStorage) SetGauge(n string, v float64) {
+func (fs *FileStorage) SetGauge(_ context.Context, n string, v float64, labels model.Labels) error {
 	fs.mutex.Lock()
-	fs.metrics[n] = model.Metrics{ID: n, MType: "gauge", Value: &v}
+	fs.setGauge(n, v, labels, time.Now())
 	fs.mutex.Unlock()
+	return nil
 }
 
 // AddCounter увеличивает метрику типа counter, если она существует, или добавляет новую.
-func (fs *FileStorage) AddCounter(n string, v int64) {
+func (fs *FileStorage) AddCounter(_ context.Context, n string, v int64, labels model.Labels) error {
 	fs.mutex.Lock()
-	oldMetric, ok := fs.metrics[n]
-	if ok {
-		newDelta := *oldMetric.Delta + v
-		updatedMetric := model.Metrics{ID: n, MType: "counter", Delta: &newDelta}
-		fs.metrics[n] = updatedMetric
-	} else {
-		fs.metrics[n] = model.Metrics{ID: n, MType: "counter", Delta: &v}
-	}
+	fs.addCounter(n, v, labels, time.Now())
 	fs.mutex.Unlock()
+	return nil
+}
+
+// UpdateBatch применяет пачку метрик под одной блокировкой.
+// Файл сохраняется фоновой горутиной тоже под блокировкой, поэтому пачка не попадет в него частично.
+func (fs *FileStorage) UpdateBatch(_ context.Context, metrics []model.Metrics) error {
+	if err := checkBatch(metrics); err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	now := time.Now()
+	for _, metric := range metrics {
+		if metric.MType == "gauge" {
+			fs.setGauge(metric.ID, *metric.Value, metric.Labels, now)
+		} else {
+			fs.addCounter(metric.ID, *metric.Delta, metric.Labels, now)
+		}
+	}
+	return nil
+}
+
+// setGauge устанавливает значение gauge. Вызывается под блокировкой.
+func (fs *FileStorage) setGauge(n string, v float64, labels model.Labels, now time.Time) {
+	fs.metrics[model.MetricKey("gauge", n, labels)] = model.Metrics{ID: n, MType: "gauge", Value: &v, Labels: labels}
+	fs.history.add("gauge", model.SeriesKey(n, labels), model.Sample{Timestamp: now, Value: v})
+}
+
+// addCounter увеличивает значение counter. Вызывается под блокировкой.
+func (fs *FileStorage) addCounter(n string, v int64, labels model.Labels, now time.Time) {
+	key := model.MetricKey("counter", n, labels)
+	newDelta := v
+	if oldMetric, ok := fs.metrics[key]; ok {
+		newDelta += *oldMetric.Delta
+	}
+	fs.metrics[key] = model.Metrics{ID: n, MType: "counter", Delta: &newDelta, Labels: labels}
+	fs.history.add("counter", model.SeriesKey(n, labels), model.Sample{Timestamp: now, Value: float64(v)})
+}
+
+// GetHistory возвращает сохранённые значения метрики за интервал [from, to].
+func (fs *FileStorage) GetHistory(_ context.Context, mType, n string, labels model.Labels, from, to time.Time) ([]model.Sample, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.history.get(mType, model.SeriesKey(n, labels), from, to), nil
+}
+
+// Delete удаляет метрику и её историю. Файл обновляется фоновой горутиной.
+func (fs *FileStorage) Delete(_ context.Context, mType, n string, labels model.Labels) (bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return deleteMetric(fs.metrics, fs.history, mType, n, labels), nil
+}
+
+// DeleteByPrefix удаляет все метрики, имя которых начинается с prefix.
+func (fs *FileStorage) DeleteByPrefix(_ context.Context, prefix string) (int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return deleteByPrefix(fs.metrics, fs.history, prefix), nil
+}
+
+// ResetCounter обнуляет значение counter. История приращений сохраняется.
+func (fs *FileStorage) ResetCounter(_ context.Context, n string, labels model.Labels) (bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return resetCounter(fs.metrics, n, labels), nil
+}
+
+// GetNotificationState возвращает состояние уведомления по ключу.
+func (fs *FileStorage) GetNotificationState(_ context.Context, key string) (model.NotificationState, bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	state, ok := fs.notifications[key]
+	return state, ok, nil
+}
+
+// SetNotificationState сохраняет состояние уведомления и сразу записывает все состояния в файл.
+func (fs *FileStorage) SetNotificationState(_ context.Context, state model.NotificationState) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.notifications[state.Key] = state
+
+	data, err := json.Marshal(fs.notifications)
+	if err != nil {
+		return fmt.Errorf("ошибка при попытке сохранить состояние уведомлений в файл: %w", err)
+	}
+	if err := os.WriteFile(fs.notificationsPath, data, 0666); err != nil {
+		return fmt.Errorf("ошибка при попытке сохранить состояние уведомлений в файл: %w", err)
+	}
+	return nil
 }
 
 // Ping возвращает ошибку, так как файловое хранилище не поддерживает пинг.
-func (fs *FileStorage) Ping() error {
+func (fs *FileStorage) Ping(_ context.Context) error {
 	return errors.New("метод Ping() не определен для данного типа хранилища")
 }
 
@@ -93,9 +217,13 @@ func (fs *FileStorage) save(file *os.File) {
 		return
 	}
 
+	fs.mutex.Lock()
+	metrics := fs.copyMetrics()
+	fs.mutex.Unlock()
+
 	buf := bufio.NewWriter(file)
 	encoder := json.NewEncoder(buf)
-	if err := encoder.Encode(fs.GetMetrics()); err != nil {
+	if err := encoder.Encode(metrics); err != nil {
 		log.I().Errorf("ошибка при попытке сохранить метрики в файл: %w", err)
 		return
 	}
@@ -119,8 +247,87 @@ func (fs *FileStorage) load(file *os.File) {
 				return
 			}
 		}
+		// Ключи пересчитываются, так как в старых файлах метрики хранились по имени без типа.
+		rekeyed := make(map[string]model.Metrics, len(metrics))
+		for _, m := range metrics {
+			rekeyed[m.Key()] = m
+		}
 		fs.mutex.Lock()
-		fs.metrics = metrics
+		fs.metrics = rekeyed
 		fs.mutex.Unlock()
 	}
 }
+
+// saveHistory перезаписывает файл истории содержимым кольцевых буферов.
+// Размер файла ограничен так же, как история в памяти.
+func (fs *FileStorage) saveHistory(file *os.File) {
+	if err := file.Truncate(0); err != nil {
+		log.I().Errorf("ошибка при попытке сохранить историю в файл: %v", err)
+		return
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		log.I().Errorf("ошибка при попытке сохранить историю в файл: %v", err)
+		return
+	}
+
+	// Значения копируются под блокировкой, а кодируются уже без неё,
+	// чтобы запись в файл не задерживала запросы.
+	fs.mutex.Lock()
+	history := fs.history.snapshot()
+	fs.mutex.Unlock()
+
+	buf := bufio.NewWriter(file)
+	encoder := json.NewEncoder(buf)
+	for key, samples := range history {
+		for _, sample := range samples {
+			if err := encoder.Encode(historyRecord{MType: key.MType, ID: key.ID, Sample: sample}); err != nil {
+				log.I().Errorf("ошибка при попытке сохранить историю в файл: %v", err)
+				return
+			}
+		}
+	}
+	buf.Flush()
+}
+
+// loadHistory загружает историю значений метрик из файла.
+func (fs *FileStorage) loadHistory(file *os.File) {
+	if _, err := file.Seek(0, 0); err != nil {
+		log.I().Warnf("ошибка при загрузке истории с файла: %v", err)
+		return
+	}
+
+	decoder := json.NewDecoder(file)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for {
+		var record historyRecord
+		if err := decoder.Decode(&record); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.I().Warnf("ошибка при загрузке истории с файла: %v", err)
+			}
+			return
+		}
+		fs.history.add(record.MType, record.ID, record.Sample)
+	}
+}
+
+// loadNotifications загружает состояние уведомлений из файла, если он существует.
+func (fs *FileStorage) loadNotifications() {
+	data, err := os.ReadFile(fs.notificationsPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.I().Warnf("ошибка при загрузке состояния уведомлений с файла: %v", err)
+		}
+		return
+	}
+
+	notifications := make(map[string]model.NotificationState)
+	if err := json.Unmarshal(data, &notifications); err != nil {
+		log.I().Warnf("ошибка при загрузке состояния уведомлений с файла: %v", err)
+		return
+	}
+	fs.mutex.Lock()
+	fs.notifications = notifications
+	fs.mutex.Unlock()
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+// historyCapacity - максимальное количество значений, хранимых в памяти для одной метрики.
+const historyCapacity = 1024
+
+// sampleRing - кольцевой буфер значений метрики ограниченного размера.
+// Память под значения выделяется по мере добавления, а после заполнения
+// старые значения вытесняются новыми.
+type sampleRing struct {
+	samples  []model.Sample
+	start    int
+	capacity int
+}
+
+func newSampleRing(capacity int) *sampleRing {
+	return &sampleRing{capacity: capacity}
+}
+
+// push добавляет значение в конец буфера.
+func (r *sampleRing) push(s model.Sample) {
+	if len(r.samples) < r.capacity {
+		r.samples = append(r.samples, s)
+		return
+	}
+	r.samples[r.start] = s
+	r.start = (r.start + 1) % r.capacity
+}
+
+// between возвращает значения в интервале [from, to] в порядке добавления.
+func (r *sampleRing) between(from, to time.Time) []model.Sample {
+	result := make([]model.Sample, 0)
+	for i := 0; i < len(r.samples); i++ {
+		s := r.samples[(r.start+i)%len(r.samples)]
+		if s.Timestamp.Before(from) || s.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// all возвращает все значения буфера в порядке добавления.
+func (r *sampleRing) all() []model.Sample {
+	result := make([]model.Sample, 0, len(r.samples))
+	for i := 0; i < len(r.samples); i++ {
+		result = append(result, r.samples[(r.start+i)%len(r.samples)])
+	}
+	return result
+}
+
+// metricHistory хранит кольцевые буферы по ключу (тип, имя). Не потокобезопасна,
+// синхронизация выполняется хранилищем-владельцем. nil - история не хранится.
+type metricHistory map[historyKey]*sampleRing
+
+type historyKey struct {
+	MType string
+	ID    string
+}
+
+func (h metricHistory) add(mType, id string, s model.Sample) {
+	if h == nil {
+		return
+	}
+	key := historyKey{MType: mType, ID: id}
+	ring, ok := h[key]
+	if !ok {
+		ring = newSampleRing(historyCapacity)
+		h[key] = ring
+	}
+	ring.push(s)
+}
+
+func (h metricHistory) get(mType, id string, from, to time.Time) []model.Sample {
+	ring, ok := h[historyKey{MType: mType, ID: id}]
+	if !ok {
+		return []model.Sample{}
+	}
+	return ring.between(from, to)
+}
+
+func (h metricHistory) remove(mType, id string) {
+	delete(h, historyKey{MType: mType, ID: id})
+}
+
+// snapshot возвращает копию значений всех буферов.
+func (h metricHistory) snapshot() map[historyKey][]model.Sample {
+	result := make(map[historyKey][]model.Sample, len(h))
+	for key, ring := range h {
+		result[key] = ring.all()
+	}
+	return result
+}
@@ -2,8 +2,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/lenarlenar/go-my-metrics-service/internal/model"
 	_ "github.com/lib/pq"
@@ -13,45 +15,147 @@ import (
 type MemStorage struct {
 	mutex   sync.Mutex
 	metrics map[string]model.Metrics
+	history metricHistory
+
+	notifications map[string]model.NotificationState
 }
 
 // NewMemStorage создает новый экземпляр in-memory хранилища.
 func NewMemStorage() *MemStorage {
 	return &MemStorage{
 		metrics: make(map[string]model.Metrics),
+		history: make(metricHistory),
+
+		notifications: make(map[string]model.NotificationState),
+	}
+}
+
+// NewMemStorageWithoutHistory создает in-memory хранилище, которое не хранит историю
+// значений: GetHistory всегда возвращает пустой список. Подходит агенту, которому
+// нужны только последние значения.
+func NewMemStorageWithoutHistory() *MemStorage {
+	return &MemStorage{
+		metrics:       make(map[string]model.Metrics),
+		notifications: make(map[string]model.NotificationState),
 	}
 }
 
 // GetMetrics возвращает копию всех метрик из памяти.
-func (m *MemStorage) GetMetrics() map[string]model.Metrics {
+func (m *MemStorage) GetMetrics(_ context.Context) (map[string]model.Metrics, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	return m.metrics
+	return m.copyMetrics(), nil
+}
+
+// copyMetrics возвращает копию карты метрик. Вызывается под блокировкой.
+func (m *MemStorage) copyMetrics() map[string]model.Metrics {
+	metrics := make(map[string]model.Metrics, len(m.metrics))
+	for k, v := range m.metrics {
+		metrics[k] = v
+	}
+	return metrics
 }
 
 // SetGauge устанавливает значение метрики типа gauge.
-func (m *MemStorage) SetGauge(n string, v float64) {
+func (m *MemStorage) SetGauge(_ context.Context, n string, v float64, labels model.Labels) error {
 	m.mutex.Lock()
-	m.metrics[n] = model.Metrics{ID: n, MType: "gauge", Value: &v}
+	m.setGauge(n, v, labels, time.Now())
 	m.mutex.Unlock()
+	return nil
 }
 
 // AddCounter увеличивает значение метрики типа counter на заданную величину.
 // Если метрика отсутствует — она создается.
-func (m *MemStorage) AddCounter(n string, v int64) {
-	m.mutex.Lock()
-	oldMetric, ok := m.metrics[n]
-	if ok {
-		newDelta := *oldMetric.Delta + v
-		updatedMetric := model.Metrics{ID: n, MType: "counter", Delta: &newDelta}
-		m.metrics[n] = updatedMetric
-	} else {
-		m.metrics[n] = model.Metrics{ID: n, MType: "counter", Delta: &v}
+func (m *MemStorage) AddCounter(_ context.Context, n string, v int64, labels model.Labels) error {
+	m.mutex.Lock()
+	m.addCounter(n, v, labels, time.Now())
+	m.mutex.Unlock()
+	return nil
+}
+
+// UpdateBatch применяет пачку метрик под одной блокировкой,
+// поэтому другие запросы не увидят пачку применённой частично.
+func (m *MemStorage) UpdateBatch(_ context.Context, metrics []model.Metrics) error {
+	if err := checkBatch(metrics); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for _, metric := range metrics {
+		if metric.MType == "gauge" {
+			m.setGauge(metric.ID, *metric.Value, metric.Labels, now)
+		} else {
+			m.addCounter(metric.ID, *metric.Delta, metric.Labels, now)
+		}
 	}
+	return nil
+}
+
+// setGauge устанавливает значение gauge. Вызывается под блокировкой.
+func (m *MemStorage) setGauge(n string, v float64, labels model.Labels, now time.Time) {
+	m.metrics[model.MetricKey("gauge", n, labels)] = model.Metrics{ID: n, MType: "gauge", Value: &v, Labels: labels}
+	m.history.add("gauge", model.SeriesKey(n, labels), model.Sample{Timestamp: now, Value: v})
+}
+
+// addCounter увеличивает значение counter. Вызывается под блокировкой.
+func (m *MemStorage) addCounter(n string, v int64, labels model.Labels, now time.Time) {
+	key := model.MetricKey("counter", n, labels)
+	newDelta := v
+	if oldMetric, ok := m.metrics[key]; ok {
+		newDelta += *oldMetric.Delta
+	}
+	m.metrics[key] = model.Metrics{ID: n, MType: "counter", Delta: &newDelta, Labels: labels}
+	m.history.add("counter", model.SeriesKey(n, labels), model.Sample{Timestamp: now, Value: float64(v)})
+}
+
+// GetHistory возвращает сохранённые значения метрики за интервал [from, to].
+// Для counter значения — приращения, переданные в AddCounter.
+func (m *MemStorage) GetHistory(_ context.Context, mType, n string, labels model.Labels, from, to time.Time) ([]model.Sample, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.history.get(mType, model.SeriesKey(n, labels), from, to), nil
+}
+
+// Delete удаляет метрику и её историю.
+func (m *MemStorage) Delete(_ context.Context, mType, n string, labels model.Labels) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return deleteMetric(m.metrics, m.history, mType, n, labels), nil
+}
+
+// DeleteByPrefix удаляет все метрики, имя которых начинается с prefix.
+func (m *MemStorage) DeleteByPrefix(_ context.Context, prefix string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return deleteByPrefix(m.metrics, m.history, prefix), nil
+}
+
+// ResetCounter обнуляет значение counter. История приращений сохраняется.
+func (m *MemStorage) ResetCounter(_ context.Context, n string, labels model.Labels) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return resetCounter(m.metrics, n, labels), nil
+}
+
+// GetNotificationState возвращает состояние уведомления по ключу.
+func (m *MemStorage) GetNotificationState(_ context.Context, key string) (model.NotificationState, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	state, ok := m.notifications[key]
+	return state, ok, nil
+}
+
+// SetNotificationState сохраняет состояние уведомления.
+func (m *MemStorage) SetNotificationState(_ context.Context, state model.NotificationState) error {
+	m.mutex.Lock()
+	m.notifications[state.Key] = state
 	m.mutex.Unlock()
+	return nil
 }
 
 // Ping возвращает ошибку, так как MemStorage не поддерживает подключение.
-func (m *MemStorage) Ping() error {
+func (m *MemStorage) Ping(_ context.Context) error {
 	return errors.New("метод Ping() не определен для данного типа хранилища")
 }
@@ -0,0 +1,195 @@
+// Package migrations содержит версионированные миграции схемы PostgreSQL для DBStorage.
+//
+// Миграции встроены в бинарник и лежат в каталоге sql в виде пар файлов
+// NNNN_name.up.sql и NNNN_name.down.sql. Применённые версии хранятся в таблице schema_migrations.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// Migration - одна миграция схемы.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// fileRegexp разбирает имя файла миграции: версия, имя и направление.
+var fileRegexp = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// ErrInvalidMigrations возвращается, если набор файлов миграций некорректен.
+var ErrInvalidMigrations = errors.New("invalid migrations")
+
+// Load возвращает встроенные миграции, упорядоченные по версии.
+func Load() ([]Migration, error) {
+	return load(files, "sql")
+}
+
+// load читает миграции из каталога dir файловой системы fsys.
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%w: unexpected file %q", ErrInvalidMigrations, entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("%w: version %d has different names %q and %q", ErrInvalidMigrations, version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: version %d must have both up and down files", ErrInvalidMigrations, m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator применяет и откатывает миграции в базе данных.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New создает Migrator со встроенными миграциями.
+func New(db *sql.DB) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// createTableQuery создает таблицу с версиями применённых миграций.
+const createTableQuery = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// lockKey - ключ advisory-блокировки, чтобы несколько серверов не применяли миграции одновременно.
+const lockKey = 7305410318
+
+// Version возвращает версию последней применённой миграции или 0, если миграций не было.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	if _, err := m.db.ExecContext(ctx, createTableQuery); err != nil {
+		return 0, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var version int
+	err := m.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// Up применяет все ещё не применённые миграции по возрастанию версий.
+// Каждая миграция выполняется в отдельной транзакции вместе с записью в schema_migrations.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, migration := range m.migrations {
+		if migration.Version <= current {
+			continue
+		}
+		err := m.apply(ctx, migration.Up, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)
+				ON CONFLICT (version) DO NOTHING`, migration.Version, migration.Name)
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s up: %w", migration.Version, migration.Name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// Down откатывает steps последних применённых миграций.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	for i := len(m.migrations) - 1; i >= 0 && reverted < steps; i-- {
+		migration := m.migrations[i]
+		if migration.Version > current {
+			continue
+		}
+		err := m.apply(ctx, migration.Down, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+			return err
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("migration %04d_%s down: %w", migration.Version, migration.Name, err)
+		}
+		reverted++
+	}
+	return reverted, nil
+}
+
+// apply выполняет скрипт миграции и обновление schema_migrations в одной транзакции.
+func (m *Migrator) apply(ctx context.Context, script string, record func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, lockKey); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
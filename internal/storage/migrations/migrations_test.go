@@ -0,0 +1,70 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	assert.Equal(t, 1, migrations[0].Version)
+	assert.Contains(t, migrations[0].Up, "CREATE UNIQUE INDEX IF NOT EXISTS metrics_type_name_labels_idx")
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "версии миграций должны идти подряд")
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{
+			name: "without down",
+			files: fstest.MapFS{
+				"sql/0001_init.up.sql": {Data: []byte("SELECT 1")},
+			},
+		},
+		{
+			name: "different names",
+			files: fstest.MapFS{
+				"sql/0001_init.up.sql":    {Data: []byte("SELECT 1")},
+				"sql/0001_other.down.sql": {Data: []byte("SELECT 1")},
+			},
+		},
+		{
+			name: "unexpected file",
+			files: fstest.MapFS{
+				"sql/init.sql": {Data: []byte("SELECT 1")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := load(test.files, "sql")
+			assert.ErrorIs(t, err, ErrInvalidMigrations)
+		})
+	}
+}
+
+func TestLoadOrder(t *testing.T) {
+	migrations, err := load(fstest.MapFS{
+		"sql/0010_b.up.sql":   {Data: []byte("up b")},
+		"sql/0010_b.down.sql": {Data: []byte("down b")},
+		"sql/0002_a.up.sql":   {Data: []byte("up a")},
+		"sql/0002_a.down.sql": {Data: []byte("down a")},
+	}, "sql")
+	require.NoError(t, err)
+	assert.Equal(t, []Migration{
+		{Version: 2, Name: "a", Up: "up a", Down: "down a"},
+		{Version: 10, Name: "b", Up: "up b", Down: "down b"},
+	}, migrations)
+}
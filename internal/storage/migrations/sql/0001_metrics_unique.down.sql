@@ -0,0 +1 @@
+DROP INDEX IF EXISTS metrics_type_name_labels_idx;
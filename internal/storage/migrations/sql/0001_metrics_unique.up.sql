@@ -0,0 +1,15 @@
+-- Таблица metrics могла быть создана до появления миграций, поэтому все изменения идемпотентны.
+CREATE TABLE IF NOT EXISTS metrics (
+	id SERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	name TEXT NOT NULL,
+	value DOUBLE PRECISION,
+	delta BIGINT
+);
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '{}';
+
+-- Из дублей остается последняя добавленная строка.
+DELETE FROM metrics a USING metrics b
+	WHERE a.type = b.type AND a.name = b.name AND a.labels = b.labels AND a.id < b.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_type_name_labels_idx ON metrics (type, name, labels);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS metric_samples (
+	id BIGSERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	name TEXT NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	value DOUBLE PRECISION NOT NULL
+);
+ALTER TABLE metric_samples ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '{}';
+DROP INDEX IF EXISTS metric_samples_type_name_ts_idx;
+CREATE INDEX IF NOT EXISTS metric_samples_series_ts_idx ON metric_samples (type, name, labels, ts);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS alert_notifications (
+	key TEXT PRIMARY KEY,
+	fingerprint TEXT NOT NULL,
+	sent_at TIMESTAMPTZ NOT NULL
+);
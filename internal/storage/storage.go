@@ -2,28 +2,133 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
 	"github.com/lenarlenar/go-my-metrics-service/internal/log"
-	"github.com/lenarlenar/go-my-metrics-service/internal/server/flags"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
 )
 
+// Config - настройки хранилища метрик сервера.
+type Config struct {
+	DatabaseDSN     string        // строка подключения к PostgreSQL
+	FileStoragePath string        // путь к файлу для сохранения метрик
+	Restore         bool          // загружать ли метрики из файла при старте
+	StoreInterval   time.Duration // интервал сохранения метрик в файл
+}
+
 // NewStorage создает подходящее хранилище метрик в зависимости от конфигурации.
 // Приоритет:
 //  1. DBStorage — если указан DSN к базе данных,
 //  2. FileStorage — если указан путь к файлу,
 //  3. MemStorage — если ничего из вышеуказанного не задано или произошла ошибка при инициализации файла.
-func NewStorage(config flags.Config) interfaces.Storage {
+//
+// Ошибка возвращается, только если не удалось подключиться к базе данных.
+func NewStorage(config Config) (interfaces.Storage, error) {
 	if config.DatabaseDSN != "" {
 		log.I().Info("тип хранилища: DBStorage")
-		return NewDBStorage(config)
+		db, err := NewDBStorage(config)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
 	} else if config.FileStoragePath != "" {
 		fs, err := NewFileStorage(config)
 		if err == nil {
 			log.I().Info("тип хранилища: FileStorage")
-			return fs
+			return fs, nil
 		}
 	}
 
 	log.I().Info("тип хранилища: MemStorage")
-	return NewMemStorage()
+	return NewMemStorage(), nil
+}
+
+// ErrInvalidMetric возвращается из UpdateBatch, если в пачке есть метрика
+// неизвестного типа или без значения. В этом случае пачка не применяется.
+var ErrInvalidMetric = errors.New("invalid metric in batch")
+
+// checkBatch проверяет, что у каждой метрики пачки задано значение для её типа,
+// а имена не подделывают ключ другого ряда.
+func checkBatch(metrics []model.Metrics) error {
+	for _, m := range metrics {
+		if err := model.ValidateNames(m.ID, m.Labels); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidMetric, err)
+		}
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+		case m.MType == "counter" && m.Delta != nil:
+		default:
+			return fmt.Errorf("%w: %q", ErrInvalidMetric, m.ID)
+		}
+	}
+	return nil
+}
+
+// sortedBatch возвращает копию пачки, упорядоченную по ключу, в которой повторы одного
+// ряда объединены: приращения counter складываются, для gauge остаётся последнее значение.
+func sortedBatch(metrics []model.Metrics) []model.Metrics {
+	index := make(map[string]int, len(metrics))
+	result := make([]model.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		key := m.Key()
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(result)
+			result = append(result, m)
+			continue
+		}
+		if m.MType == "counter" {
+			delta := *result[i].Delta + *m.Delta
+			result[i].Delta = &delta
+		} else {
+			result[i] = m
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key() < result[j].Key() })
+	return result
+}
+
+// deleteMetric удаляет метрику и её историю из карт хранилища в памяти.
+// Вызывается под блокировкой владельца.
+func deleteMetric(metrics map[string]model.Metrics, history metricHistory, mType, n string, labels model.Labels) bool {
+	key := model.MetricKey(mType, n, labels)
+	if _, ok := metrics[key]; !ok {
+		return false
+	}
+	delete(metrics, key)
+	history.remove(mType, model.SeriesKey(n, labels))
+	return true
+}
+
+// deleteByPrefix удаляет метрики с именем, начинающимся с prefix, и их историю.
+// Вызывается под блокировкой владельца.
+func deleteByPrefix(metrics map[string]model.Metrics, history metricHistory, prefix string) int {
+	deleted := 0
+	for key, m := range metrics {
+		if !strings.HasPrefix(m.ID, prefix) {
+			continue
+		}
+		delete(metrics, key)
+		history.remove(m.MType, model.SeriesKey(m.ID, m.Labels))
+		deleted++
+	}
+	return deleted
+}
+
+// resetCounter обнуляет counter в карте метрик. Вызывается под блокировкой владельца.
+func resetCounter(metrics map[string]model.Metrics, n string, labels model.Labels) bool {
+	key := model.MetricKey("counter", n, labels)
+	m, ok := metrics[key]
+	if !ok {
+		return false
+	}
+	zero := int64(0)
+	m.Delta = &zero
+	metrics[key] = m
+	return true
 }
@@ -1,7 +1,14 @@
 package storage
 
 import (
+	"context"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type Pair struct {
@@ -28,13 +35,182 @@ func TestStorage(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			for _, p := range test.values {
-				memStorage.SetGauge(p.a, p.b)
+				memStorage.SetGauge(context.Background(), p.a, p.b, nil)
 			}
 
-			metric := memStorage.GetMetrics()[test.values[0].a]
+			metric := mustGetMetrics(t, memStorage)[model.MetricKey("gauge", test.values[0].a, nil)]
 			if *metric.Value != test.want {
 				t.Errorf("test.values[0].a = %f, want %f", *metric.Value, test.want)
 			}
 		})
 	}
 }
+
+func TestSampleRing(t *testing.T) {
+	ring := newSampleRing(3)
+	assert.Zero(t, cap(ring.samples), "память под значения выделяется по мере добавления")
+	for i := 1; i <= 5; i++ {
+		ring.push(model.Sample{Timestamp: time.Unix(int64(i), 0), Value: float64(i)})
+	}
+
+	values := make([]float64, 0)
+	for _, s := range ring.all() {
+		values = append(values, s.Value)
+	}
+	assert.Equal(t, []float64{3, 4, 5}, values)
+
+	between := ring.between(time.Unix(4, 0), time.Unix(10, 0))
+	assert.Len(t, between, 2)
+	assert.Equal(t, 4.0, between[0].Value)
+}
+
+func TestMemStorageHistory(t *testing.T) {
+	memStorage := NewMemStorage()
+	memStorage.AddCounter(context.Background(), "PollCount", 1, nil)
+	memStorage.AddCounter(context.Background(), "PollCount", 2, nil)
+	memStorage.SetGauge(context.Background(), "PollCount", 7, nil)
+
+	now := time.Now()
+	counter, err := memStorage.GetHistory(context.Background(), "counter", "PollCount", nil, now.Add(-time.Minute), now)
+	require.NoError(t, err)
+	assert.Len(t, counter, 2)
+	assert.Equal(t, 2.0, counter[1].Value)
+
+	gauge, err := memStorage.GetHistory(context.Background(), "gauge", "PollCount", nil, now.Add(-time.Minute), now)
+	require.NoError(t, err)
+	assert.Len(t, gauge, 1)
+}
+
+func TestMemStorageWithoutHistory(t *testing.T) {
+	memStorage := NewMemStorageWithoutHistory()
+	require.NoError(t, memStorage.SetGauge(context.Background(), "Alloc", 7, nil))
+	require.NoError(t, memStorage.AddCounter(context.Background(), "PollCount", 1, nil))
+
+	history, err := memStorage.GetHistory(context.Background(), "gauge", "Alloc", nil, time.Time{}, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, history)
+	assert.Equal(t, 7.0, *mustGetMetrics(t, memStorage)["gauge:Alloc"].Value)
+	deleted, err := memStorage.Delete(context.Background(), "gauge", "Alloc", nil)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+}
+
+func TestMemStorageLabels(t *testing.T) {
+	memStorage := NewMemStorage()
+	memStorage.AddCounter(context.Background(), "PollCount", 1, model.Labels{"host": "a"})
+	memStorage.AddCounter(context.Background(), "PollCount", 2, model.Labels{"host": "b"})
+	memStorage.AddCounter(context.Background(), "PollCount", 3, model.Labels{"host": "a"})
+	memStorage.AddCounter(context.Background(), "PollCount", 4, nil)
+
+	metrics := mustGetMetrics(t, memStorage)
+	assert.Len(t, metrics, 3)
+	assert.Equal(t, int64(4), *metrics[`counter:PollCount{host="a"}`].Delta)
+	assert.Equal(t, int64(2), *metrics[`counter:PollCount{host="b"}`].Delta)
+	assert.Equal(t, int64(4), *metrics["counter:PollCount"].Delta)
+	assert.Equal(t, model.Labels{"host": "a"}, metrics[`counter:PollCount{host="a"}`].Labels)
+}
+
+func TestMemStorageTypedKeys(t *testing.T) {
+	memStorage := NewMemStorage()
+	memStorage.SetGauge(context.Background(), "Alloc", 1.5, nil)
+	memStorage.AddCounter(context.Background(), "Alloc", 3, nil)
+
+	metrics := mustGetMetrics(t, memStorage)
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, 1.5, *metrics["gauge:Alloc"].Value)
+	assert.Equal(t, int64(3), *metrics["counter:Alloc"].Delta)
+}
+
+func TestMemStorageUpdateBatch(t *testing.T) {
+	memStorage := NewMemStorage()
+	value := 1.5
+	delta := int64(2)
+
+	err := memStorage.UpdateBatch(context.Background(), []model.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter"},
+	})
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+	assert.Empty(t, mustGetMetrics(t, memStorage), "пачка с ошибкой не должна применяться частично")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := memStorage.UpdateBatch(context.Background(), []model.Metrics{
+				{ID: "Alloc", MType: "gauge", Value: &value},
+				{ID: "PollCount", MType: "counter", Delta: &delta},
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	metrics := mustGetMetrics(t, memStorage)
+	assert.Equal(t, 1.5, *metrics["gauge:Alloc"].Value)
+	assert.Equal(t, int64(20), *metrics["counter:PollCount"].Delta)
+}
+
+func TestSortedBatch(t *testing.T) {
+	one, two, gauge := int64(1), int64(2), 3.5
+	batch := []model.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &one},
+		{ID: "Alloc", MType: "gauge", Value: &gauge},
+		{ID: "PollCount", MType: "counter", Delta: &two},
+	}
+
+	sorted := sortedBatch(batch)
+	require.Len(t, sorted, 2)
+	assert.Equal(t, "gauge:Alloc", sorted[1].Key())
+	assert.Equal(t, int64(3), *sorted[0].Delta)
+	assert.Equal(t, int64(1), *batch[0].Delta, "пачка вызывающего не должна меняться")
+}
+
+func TestMemStorageDelete(t *testing.T) {
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	memStorage.SetGauge(ctx, "web1.cpu", 1, nil)
+	memStorage.SetGauge(ctx, "web1.mem", 2, model.Labels{"dc": "eu"})
+	memStorage.AddCounter(ctx, "web1.requests", 3, nil)
+	memStorage.SetGauge(ctx, "web2.cpu", 4, nil)
+	memStorage.AddCounter(ctx, "PollCount", 5, nil)
+
+	deleted, err := memStorage.Delete(ctx, "gauge", "web2.cpu", nil)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = memStorage.Delete(ctx, "counter", "web2.cpu", nil)
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	// История удалённой метрики не возвращается, в том числе после повторного создания.
+	now := time.Now()
+	history, err := memStorage.GetHistory(ctx, "gauge", "web2.cpu", nil, now.Add(-time.Minute), now)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	count, err := memStorage.DeleteByPrefix(ctx, "web1.")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	reset, err := memStorage.ResetCounter(ctx, "PollCount", nil)
+	require.NoError(t, err)
+	assert.True(t, reset)
+	reset, err = memStorage.ResetCounter(ctx, "Missing", nil)
+	require.NoError(t, err)
+	assert.False(t, reset)
+
+	metrics := mustGetMetrics(t, memStorage)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, int64(0), *metrics["counter:PollCount"].Delta)
+	// История приращений сохраняется после сброса.
+	history, err = memStorage.GetHistory(ctx, "counter", "PollCount", nil, now.Add(-time.Minute), time.Now())
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func mustGetMetrics(t *testing.T, s *MemStorage) map[string]model.Metrics {
+	metrics, err := s.GetMetrics(context.Background())
+	require.NoError(t, err)
+	return metrics
+}
@@ -0,0 +1,186 @@
+package tenant
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/interfaces"
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+)
+
+// Label - служебная метка, которой метрики арендатора помечаются в общем хранилище.
+// Арендатор не видит её и не может задать сам.
+const Label = "__tenant__"
+
+// ReservedPrefix - префикс служебных меток. Метки с ним отбрасываются из всех входящих метрик.
+const ReservedPrefix = "__"
+
+// Storage ограничивает операции хранилища арендатором из контекста.
+// Метрики арендатора хранятся с меткой Label, поэтому разделение работает с любым бэкендом.
+type Storage struct {
+	storage interfaces.Storage
+}
+
+var _ interfaces.Storage = (*Storage)(nil)
+
+// NewStorage оборачивает общее хранилище.
+func NewStorage(s interfaces.Storage) *Storage {
+	return &Storage{storage: s}
+}
+
+// scopeLabels возвращает метки метрики в хранилище: служебные метки из запроса отбрасываются,
+// для арендатора добавляется его идентификатор.
+func scopeLabels(labels model.Labels, tenantID string) model.Labels {
+	result := make(model.Labels, len(labels)+1)
+	for k, v := range labels {
+		if !strings.HasPrefix(k, ReservedPrefix) {
+			result[k] = v
+		}
+	}
+	if tenantID != "" {
+		result[Label] = tenantID
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// scopeMetric проверяет имена метрики и возвращает её метки в хранилище для арендатора
+// из контекста. Без проверки имя вида orders{__tenant__="a"} дало бы ключ метрики арендатора a.
+func scopeMetric(ctx context.Context, n string, labels model.Labels) (model.Labels, error) {
+	id, err := Scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := model.ValidateNames(n, labels); err != nil {
+		return nil, err
+	}
+	return scopeLabels(labels, id), nil
+}
+
+// PublicLabels возвращает метки без служебных - в том виде, в каком их видит арендатор.
+func PublicLabels(labels model.Labels) model.Labels {
+	return scopeLabels(labels, "")
+}
+
+// SetGauge устанавливает gauge арендатора.
+func (s *Storage) SetGauge(ctx context.Context, n string, v float64, labels model.Labels) error {
+	scoped, err := scopeMetric(ctx, n, labels)
+	if err != nil {
+		return err
+	}
+	return s.storage.SetGauge(ctx, n, v, scoped)
+}
+
+// AddCounter увеличивает counter арендатора.
+func (s *Storage) AddCounter(ctx context.Context, n string, v int64, labels model.Labels) error {
+	scoped, err := scopeMetric(ctx, n, labels)
+	if err != nil {
+		return err
+	}
+	return s.storage.AddCounter(ctx, n, v, scoped)
+}
+
+// UpdateBatch применяет пачку метрик арендатора.
+func (s *Storage) UpdateBatch(ctx context.Context, metrics []model.Metrics) error {
+	id, err := Scope(ctx)
+	if err != nil {
+		return err
+	}
+	scoped := make([]model.Metrics, len(metrics))
+	for i, m := range metrics {
+		if err := model.ValidateNames(m.ID, m.Labels); err != nil {
+			return err
+		}
+		m.Labels = scopeLabels(m.Labels, id)
+		scoped[i] = m
+	}
+	return s.storage.UpdateBatch(ctx, scoped)
+}
+
+// GetMetrics возвращает только метрики арендатора, без служебной метки.
+func (s *Storage) GetMetrics(ctx context.Context) (map[string]model.Metrics, error) {
+	id, err := Scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all, err := s.storage.GetMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make(map[string]model.Metrics)
+	for _, m := range all {
+		if m.Labels[Label] != id {
+			continue
+		}
+		m.Labels = PublicLabels(m.Labels)
+		metrics[m.Key()] = m
+	}
+	return metrics, nil
+}
+
+// GetHistory возвращает историю метрики арендатора.
+func (s *Storage) GetHistory(
+	ctx context.Context, mType, n string, labels model.Labels, from, to time.Time,
+) ([]model.Sample, error) {
+	scoped, err := scopeMetric(ctx, n, labels)
+	if err != nil {
+		return nil, err
+	}
+	return s.storage.GetHistory(ctx, mType, n, scoped, from, to)
+}
+
+// Delete удаляет метрику арендатора.
+func (s *Storage) Delete(ctx context.Context, mType, n string, labels model.Labels) (bool, error) {
+	scoped, err := scopeMetric(ctx, n, labels)
+	if err != nil {
+		return false, err
+	}
+	return s.storage.Delete(ctx, mType, n, scoped)
+}
+
+// DeleteByPrefix удаляет метрики арендатора с именем, начинающимся с prefix.
+// Общее хранилище не фильтрует по меткам, поэтому метрики удаляются по одной;
+// при ошибке часть метрик может остаться.
+func (s *Storage) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	id, err := Scope(ctx)
+	if err != nil {
+		return 0, err
+	}
+	all, err := s.storage.GetMetrics(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, m := range all {
+		if m.Labels[Label] != id || !strings.HasPrefix(m.ID, prefix) {
+			continue
+		}
+		ok, err := s.storage.Delete(ctx, m.MType, m.ID, m.Labels)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// ResetCounter обнуляет counter арендатора.
+func (s *Storage) ResetCounter(ctx context.Context, n string, labels model.Labels) (bool, error) {
+	scoped, err := scopeMetric(ctx, n, labels)
+	if err != nil {
+		return false, err
+	}
+	return s.storage.ResetCounter(ctx, n, scoped)
+}
+
+// Ping проверяет доступность общего хранилища.
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.storage.Ping(ctx)
+}
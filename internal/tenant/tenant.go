@@ -0,0 +1,141 @@
+// Package tenant разделяет метрики арендаторов - команд, которые пользуются одним сервером.
+//
+// Арендатор определяется по запросу (см. middleware.Tenants) и сохраняется в контексте.
+// Storage читает его из контекста и ограничивает все операции хранилища метриками
+// этого арендатора. Запросы без арендатора работают с метриками по умолчанию, как
+// до появления арендаторов.
+package tenant
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Header - заголовок запроса с идентификатором арендатора.
+const Header = "X-Tenant-ID"
+
+// ErrUnauthorized - арендатор указан в запросе, но не подтверждён ни токеном, ни подписью.
+var ErrUnauthorized = errors.New("tenant is not authenticated")
+
+// Config - арендатор в JSON-конфиге сервера: команда со своими метриками, невидимыми
+// другим арендаторам. Агент арендатора подписывает запросы ключом key, передавая
+// идентификатор в заголовке X-Tenant-ID, и/или предъявляет token в заголовке
+// Authorization: Bearer.
+//
+// Пример:
+//
+//	{"tenants": [{"id": "payments", "key": "secret"}, {"id": "search", "token": "s3cr3t-t0ken"}]}
+type Config struct {
+	ID    string `json:"id"`
+	Key   string `json:"key"`
+	Token string `json:"token"`
+}
+
+// Tenant - арендатор с ключом подписи HMAC и/или токеном доступа.
+type Tenant struct {
+	ID    string
+	Key   string
+	Token string
+}
+
+// Registry - арендаторы сервера из конфига.
+type Registry struct {
+	byID    map[string]Tenant
+	byToken map[[sha256.Size]byte]Tenant
+}
+
+// NewRegistry проверяет настройки арендаторов: идентификаторы и токены уникальны,
+// у каждого арендатора есть ключ или токен.
+func NewRegistry(configs []Config) (*Registry, error) {
+	r := &Registry{
+		byID:    make(map[string]Tenant, len(configs)),
+		byToken: make(map[[sha256.Size]byte]Tenant, len(configs)),
+	}
+	for _, cfg := range configs {
+		t := Tenant(cfg)
+		if t.ID == "" {
+			return nil, errors.New("у арендатора не задан id")
+		}
+		if t.Key == "" && t.Token == "" {
+			return nil, fmt.Errorf("у арендатора %q не задан ни key, ни token", t.ID)
+		}
+		if _, ok := r.byID[t.ID]; ok {
+			return nil, fmt.Errorf("арендатор %q задан дважды", t.ID)
+		}
+		r.byID[t.ID] = t
+
+		if t.Token != "" {
+			// Токены хранятся по хешу, чтобы поиск не зависел от совпадающего префикса токена.
+			hash := sha256.Sum256([]byte(t.Token))
+			if _, ok := r.byToken[hash]; ok {
+				return nil, fmt.Errorf("токен арендатора %q уже используется", t.ID)
+			}
+			r.byToken[hash] = t
+		}
+	}
+	return r, nil
+}
+
+// ByID возвращает арендатора по идентификатору.
+func (r *Registry) ByID(id string) (Tenant, bool) {
+	t, ok := r.byID[id]
+	return t, ok
+}
+
+// ByToken возвращает арендатора по токену доступа.
+func (r *Registry) ByToken(token string) (Tenant, bool) {
+	t, ok := r.byToken[sha256.Sum256([]byte(token))]
+	return t, ok
+}
+
+// Len возвращает число арендаторов.
+func (r *Registry) Len() int {
+	return len(r.byID)
+}
+
+type contextKey struct{}
+
+// identity - арендатор запроса. Подтверждение может прийти позже, чем арендатор
+// определён (подпись проверяется после расшифровки тела), поэтому в контексте
+// хранится указатель.
+type identity struct {
+	tenant   Tenant
+	verified bool
+}
+
+// WithTenant возвращает контекст с арендатором. verified - арендатор уже подтверждён токеном;
+// иначе его должна подтвердить проверка подписи вызовом Verify.
+func WithTenant(ctx context.Context, t Tenant, verified bool) context.Context {
+	return context.WithValue(ctx, contextKey{}, &identity{tenant: t, verified: verified})
+}
+
+// FromContext возвращает арендатора запроса. false - запрос без арендатора.
+func FromContext(ctx context.Context) (Tenant, bool) {
+	id, ok := ctx.Value(contextKey{}).(*identity)
+	if !ok {
+		return Tenant{}, false
+	}
+	return id.tenant, true
+}
+
+// Verify отмечает арендатора запроса подтверждённым.
+func Verify(ctx context.Context) {
+	if id, ok := ctx.Value(contextKey{}).(*identity); ok {
+		id.verified = true
+	}
+}
+
+// Scope возвращает идентификатор арендатора, метрики которого доступны в контексте:
+// пустая строка - метрики по умолчанию. Для неподтверждённого арендатора возвращает ErrUnauthorized.
+func Scope(ctx context.Context) (string, error) {
+	id, ok := ctx.Value(contextKey{}).(*identity)
+	if !ok {
+		return "", nil
+	}
+	if !id.verified {
+		return "", ErrUnauthorized
+	}
+	return id.tenant.ID, nil
+}
@@ -0,0 +1,158 @@
+package tenant_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lenarlenar/go-my-metrics-service/internal/model"
+	"github.com/lenarlenar/go-my-metrics-service/internal/storage"
+	"github.com/lenarlenar/go-my-metrics-service/internal/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRegistry(t *testing.T) {
+	r, err := tenant.NewRegistry([]tenant.Config{{ID: "a", Key: "k"}, {ID: "b", Token: "t"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, r.Len())
+
+	b, ok := r.ByToken("t")
+	require.True(t, ok)
+	assert.Equal(t, "b", b.ID)
+	_, ok = r.ByToken("k")
+	assert.False(t, ok)
+
+	for _, configs := range [][]tenant.Config{
+		{{Key: "k"}},
+		{{ID: "a"}},
+		{{ID: "a", Key: "k"}, {ID: "a", Token: "t"}},
+		{{ID: "a", Token: "t"}, {ID: "b", Token: "t"}},
+	} {
+		_, err := tenant.NewRegistry(configs)
+		assert.Error(t, err, "%+v", configs)
+	}
+}
+
+func TestStorageIsolation(t *testing.T) {
+	shared := storage.NewMemStorage()
+	s := tenant.NewStorage(shared)
+
+	defaultCtx := context.Background()
+	ctxA := tenant.WithTenant(defaultCtx, tenant.Tenant{ID: "a"}, true)
+	ctxB := tenant.WithTenant(defaultCtx, tenant.Tenant{ID: "b"}, true)
+
+	require.NoError(t, s.SetGauge(defaultCtx, "Alloc", 1, nil))
+	require.NoError(t, s.SetGauge(ctxA, "Alloc", 2, nil))
+	// Арендатор не может записать метрику в чужую область, задав служебную метку.
+	require.NoError(t, s.AddCounter(ctxA, "PollCount", 5, model.Labels{tenant.Label: "b"}))
+	delta := int64(7)
+	require.NoError(t, s.UpdateBatch(ctxB, []model.Metrics{{ID: "PollCount", MType: "counter", Delta: &delta}}))
+
+	alloc := model.MetricKey("gauge", "Alloc", nil)
+	pollCount := model.MetricKey("counter", "PollCount", nil)
+
+	metrics, err := s.GetMetrics(defaultCtx)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, 1.0, *metrics[alloc].Value)
+
+	metrics, err = s.GetMetrics(ctxA)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, 2.0, *metrics[alloc].Value)
+	assert.Equal(t, int64(5), *metrics[pollCount].Delta)
+	assert.Nil(t, metrics[alloc].Labels)
+
+	metrics, err = s.GetMetrics(ctxB)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, int64(7), *metrics[pollCount].Delta)
+
+	// В общем хранилище метрики разных арендаторов - разные ряды.
+	all, err := shared.GetMetrics(defaultCtx)
+	require.NoError(t, err)
+	assert.Len(t, all, 4)
+}
+
+func TestStorageDelete(t *testing.T) {
+	shared := storage.NewMemStorage()
+	s := tenant.NewStorage(shared)
+
+	defaultCtx := context.Background()
+	ctxA := tenant.WithTenant(defaultCtx, tenant.Tenant{ID: "a"}, true)
+	for _, ctx := range []context.Context{defaultCtx, ctxA} {
+		require.NoError(t, s.SetGauge(ctx, "web1.cpu", 1, nil))
+		require.NoError(t, s.SetGauge(ctx, "web1.mem", 1, model.Labels{"dc": "eu"}))
+		require.NoError(t, s.AddCounter(ctx, "PollCount", 5, nil))
+	}
+
+	// Удаление и сброс не затрагивают метрики других арендаторов.
+	deleted, err := s.DeleteByPrefix(ctxA, "web1.")
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	reset, err := s.ResetCounter(ctxA, "PollCount", nil)
+	require.NoError(t, err)
+	assert.True(t, reset)
+
+	metrics, err := s.GetMetrics(defaultCtx)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 3)
+	assert.Equal(t, int64(5), *metrics[model.MetricKey("counter", "PollCount", nil)].Delta)
+
+	ok, err := s.Delete(defaultCtx, "gauge", "web1.cpu", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = s.Delete(ctxA, "counter", "PollCount", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	all, err := shared.GetMetrics(defaultCtx)
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+}
+
+func TestStorageForgedKey(t *testing.T) {
+	s := tenant.NewStorage(storage.NewMemStorage())
+	defaultCtx := context.Background()
+	ctxA := tenant.WithTenant(defaultCtx, tenant.Tenant{ID: "payments"}, true)
+	require.NoError(t, s.AddCounter(ctxA, "orders", 10, nil))
+
+	// Имя с меткой арендатора совпало бы с ключом его ряда.
+	forged := `orders{__tenant__="payments"}`
+	assert.ErrorIs(t, s.AddCounter(defaultCtx, forged, 5, nil), model.ErrInvalidName)
+	_, err := s.Delete(defaultCtx, "counter", forged, nil)
+	assert.ErrorIs(t, err, model.ErrInvalidName)
+	_, err = s.GetHistory(defaultCtx, "counter", forged, nil, time.Time{}, time.Now())
+	assert.ErrorIs(t, err, model.ErrInvalidName)
+
+	metrics, err := s.GetMetrics(ctxA)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), *metrics[model.MetricKey("counter", "orders", nil)].Delta)
+}
+
+func TestStorageReservedLabels(t *testing.T) {
+	shared := storage.NewMemStorage()
+	s := tenant.NewStorage(shared)
+
+	// Так пишут StatsD и Graphite: без арендатора в контексте, с метками от клиента.
+	labels := model.Labels{tenant.Label: "payments", "__name__": "x", "host": "a"}
+	require.NoError(t, s.SetGauge(context.Background(), "cpu", 1, labels))
+
+	all, err := shared.GetMetrics(context.Background())
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Contains(t, all, model.MetricKey("gauge", "cpu", model.Labels{"host": "a"}))
+}
+
+func TestStorageUnverified(t *testing.T) {
+	s := tenant.NewStorage(storage.NewMemStorage())
+	ctx := tenant.WithTenant(context.Background(), tenant.Tenant{ID: "a", Key: "k"}, false)
+
+	assert.ErrorIs(t, s.SetGauge(ctx, "Alloc", 1, nil), tenant.ErrUnauthorized)
+	_, err := s.GetMetrics(ctx)
+	assert.ErrorIs(t, err, tenant.ErrUnauthorized)
+
+	tenant.Verify(ctx)
+	assert.NoError(t, s.SetGauge(ctx, "Alloc", 1, nil))
+}
@@ -0,0 +1,76 @@
+// Package tlsconfig собирает настройки TLS сервера и агента из файлов сертификатов в формате PEM.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Server возвращает настройки TLS сервера с сертификатом certFile и ключом keyFile.
+// Если задан clientCAFile, сервер требует сертификат клиента, подписанный одним из
+// удостоверяющих центров этого файла (mTLS).
+func Server(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("для TLS нужны и сертификат, и ключ сервера")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки сертификата сервера: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// Client возвращает настройки TLS агента. caFile - удостоверяющие центры, которым
+// доверяет агент; если он не задан, используются системные. certFile и keyFile -
+// сертификат клиента для mTLS, задаются вместе или не задаются вовсе.
+func Client(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("сертификат и ключ клиента задаются вместе")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка загрузки сертификата клиента: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// loadCertPool читает сертификаты удостоверяющих центров из PEM-файла.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения сертификатов CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("в файле %s нет сертификатов CA", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,117 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert выпускает сертификат, подписанный parent (или самоподписанный), и записывает
+// сертификат и ключ в каталог dir под именем name.
+func writeCert(
+	t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	notAfter := time.Now().Add(time.Hour)
+
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverConfig, err := Server(path("server.crt"), path("server.key"), path("ca.crt"))
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = serverConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(caFile, certFile, keyFile string) (*http.Response, error) {
+		clientConfig, err := Client(caFile, certFile, keyFile)
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		return client.Get(srv.URL)
+	}
+
+	resp, err := get(path("ca.crt"), path("client.crt"), path("client.key"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Без сертификата клиента сервер обрывает рукопожатие.
+	_, err = get(path("ca.crt"), "", "")
+	assert.Error(t, err)
+
+	// Без CA клиент не доверяет сертификату сервера.
+	_, err = get("", path("client.crt"), path("client.key"))
+	assert.Error(t, err)
+}
+
+func TestConfigErrors(t *testing.T) {
+	_, err := Server("", "", "")
+	assert.Error(t, err)
+
+	_, err = Client("", "client.crt", "")
+	assert.Error(t, err)
+
+	_, err = Client(filepath.Join(t.TempDir(), "missing.crt"), "", "")
+	assert.Error(t, err)
+}